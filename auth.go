@@ -31,6 +31,9 @@ metadata implementation is according to:
 
 http://www.smackfu.com/stuff/programming/shoutcast.html
 
+Browser clients can optionally request a stream via a WebSocket upgrade. Audio
+frames are then send as binary messages and meta data as JSON text messages.
+
 Playlists
 
 Playlists provide the data which is send to the client. A simple implementation
@@ -43,8 +46,15 @@ connection.
 package dudeldu
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"regexp"
+	"strings"
+	"time"
 )
 
 /*
@@ -53,22 +63,267 @@ requestAuthPattern is the pattern which is used to extract the request authentic
 */
 var requestAuthPattern = regexp.MustCompile("(?im)^Authorization: Basic (\\S+).*$")
 
+/*
+requestBearerPattern is the pattern which is used to extract a bearer token
+(i case-insensitive / m multi-line mode: ^ and $ match begin/end line)
+*/
+var requestBearerPattern = regexp.MustCompile("(?im)^Authorization: Bearer (\\S+).*$")
+
+/*
+maxAuthFailureEntries is the maximum number of clients whose failed
+authentications are tracked (the oldest entries are discarded first).
+*/
+const maxAuthFailureEntries = 10000
+
+/*
+authPeer is an authenticated peer.
+*/
+type authPeer struct {
+	request string    // Request which contained the authentication
+	time    time.Time // Time of the authentication
+}
+
+/*
+authFailure holds the failed authentications of a client.
+*/
+type authFailure struct {
+	count       int       // Number of failed authentications in the current window
+	start       time.Time // Start of the current window
+	bannedUntil time.Time // Time until the client is refused (zero if the client is not banned)
+}
+
+/*
+authBanned checks if a client is refused because of too many failed
+authentications.
+*/
+func (drh *DefaultRequestHandler) authBanned(clientString string) bool {
+	drh.authFailuresLock.Lock()
+	defer drh.authFailuresLock.Unlock()
+
+	if f, ok := drh.authFailures.Get(clientString); ok {
+		return drh.now().Before(f.(*authFailure).bannedUntil)
+	}
+
+	return false
+}
+
+/*
+recordAuthFailure records a failed authentication of a client. The client is
+banned for AuthBanTime once it failed MaxAuthFailures times within
+AuthFailureWindow.
+*/
+func (drh *DefaultRequestHandler) recordAuthFailure(clientString string, logger DebugLogger) {
+	if drh.MaxAuthFailures <= 0 {
+		return
+	}
+
+	drh.authFailuresLock.Lock()
+	defer drh.authFailuresLock.Unlock()
+
+	now := drh.now()
+
+	f, ok := drh.authFailures.Get(clientString)
+
+	// Start a new window if the old window (or ban) has passed
+
+	if !ok || (now.Sub(f.(*authFailure).start) > drh.AuthFailureWindow && !now.Before(f.(*authFailure).bannedUntil)) {
+		f = &authFailure{start: now}
+		drh.authFailures.Put(clientString, f)
+	}
+
+	af := f.(*authFailure)
+
+	if af.count++; af.count >= drh.MaxAuthFailures {
+		logger.PrintDebug("Banning client after ", af.count, " failed authentications: ", clientString)
+
+		af.bannedUntil = now.Add(drh.AuthBanTime)
+		af.count = 0
+		af.start = af.bannedUntil
+	}
+}
+
+/*
+resetAuthFailures removes all failed authentications of a client.
+*/
+func (drh *DefaultRequestHandler) resetAuthFailures(clientString string) {
+	drh.authFailuresLock.Lock()
+	defer drh.authFailuresLock.Unlock()
+
+	drh.authFailures.Remove(clientString)
+}
+
+/*
+SetCredentials changes the required (basic) authentication string - an empty
+string disables basic authentication. Peers which have been authenticated with
+the old credentials can optionally be forced to authenticate again.
+*/
+func (drh *DefaultRequestHandler) SetCredentials(auth string, clearPeers bool) {
+	drh.authLock.Lock()
+	drh.auth = auth
+	drh.authLock.Unlock()
+
+	if clearPeers {
+		drh.ClearAuthPeers()
+	}
+}
+
+/*
+credentials returns the required (basic) authentication string and the
+authentication strings which were loaded from a file.
+*/
+func (drh *DefaultRequestHandler) credentials() (string, map[string]bool) {
+	drh.authLock.RLock()
+	defer drh.authLock.RUnlock()
+
+	return drh.auth, drh.fileAuth
+}
+
+/*
+WatchAuthFile loads additional (basic) authentication strings from a file and
+checks the file every interval for changes. Each line of the file contains a
+<user>:<pass> pair - empty lines and lines starting with # are ignored. If a
+changed file cannot be parsed the previous credentials are kept. The returned
+function stops watching the file.
+*/
+func (drh *DefaultRequestHandler) WatchAuthFile(path string, interval time.Duration) (func(), error) {
+
+	info, err := os.Stat(path)
+
+	if err == nil {
+		err = drh.loadAuthFile(path)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	stop := make(chan struct{})
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			newInfo, err := os.Stat(path)
+
+			if err != nil || (newInfo.ModTime().Equal(info.ModTime()) && newInfo.Size() == info.Size()) {
+				continue
+			}
+
+			info = newInfo
+
+			if err = drh.loadAuthFile(path); err != nil {
+				drh.logger.PrintDebug("Keeping previous credentials: ", err)
+			} else {
+				drh.logger.PrintDebug("Reloaded credentials from: ", path)
+			}
+		}
+	}()
+
+	return func() { close(stop) }, nil
+}
+
+/*
+loadAuthFile parses an authentication file and replaces the credentials
+which were loaded from a file.
+*/
+func (drh *DefaultRequestHandler) loadAuthFile(path string) error {
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	creds := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if !strings.Contains(line, ":") {
+			return fmt.Errorf("Invalid credentials in line %v of %v", i, path)
+		}
+
+		creds[line] = true
+	}
+
+	drh.authLock.Lock()
+	drh.fileAuth = creds
+	drh.authLock.Unlock()
+
+	return nil
+}
+
+/*
+ClearAuthPeers removes all remembered authenticated peers. All peers need to
+send their authentication again with their next connection.
+*/
+func (drh *DefaultRequestHandler) ClearAuthPeers() {
+	drh.authPeers.Clear()
+}
+
+/*
+AuthPeerCount returns the number of currently remembered authenticated peers.
+*/
+func (drh *DefaultRequestHandler) AuthPeerCount() int {
+	return int(drh.authPeers.Size())
+}
+
 /*
 checkAuth checks the authentication header of a client request.
 */
-func (drh *DefaultRequestHandler) checkAuth(bufStr string, clientString string) (string, string, bool) {
+func (drh *DefaultRequestHandler) checkAuth(bufStr string, clientString string, logger DebugLogger) (string, string, bool) {
 
 	auth := ""
+	required, fileAuth := drh.credentials()
+	requireBasic := required != "" || len(fileAuth) > 0
 	res := requestAuthPattern.FindStringSubmatch(bufStr)
-	origBufStr, hasAuth := drh.authPeers.Get(clientString)
+	bearer := requestBearerPattern.FindStringSubmatch(bufStr)
+	peer, hasAuth := drh.authPeers.Get(clientString)
+
+	// Peers need to authenticate again after a timeout
+
+	if hasAuth && drh.now().Sub(peer.(*authPeer).time) > peerNoAuthTimeout*time.Second {
+		drh.authPeers.Remove(clientString)
+		hasAuth = false
+	}
+
+	if drh.DisableAuthReplay {
+		hasAuth = false
+	}
+
+	if len(bearer) > 1 && drh.BearerTokenValidator != nil {
+
+		// Authorize request with the given token
+
+		if !drh.BearerTokenValidator(bearer[1]) {
+			logger.PrintDebug("Wrong bearer token")
+			return auth, bufStr, false
+		}
+
+		// Peer is now authorized store this so it can connect again
 
-	if len(res) > 1 {
+		if !drh.DisableAuthReplay {
+			drh.authPeers.Put(clientString, &authPeer{bufStr, drh.now()})
+		}
+
+	} else if len(res) > 1 {
 
 		// Decode authentication
 
 		b, err := base64.StdEncoding.DecodeString(res[1])
 		if err != nil {
-			drh.logger.PrintDebug("Invalid request (cannot decode authentication): ", bufStr)
+			logger.PrintDebug("Invalid request (cannot decode authentication): ", bufStr)
 			return auth, bufStr, false
 		}
 
@@ -76,20 +331,24 @@ func (drh *DefaultRequestHandler) checkAuth(bufStr string, clientString string)
 
 		// Authorize request
 
-		if auth != drh.auth && drh.auth != "" {
-			drh.logger.PrintDebug("Wrong authentication:", auth)
+		// Basic authentication is refused if only bearer tokens are accepted
+
+		if (requireBasic || drh.BearerTokenValidator != nil) && (auth != required || required == "") && !fileAuth[auth] {
+			logger.PrintDebug("Wrong authentication:", auth)
 			return auth, bufStr, false
 		}
 
 		// Peer is now authorized store this so it can connect again
 
-		drh.authPeers.Put(clientString, bufStr)
+		if !drh.DisableAuthReplay {
+			drh.authPeers.Put(clientString, &authPeer{bufStr, drh.now()})
+		}
 
-	} else if drh.auth != "" && !hasAuth {
+	} else if (requireBasic || drh.BearerTokenValidator != nil) && !hasAuth {
 
 		// No authorization
 
-		drh.logger.PrintDebug("No authentication found")
+		logger.PrintDebug("No authentication found")
 		return auth, bufStr, false
 
 	} else if bufStr == "" && hasAuth {
@@ -98,7 +357,7 @@ func (drh *DefaultRequestHandler) checkAuth(bufStr string, clientString string)
 		// authentication then connect again on a different port and just
 		// expect the stream
 
-		bufStr = origBufStr.(string)
+		bufStr = peer.(*authPeer).request
 
 		// Get again the authentication
 
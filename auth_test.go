@@ -0,0 +1,422 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package dudeldu
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"devt.de/krotik/common/testutil"
+)
+
+func TestAuthPeerExpiry(t *testing.T) {
+
+	// Use a fake clock
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tpl := &testPlaylist{[][]byte{[]byte("123")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "web:web")
+	drh.now = func() time.Time {
+		return now
+	}
+
+	request := func(req string) string {
+		tpl.fp = 0
+		testConn := &testutil.ErrorTestingConnection{}
+		testConn.In.WriteString(req)
+		drh.HandleRequest(testConn, nil)
+		return testConn.Out.String()
+	}
+
+	if res := request("GET /testpath HTTP/1.1\r\nAuthorization: Basic d2ViOndlYg==\r\n\r\n"); !strings.HasPrefix(res, "ICY 200 OK") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// Peer can connect again without authentication
+
+	now = now.Add(peerNoAuthTimeout * time.Second)
+
+	if res := request("GET /testpath HTTP/1.1\r\n\r\n"); !strings.HasPrefix(res, "ICY 200 OK") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// Authentication expires once the timeout has passed
+
+	now = now.Add(time.Second)
+
+	if res := request("GET /testpath HTTP/1.1\r\n\r\n"); !strings.HasPrefix(res, "HTTP/1.1 401") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+}
+
+func TestFakeClockThrottling(t *testing.T) {
+	var slept time.Duration
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tpl := &testPlaylist{[][]byte{[]byte("12345"), []byte("67890")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+	drh.MaxBytesPerSecond = 10
+	drh.now = func() time.Time {
+		return now
+	}
+	drh.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+
+	testConn := &testutil.ErrorTestingConnection{}
+
+	drh.defaultServeRequest(testConn, &RequestInfo{Path: "/testpath"})
+
+	// Headers are 66 bytes and the data 10 bytes
+
+	if slept != 7600*time.Millisecond {
+		t.Error("Unexpected sleep time:", slept)
+		return
+	}
+}
+
+func TestBearerAuth(t *testing.T) {
+
+	tpl := &testPlaylist{[][]byte{[]byte("123")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+	drh.DisableAuthReplay = true
+	drh.BearerTokenValidator = func(token string) bool {
+		return token == "secret"
+	}
+
+	request := func(req string) string {
+		tpl.fp = 0
+		testConn := &testutil.ErrorTestingConnection{}
+		testConn.In.WriteString(req)
+		drh.HandleRequest(testConn, nil)
+		return testConn.Out.String()
+	}
+
+	if res := request("GET /testpath HTTP/1.1\r\nAuthorization: Bearer secret\r\n\r\n"); !strings.HasPrefix(res, "ICY 200 OK") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	if res := request("GET /testpath HTTP/1.1\r\nAuthorization: Bearer wrong\r\n\r\n"); !strings.HasPrefix(res, "HTTP/1.1 401") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	if res := request("GET /testpath HTTP/1.1\r\n\r\n"); !strings.HasPrefix(res, "HTTP/1.1 401") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// Basic authentication is refused if no credentials are configured
+
+	if res := request("GET /testpath HTTP/1.1\r\nAuthorization: Basic d2ViOndlYg==\r\n\r\n"); !strings.HasPrefix(res, "HTTP/1.1 401") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// Both schemes can be used side by side
+
+	drh.SetCredentials("web:web", false)
+
+	if res := request("GET /testpath HTTP/1.1\r\nAuthorization: Basic d2ViOndlYg==\r\n\r\n"); !strings.HasPrefix(res, "ICY 200 OK") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	if res := request("GET /testpath HTTP/1.1\r\nAuthorization: Bearer secret\r\n\r\n"); !strings.HasPrefix(res, "ICY 200 OK") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// Bearer tokens are ignored without a validator
+
+	drh.BearerTokenValidator = nil
+
+	if res := request("GET /testpath HTTP/1.1\r\nAuthorization: Bearer secret\r\n\r\n"); !strings.HasPrefix(res, "HTTP/1.1 401") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+}
+
+func TestRealm(t *testing.T) {
+
+	tpl := &testPlaylist{[][]byte{[]byte("123")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "web:web")
+
+	request := func() string {
+		testConn := &testutil.ErrorTestingConnection{}
+		testConn.In.WriteString("GET /testpath HTTP/1.1\r\n\r\n")
+		drh.HandleRequest(testConn, nil)
+		return testConn.Out.String()
+	}
+
+	if res := request(); !strings.Contains(res, "\r\nWWW-Authenticate: Basic realm=\"DudelDu Streaming Server\"\r\n") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	drh.Realm = `Radio "Test"`
+
+	if res := request(); !strings.Contains(res, "\r\nWWW-Authenticate: Basic realm=\"Radio \\\"Test\\\"\"\r\n") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+}
+
+func TestAuthPeers(t *testing.T) {
+
+	tpl := &testPlaylist{[][]byte{[]byte("123")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "web:web")
+
+	request := func(req string) string {
+		tpl.fp = 0
+		testConn := &testutil.ErrorTestingConnection{}
+		testConn.In.WriteString(req)
+		drh.HandleRequest(testConn, nil)
+		return testConn.Out.String()
+	}
+
+	authRequest := "GET /testpath HTTP/1.1\r\nAuthorization: Basic d2ViOndlYg==\r\n\r\n"
+	noAuthRequest := "GET /testpath HTTP/1.1\r\n\r\n"
+
+	if res := request(authRequest); !strings.HasPrefix(res, "ICY 200 OK") || drh.AuthPeerCount() != 1 {
+		t.Error("Unexpected response:", res, drh.AuthPeerCount())
+		return
+	}
+
+	if res := request(noAuthRequest); !strings.HasPrefix(res, "ICY 200 OK") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// Cleared peers need to authenticate again
+
+	drh.ClearAuthPeers()
+
+	if res := request(noAuthRequest); !strings.HasPrefix(res, "HTTP/1.1 401") || drh.AuthPeerCount() != 0 {
+		t.Error("Unexpected response:", res, drh.AuthPeerCount())
+		return
+	}
+
+	// Changing the credentials keeps the peers unless requested otherwise
+
+	if res := request(authRequest); !strings.HasPrefix(res, "ICY 200 OK") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	drh.SetCredentials("web:web2", false)
+
+	if res := request(noAuthRequest); !strings.HasPrefix(res, "ICY 200 OK") || drh.AuthPeerCount() != 1 {
+		t.Error("Unexpected response:", res, drh.AuthPeerCount())
+		return
+	}
+
+	drh.SetCredentials("web:web3", true)
+
+	if res := request(noAuthRequest); !strings.HasPrefix(res, "HTTP/1.1 401") || drh.AuthPeerCount() != 0 {
+		t.Error("Unexpected response:", res, drh.AuthPeerCount())
+		return
+	}
+
+	if res := request(authRequest); !strings.HasPrefix(res, "HTTP/1.1 401") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	if res := request("GET /testpath HTTP/1.1\r\nAuthorization: Basic d2ViOndlYjM=\r\n\r\n"); !strings.HasPrefix(res, "ICY 200 OK") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+}
+
+func TestWatchAuthFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "authfile")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	authFile := filepath.Join(dir, "auth")
+
+	writeAuthFile := func(content string, mtime time.Time) {
+		ioutil.WriteFile(authFile, []byte(content), 0644)
+		os.Chtimes(authFile, mtime, mtime)
+	}
+
+	mtime := time.Now().Add(-time.Hour)
+	writeAuthFile("# Users\nweb:web\n", mtime)
+
+	tpl := &testPlaylist{[][]byte{[]byte("123")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+	drh.DisableAuthReplay = true
+
+	if _, err := drh.WatchAuthFile(filepath.Join(dir, "missing"), time.Millisecond); err == nil {
+		t.Error("Missing file should cause an error")
+		return
+	}
+
+	stop, err := drh.WatchAuthFile(authFile, 10*time.Millisecond)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer stop()
+
+	request := func(auth string) string {
+		tpl.fp = 0
+		testConn := &testutil.ErrorTestingConnection{}
+		testConn.In.WriteString("GET /testpath HTTP/1.1\r\nAuthorization: Basic " +
+			base64.StdEncoding.EncodeToString([]byte(auth)) + "\r\n\r\n")
+		drh.HandleRequest(testConn, nil)
+		return testConn.Out.String()
+	}
+
+	if res := request("web:web"); !strings.HasPrefix(res, "ICY 200 OK") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	if res := request("web2:web2"); !strings.HasPrefix(res, "HTTP/1.1 401") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// Add a new user - the change is picked up after the reload interval
+
+	writeAuthFile("web:web\nweb2:web2\n", mtime.Add(time.Second))
+
+	for i := 0; i < 500 && !strings.HasPrefix(request("web2:web2"), "ICY 200 OK"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if res := request("web2:web2"); !strings.HasPrefix(res, "ICY 200 OK") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// A file which cannot be parsed keeps the previous credentials
+
+	writeAuthFile("web:web\nweb3\n", mtime.Add(2*time.Second))
+
+	time.Sleep(100 * time.Millisecond)
+
+	if res := request("web2:web2"); !strings.HasPrefix(res, "ICY 200 OK") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	if err := drh.loadAuthFile(authFile); err == nil || err.Error() != "Invalid credentials in line 2 of "+authFile {
+		t.Error("Unexpected error:", err)
+		return
+	}
+}
+
+func TestAuthBan(t *testing.T) {
+
+	// Use a fake clock
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tpl := &testPlaylist{[][]byte{[]byte("123")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "web:web")
+	drh.DisableAuthReplay = true
+	drh.MaxAuthFailures = 3
+	drh.now = func() time.Time {
+		return now
+	}
+
+	request := func(auth string) string {
+		tpl.fp = 0
+		testConn := &testutil.ErrorTestingConnection{}
+		if auth != "" {
+			auth = "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(auth)) + "\r\n"
+		}
+		testConn.In.WriteString("GET /testpath HTTP/1.1\r\n" + auth + "\r\n")
+		drh.HandleRequest(testConn, nil)
+		return testConn.Out.String()
+	}
+
+	// Requests without authentication are not counted
+
+	for i := 0; i < 5; i++ {
+		if res := request(""); !strings.HasPrefix(res, "HTTP/1.1 401") {
+			t.Error("Unexpected response:", res)
+			return
+		}
+	}
+
+	// A successful authentication resets the counter
+
+	for _, auth := range []string{"web:foo", "web:bar", "web:web", "web:foo", "web:bar"} {
+		if res := request(auth); auth != "web:web" && !strings.HasPrefix(res, "HTTP/1.1 401") {
+			t.Error("Unexpected response:", res)
+			return
+		}
+	}
+
+	// The client is banned after too many failed attempts
+
+	if res := request("web:baz"); !strings.HasPrefix(res, "HTTP/1.1 401") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	if res := request("web:web"); res != "HTTP/1.1 429 Too Many Requests\r\nConnection: close\r\n\r\n" {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// The ban ends after the ban time
+
+	now = now.Add(drh.AuthBanTime - time.Second)
+
+	if res := request("web:web"); !strings.HasPrefix(res, "HTTP/1.1 429") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	now = now.Add(time.Second)
+
+	if res := request("web:web"); !strings.HasPrefix(res, "ICY 200 OK") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// Failed attempts outside of the window are not counted together
+
+	for i := 0; i < 4; i++ {
+		now = now.Add(drh.AuthFailureWindow/2 + time.Second)
+
+		if res := request("web:foo"); !strings.HasPrefix(res, "HTTP/1.1 401") {
+			t.Error("Unexpected response:", i, res)
+			return
+		}
+	}
+
+	if res := request("web:web"); !strings.HasPrefix(res, "ICY 200 OK") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+}
@@ -0,0 +1,99 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package dudeldu
+
+import (
+	"sort"
+	"time"
+)
+
+/*
+ConnSnapshot holds the state of an active streaming connection.
+*/
+type ConnSnapshot struct {
+	ID             string    // ID of the connection
+	Path           string    // Streamed path
+	ClientIP       string    // IP address of the client (may be empty)
+	CurrentPlaying string    // Currently playing track as "<title> - <artist>"
+	WrittenBytes   uint64    // Number of audio bytes which have been send to the client
+	Start          time.Time // Time when the connection started streaming
+}
+
+/*
+Connections returns snapshots of all active streaming connections ordered by
+their start time.
+*/
+func (drh *DefaultRequestHandler) Connections() []ConnSnapshot {
+	drh.connectionsLock.RLock()
+
+	ret := make([]ConnSnapshot, 0, len(drh.connections))
+	for _, cs := range drh.connections {
+		ret = append(ret, *cs)
+	}
+
+	drh.connectionsLock.RUnlock()
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Start.Equal(ret[j].Start) {
+			return ret[i].ID < ret[j].ID
+		}
+		return ret[i].Start.Before(ret[j].Start)
+	})
+
+	return ret
+}
+
+/*
+startConnection registers a new streaming connection. Returns the ID of the
+connection.
+*/
+func (drh *DefaultRequestHandler) startConnection(id string, path string, clientIP string) string {
+	drh.connectionsLock.Lock()
+	defer drh.connectionsLock.Unlock()
+
+	// Connections which were not started by HandleRequest have no ID
+
+	for id == "" || drh.connections[id] != nil {
+		id = newRequestID()
+	}
+
+	drh.connections[id] = &ConnSnapshot{
+		ID:       id,
+		Path:     path,
+		ClientIP: clientIP,
+		Start:    drh.now(),
+	}
+
+	return id
+}
+
+/*
+updateConnection records the progress of a streaming connection.
+*/
+func (drh *DefaultRequestHandler) updateConnection(id string, currentPlaying string, written int) {
+	drh.connectionsLock.Lock()
+	defer drh.connectionsLock.Unlock()
+
+	if cs, ok := drh.connections[id]; ok {
+		cs.CurrentPlaying = currentPlaying
+		cs.WrittenBytes += uint64(written)
+	}
+}
+
+/*
+stopConnection unregisters a streaming connection.
+*/
+func (drh *DefaultRequestHandler) stopConnection(id string) {
+	drh.connectionsLock.Lock()
+	defer drh.connectionsLock.Unlock()
+
+	delete(drh.connections, id)
+}
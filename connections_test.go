@@ -0,0 +1,77 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package dudeldu
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnections(t *testing.T) {
+
+	tpl := &testPlaylist{[][]byte{[]byte("123"), []byte("4567")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, true, false, "")
+
+	if res := drh.Connections(); len(res) != 0 {
+		t.Error("Unexpected connections:", res)
+		return
+	}
+
+	c1, c2 := net.Pipe()
+
+	done := make(chan bool)
+
+	go func() {
+		drh.defaultServeRequest(c1, &RequestInfo{Path: "/testpath", ID: "abc"})
+		close(done)
+	}()
+
+	// Read the headers and the first loop of the playlist
+
+	if _, err := io.ReadFull(c2, make([]byte, 66+7)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	var res []ConnSnapshot
+
+	for i := 0; i < 500; i++ {
+		if res = drh.Connections(); len(res) == 1 && res[0].WrittenBytes >= 7 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(res) != 1 || res[0].ID != "abc" || res[0].Path != "/testpath" ||
+		res[0].CurrentPlaying != "Test Title - Test Artist" || res[0].WrittenBytes < 7 ||
+		res[0].Start.IsZero() {
+		t.Error("Unexpected connections:", res)
+		return
+	}
+
+	// The connection is removed once the client disconnects
+
+	c2.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("Server did not stop writing")
+		return
+	}
+
+	if res := drh.Connections(); len(res) != 0 {
+		t.Error("Unexpected connections:", res)
+		return
+	}
+}
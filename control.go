@@ -0,0 +1,37 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package dudeldu
+
+/*
+SkipTrack signals all connections which currently stream the playlist of a given
+path to skip the currently playing track. Connections on other paths of the same
+playlist (e.g. aliases) skip as well. Only playlists which implement
+SkippablePlaylist can skip tracks.
+*/
+func (drh *DefaultRequestHandler) SkipTrack(path string) {
+	name := drh.playlistName(path)
+
+	drh.skipsLock.Lock()
+	defer drh.skipsLock.Unlock()
+
+	drh.skips[name]++
+}
+
+/*
+skipCounter returns the number of skip requests for a given playlist name. A
+connection should skip a track whenever this counter changes.
+*/
+func (drh *DefaultRequestHandler) skipCounter(name string) uint64 {
+	drh.skipsLock.RLock()
+	defer drh.skipsLock.RUnlock()
+
+	return drh.skips[name]
+}
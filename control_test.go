@@ -0,0 +1,146 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package dudeldu
+
+import (
+	"strings"
+	"testing"
+
+	"devt.de/krotik/common/testutil"
+)
+
+/*
+testSkipPlaylist is a playlist for testing which can skip tracks
+*/
+type testSkipPlaylist struct {
+	Tracks  [][][]byte
+	OnFrame func()
+	track   int
+	frame   int
+}
+
+func (tp *testSkipPlaylist) Name() string {
+	return "TestPlaylist"
+}
+
+func (tp *testSkipPlaylist) ContentType() string {
+	return "Test/Content"
+}
+
+func (tp *testSkipPlaylist) Artist() string {
+	return "Test Artist"
+}
+
+func (tp *testSkipPlaylist) Title() string {
+	return string(rune('A' + tp.track))
+}
+
+func (tp *testSkipPlaylist) Frame() ([]byte, error) {
+	f := tp.Tracks[tp.track][tp.frame]
+	if tp.frame++; tp.frame == len(tp.Tracks[tp.track]) {
+		tp.Skip()
+	}
+	if tp.OnFrame != nil {
+		tp.OnFrame()
+	}
+	return f, nil
+}
+
+func (tp *testSkipPlaylist) Skip() error {
+	tp.track++
+	tp.frame = 0
+	return nil
+}
+
+func (tp *testSkipPlaylist) ReleaseFrame([]byte) {
+}
+
+func (tp *testSkipPlaylist) Finished() bool {
+	return tp.track == len(tp.Tracks)
+}
+
+func (tp *testSkipPlaylist) Close() error {
+	tp.track = 0
+	tp.frame = 0
+	return nil
+}
+
+func TestSkipTrack(t *testing.T) {
+
+	tpl := &testSkipPlaylist{Tracks: [][][]byte{
+		{[]byte("a1"), []byte("a2"), []byte("a3")},
+		{[]byte("b1"), []byte("b2")},
+	}}
+
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+
+	// Skip requests before the stream started are ignored
+
+	drh.SkipTrack("/testpath")
+
+	// Skip the first track once its first frame has been read
+
+	tpl.OnFrame = func() {
+		tpl.OnFrame = nil
+		drh.SkipTrack("/testpath")
+		drh.SkipTrack("/otherpath")
+	}
+
+	testConn := &testutil.ErrorTestingConnection{}
+
+	drh.defaultServeRequest(testConn, &RequestInfo{Path: "/testpath"})
+
+	if testConn.Out.String() != "ICY 200 OK\r\n"+
+		"Content-Type: Test/Content\r\n"+
+		"icy-name: TestPlaylist\r\n"+
+		"\r\n"+
+		"a1b1b2" {
+		t.Error("Unexpected response:", testConn.Out.String())
+		return
+	}
+}
+
+func TestSkipTrackAlias(t *testing.T) {
+
+	tpl := &testSkipPlaylist{Tracks: [][][]byte{
+		{[]byte("a1"), []byte("a2"), []byte("a3")},
+		{[]byte("b1"), []byte("b2")},
+	}}
+
+	drh := NewDefaultRequestHandler(&testListablePlaylistFactory{map[string]Playlist{
+		"/live":   tpl,
+		"/stream": tpl,
+	}}, false, false, "")
+
+	// Paths which serve the same playlist share the current track and skips
+
+	var info *TrackInfo
+
+	tpl.OnFrame = func() {
+		tpl.OnFrame = nil
+		info = drh.NowPlaying("/live")
+		drh.SkipTrack("/live")
+	}
+
+	testConn := &testutil.ErrorTestingConnection{}
+
+	drh.defaultServeRequest(testConn, &RequestInfo{Path: "/stream"})
+
+	if !strings.HasSuffix(testConn.Out.String(), "\r\n\r\na1b1b2") {
+		t.Error("Unexpected response:", testConn.Out.String())
+		return
+	}
+
+	if info == nil || info.Title != tpl.Title() {
+		t.Error("Unexpected track info:", info)
+		return
+	}
+}
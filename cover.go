@@ -0,0 +1,119 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package dudeldu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+/*
+CoverPathSuffix is the path suffix which requests the cover image of the
+current track of a stream (e.g. /foo/bar/cover for the stream /foo/bar).
+*/
+const CoverPathSuffix = "/cover"
+
+/*
+requestIfModifiedSincePattern is the pattern which is used to extract the time of
+a cached copy of a resource
+(i case-insensitive / m multi-line mode: ^ and $ match begin/end line)
+*/
+var requestIfModifiedSincePattern = regexp.MustCompile("(?im)^If-Modified-Since: (.+?)\\s*$")
+
+/*
+coverPath returns the cover image of the current track of a given path. If the
+path is not streamed at the moment the cover is requested from the playlist
+factory.
+*/
+func (drh *DefaultRequestHandler) coverPath(path string) string {
+	cover := ""
+	name := drh.playlistName(path)
+
+	drh.nowPlayingLock.RLock()
+	np, streaming := drh.nowPlaying[name]
+	if streaming {
+		streaming = np.info != nil
+		cover = np.cover
+	}
+	drh.nowPlayingLock.RUnlock()
+
+	if streaming {
+		return cover
+	}
+
+	// Playlists are not created here since factories may return shared
+	// instances which must not be closed
+
+	if ipf, ok := drh.playlistFactory().(PlaylistInfoFactory); ok {
+		return ipf.Cover(path)
+	}
+
+	return ""
+}
+
+/*
+writeCover writes the cover image of the current track of a given path to the
+client. The content type is determined by the file extension. Clients which
+send an If-Modified-Since header get a Not Modified response if the image file
+has not changed since then.
+*/
+func (drh *DefaultRequestHandler) writeCover(c net.Conn, path string, request string) error {
+	version := requestHTTPVersion(request)
+	cover := drh.coverPath(path)
+
+	if cover == "" {
+		return drh.writeStreamNotFoundResponse(c, version)
+	}
+
+	info, err := os.Stat(cover)
+	if err != nil {
+		return drh.writeStreamNotFoundResponse(c, version)
+	}
+
+	// The modification time is send with a resolution of seconds
+
+	modTime := info.ModTime().UTC().Truncate(time.Second)
+
+	if res := requestIfModifiedSincePattern.FindStringSubmatch(request); len(res) > 1 {
+		if since, err := http.ParseTime(res[1]); err == nil && !modTime.After(since) {
+			_, err = c.Write([]byte(fmt.Sprintf("%v 304 Not Modified\r\n"+
+				"Last-Modified: %v\r\n"+
+				"Connection: close\r\n\r\n", version, modTime.Format(http.TimeFormat))))
+
+			return err
+		}
+	}
+
+	data, err := ioutil.ReadFile(cover)
+	if err != nil {
+		return drh.writeStreamNotFoundResponse(c, version)
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(cover))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	_, err = c.Write([]byte(fmt.Sprintf("%v 200 OK\r\n"+
+		"Content-Type: %v\r\n"+
+		"Content-Length: %v\r\n"+
+		"Last-Modified: %v\r\n"+
+		"Connection: close\r\n\r\n%s", version, contentType, len(data), modTime.Format(http.TimeFormat), data)))
+
+	return err
+}
@@ -0,0 +1,166 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package dudeldu
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"devt.de/krotik/common/testutil"
+)
+
+/*
+testCoverPlaylist is a playlist for testing which has a cover image
+*/
+type testCoverPlaylist struct {
+	testPlaylist
+	cover string
+}
+
+func (tp *testCoverPlaylist) Cover() string {
+	return tp.cover
+}
+
+func TestCover(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "dudeldu")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	png := []byte("\x89PNG\r\n\x1a\ntest")
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "cover.png"), png, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "cover2.jpg"), []byte("jpg"), 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	modTime := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	os.Chtimes(filepath.Join(dir, "cover.png"), modTime, modTime)
+	os.Chtimes(filepath.Join(dir, "cover2.jpg"), modTime, modTime)
+
+	tpl := &testCoverPlaylist{testPlaylist{[][]byte{[]byte("123")}, nil, 1}, filepath.Join(dir, "cover.png")}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+
+	requestHeaders := func(path string, headers string) string {
+		testConn := &testutil.ErrorTestingConnection{}
+		testConn.In.WriteString("GET " + path + CoverPathSuffix + " HTTP/1.1\r\n" + headers + "\r\n")
+		drh.HandleRequest(testConn, nil)
+		return testConn.Out.String()
+	}
+
+	request := func(path string) string {
+		return requestHeaders(path, "")
+	}
+
+	notFound := "HTTP/1.1 404 Not found\r\nConnection: close\r\n\r\n"
+
+	if res := request("/testpath"); res != "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: image/png\r\n"+
+		"Content-Length: 12\r\n"+
+		"Last-Modified: Wed, 01 Jan 2020 12:00:00 GMT\r\n"+
+		"Connection: close\r\n\r\n"+string(png) {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// Unchanged covers are not send again
+
+	notModified := "HTTP/1.1 304 Not Modified\r\n" +
+		"Last-Modified: Wed, 01 Jan 2020 12:00:00 GMT\r\n" +
+		"Connection: close\r\n\r\n"
+
+	if res := requestHeaders("/testpath", "If-Modified-Since: Thu, 01 Jan 2099 00:00:00 GMT\r\n"); res != notModified {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	if res := requestHeaders("/testpath", "If-Modified-Since: Wed, 01 Jan 2020 12:00:00 GMT\r\n"); res != notModified {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	if res := requestHeaders("/testpath", "If-Modified-Since: Tue, 31 Dec 2019 12:00:00 GMT\r\n"); !strings.HasPrefix(res, "HTTP/1.1 200 OK") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	if res := requestHeaders("/testpath", "If-Modified-Since: yesterday\r\n"); !strings.HasPrefix(res, "HTTP/1.1 200 OK") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// The playlist of the factory is not closed by cover requests
+
+	if tpl.fp != 1 {
+		t.Error("Playlist should not have been closed")
+		return
+	}
+
+	if res := request("/unknown"); res != notFound {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// The cover of the current track is used while the path is streamed
+
+	drh.startNowPlaying(tpl.Name())
+
+	tpl.cover = filepath.Join(dir, "cover2.jpg")
+	drh.updateNowPlaying(tpl.Name(), tpl)
+	tpl.cover = ""
+
+	if res := request("/testpath"); res != "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: image/jpeg\r\n"+
+		"Content-Length: 3\r\n"+
+		"Last-Modified: Wed, 01 Jan 2020 12:00:00 GMT\r\n"+
+		"Connection: close\r\n\r\n"+"jpg" {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	drh.stopNowPlaying(tpl.Name())
+
+	// Tracks without a cover or with a missing cover file
+
+	if res := request("/testpath"); res != notFound {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	tpl.cover = filepath.Join(dir, "missing.png")
+
+	if res := request("/testpath"); res != notFound {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// Playlists which do not know covers
+
+	drh = NewDefaultRequestHandler(&testPlaylistFactory{&tpl.testPlaylist}, false, false, "")
+
+	if res := request("/testpath"); res != notFound {
+		t.Error("Unexpected response:", res)
+		return
+	}
+}
@@ -0,0 +1,197 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+/*
+Package dudeldutest contains helpers for testing code which embeds DudelDu.
+
+TestServer
+
+TestServer is a running DudelDu server with a DefaultRequestHandler which
+listens on a free local port. Requests can be send with the Request method
+which returns all bytes the server has send:
+
+	ts, err := dudeldutest.NewTestServer(myPlaylistFactory)
+	...
+	defer ts.Close()
+
+	res, err := ts.Request("/mystream", "Icy-MetaData: 1")
+
+CaptureLogger
+
+CaptureLogger is a DebugLogger which collects all debug output so it can be
+checked by tests.
+*/
+package dudeldutest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"devt.de/krotik/dudeldu"
+)
+
+/*
+CaptureLogger is a DebugLogger which captures all debug output.
+*/
+type CaptureLogger struct {
+	buf  bytes.Buffer // Captured output
+	lock sync.Mutex   // Lock for the captured output
+}
+
+/*
+IsDebugOutputEnabled returns true - debug output is always captured.
+*/
+func (cl *CaptureLogger) IsDebugOutputEnabled() bool {
+	return true
+}
+
+/*
+PrintDebug captures debug output. Each call produces one line.
+*/
+func (cl *CaptureLogger) PrintDebug(v ...interface{}) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	cl.buf.WriteString(fmt.Sprint(v...))
+	cl.buf.WriteString("\n")
+}
+
+/*
+String returns all captured output.
+*/
+func (cl *CaptureLogger) String() string {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	return cl.buf.String()
+}
+
+/*
+Reset discards all captured output.
+*/
+func (cl *CaptureLogger) Reset() {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	cl.buf.Reset()
+}
+
+/*
+listenAddr is the address a TestServer listens on (can be replaced for unit tests).
+*/
+var listenAddr = "127.0.0.1:0"
+
+/*
+TestServer is a running DudelDu server for testing.
+*/
+type TestServer struct {
+	*dudeldu.Server                                // Running server
+	Handler         *dudeldu.DefaultRequestHandler // Request handler of the server
+	Logger          *CaptureLogger                 // Logger which captures the debug output of the handler
+	Addr            string                         // Address the server is listening on
+	wg              *sync.WaitGroup                // Wait group which is notified once the server has stopped
+	closeOnce       sync.Once                      // Ensures that the server is shut down only once
+	closeErr        error                          // Result of shutting down the server
+}
+
+/*
+NewTestServer starts a new DudelDu server with a DefaultRequestHandler for
+a given PlaylistFactory. The server listens on a free local port.
+*/
+func NewTestServer(pf dudeldu.PlaylistFactory) (*TestServer, error) {
+	var wg sync.WaitGroup
+
+	logger := &CaptureLogger{}
+
+	rh := dudeldu.NewDefaultRequestHandler(pf, false, false, "")
+	rh.SetDebugLogger(logger)
+
+	ts := &TestServer{Server: dudeldu.NewServer(rh.HandleRequest), Handler: rh, Logger: logger, wg: &wg}
+	ts.PollTimeout = 50 * time.Millisecond
+
+	wg.Add(1)
+
+	// Let the OS choose a free local port
+
+	runErr := make(chan error, 1)
+
+	go func() {
+		runErr <- ts.Run(listenAddr, &wg)
+	}()
+
+	wg.Wait()
+
+	// The server has no address if it could not listen
+
+	addr := ts.Server.Addr()
+	if addr == nil {
+		return nil, <-runErr
+	}
+
+	ts.Addr = addr.String()
+
+	// The server notifies the wait group again once it has stopped
+
+	wg.Add(1)
+
+	return ts, nil
+}
+
+/*
+Dial opens a new client connection to the server.
+*/
+func (ts *TestServer) Dial() (net.Conn, error) {
+	return net.Dial("tcp", ts.Addr)
+}
+
+/*
+Request sends a GET request for a given path with optional additional header
+lines and returns everything which is send back until the server closes the
+connection.
+*/
+func (ts *TestServer) Request(path string, headers ...string) (string, error) {
+	var buf bytes.Buffer
+
+	conn, err := ts.Dial()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	req := fmt.Sprintf("GET %v HTTP/1.1\r\nHost: %v\r\n", path, ts.Addr)
+
+	if len(headers) > 0 {
+		req += strings.Join(headers, "\r\n") + "\r\n"
+	}
+
+	if _, err = conn.Write([]byte(req + "\r\n")); err == nil {
+		_, err = io.Copy(&buf, conn)
+	}
+
+	return buf.String(), err
+}
+
+/*
+Close shuts the server down and waits until it has stopped. Further calls
+return the result of the first call.
+*/
+func (ts *TestServer) Close() error {
+	ts.closeOnce.Do(func() {
+		ts.closeErr = ts.ShutdownAndWait()
+		ts.wg.Wait()
+	})
+
+	return ts.closeErr
+}
@@ -0,0 +1,147 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package dudeldutest
+
+import (
+	"strings"
+	"testing"
+
+	"devt.de/krotik/dudeldu"
+)
+
+type testPlaylistFactory struct {
+}
+
+func (tp *testPlaylistFactory) Playlist(path string, shuffle bool) dudeldu.Playlist {
+	if path == "/testpath" {
+		return &testPlaylist{}
+	}
+	return nil
+}
+
+type testPlaylist struct {
+	played bool
+}
+
+func (tp *testPlaylist) Name() string {
+	return "TestPlaylist"
+}
+
+func (tp *testPlaylist) ContentType() string {
+	return "audio/mpeg"
+}
+
+func (tp *testPlaylist) Artist() string {
+	return "Test Artist"
+}
+
+func (tp *testPlaylist) Title() string {
+	return "Test Title"
+}
+
+func (tp *testPlaylist) Frame() ([]byte, error) {
+	tp.played = true
+	return []byte("12345"), dudeldu.ErrPlaylistEnd
+}
+
+func (tp *testPlaylist) ReleaseFrame([]byte) {
+}
+
+func (tp *testPlaylist) Finished() bool {
+	return tp.played
+}
+
+func (tp *testPlaylist) Close() error {
+	tp.played = false
+	return nil
+}
+
+func TestTestServer(t *testing.T) {
+
+	ts, err := NewTestServer(&testPlaylistFactory{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !ts.IsRunning() {
+		t.Error("Server should be running")
+		return
+	}
+
+	res, err := ts.Request("/testpath")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res != "ICY 200 OK\r\n"+
+		"Content-Type: audio/mpeg\r\n"+
+		"icy-name: TestPlaylist\r\n"+
+		"\r\n"+
+		"12345" {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	res, err = ts.Request("/foo", "Icy-MetaData: 1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res != "HTTP/1.1 404 Not found\r\nConnection: close\r\n\r\n" {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	if out := ts.Logger.String(); !strings.Contains(out, "Serve request path:/testpath complete") ||
+		!strings.Contains(out, "Serve request path:/foo Metadata support:true") {
+		t.Error("Unexpected log output:", out)
+		return
+	}
+
+	ts.Logger.Reset()
+
+	if out := ts.Logger.String(); out != "" {
+		t.Error("Unexpected log output:", out)
+		return
+	}
+
+	if err := ts.Close(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if ts.IsRunning() {
+		t.Error("Server should not be running")
+		return
+	}
+
+	// Closing the server again does nothing
+
+	if err := ts.Close(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Listen errors are returned
+
+	listenAddr = "127.0.0.1:abc"
+	defer func() {
+		listenAddr = "127.0.0.1:0"
+	}()
+
+	if ts, err := NewTestServer(&testPlaylistFactory{}); err == nil || ts != nil {
+		t.Error("Unexpected result:", ts, err)
+		return
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package dudeldu
+
+import "time"
+
+/*
+TrackEvent is send to subscribers whenever a stream starts sending a new track.
+*/
+type TrackEvent struct {
+	Path      string    // Path of the stream
+	Artist    string    // Artist of the new track
+	Title     string    // Title of the new track
+	Timestamp time.Time // Time when the track change was detected
+}
+
+/*
+Subscribe registers a channel which receives track events. Events are dropped
+if the channel is full so a slow subscriber cannot stall streaming.
+*/
+func (drh *DefaultRequestHandler) Subscribe(ch chan<- *TrackEvent) {
+	drh.subscribersLock.Lock()
+	defer drh.subscribersLock.Unlock()
+
+	drh.subscribers = append(drh.subscribers, ch)
+}
+
+/*
+Unsubscribe removes a previously registered channel.
+*/
+func (drh *DefaultRequestHandler) Unsubscribe(ch chan<- *TrackEvent) {
+	drh.subscribersLock.Lock()
+	defer drh.subscribersLock.Unlock()
+
+	for i, s := range drh.subscribers {
+		if s == ch {
+			drh.subscribers = append(drh.subscribers[:i], drh.subscribers[i+1:]...)
+			break
+		}
+	}
+}
+
+/*
+notifyTrackChange sends a track event to all subscribers.
+*/
+func (drh *DefaultRequestHandler) notifyTrackChange(path string, pl Playlist) {
+	drh.subscribersLock.RLock()
+	defer drh.subscribersLock.RUnlock()
+
+	if len(drh.subscribers) == 0 {
+		return
+	}
+
+	event := &TrackEvent{path, pl.Artist(), pl.Title(), drh.now()}
+
+	for _, s := range drh.subscribers {
+		select {
+		case s <- event:
+		default:
+		}
+	}
+}
@@ -0,0 +1,76 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package dudeldu
+
+import (
+	"testing"
+
+	"devt.de/krotik/common/testutil"
+)
+
+/*
+testTrackPlaylist is a playlist for testing which has a title for each frame
+*/
+type testTrackPlaylist struct {
+	testPlaylist
+	Titles []string
+}
+
+func (tp *testTrackPlaylist) Title() string {
+	if tp.fp < len(tp.Titles) {
+		return tp.Titles[tp.fp]
+	}
+	return tp.Titles[len(tp.Titles)-1]
+}
+
+func TestTrackEvents(t *testing.T) {
+
+	tpl := &testTrackPlaylist{testPlaylist{[][]byte{[]byte("12"), []byte("34"), []byte("56")}, nil, 0},
+		[]string{"Track1", "Track1", "Track2"}}
+
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+	drh.SetDebugLogger(&TestDebugLogger{false, nil})
+
+	events := make(chan *TrackEvent, 10)
+	full := make(chan *TrackEvent)
+
+	drh.Subscribe(events)
+	drh.Subscribe(full)
+
+	drh.defaultServeRequest(&testutil.ErrorTestingConnection{}, &RequestInfo{Path: "/testpath"})
+
+	if len(events) != 2 {
+		t.Error("Unexpected number of events:", len(events))
+		return
+	}
+
+	if e := <-events; e.Path != "/testpath" || e.Title != "Track1" || e.Artist != "Test Artist" || e.Timestamp.IsZero() {
+		t.Error("Unexpected event:", e)
+		return
+	}
+
+	if e := <-events; e.Path != "/testpath" || e.Title != "Track2" || e.Artist != "Test Artist" {
+		t.Error("Unexpected event:", e)
+		return
+	}
+
+	// Check that unsubscribed channels get no more events
+
+	drh.Unsubscribe(events)
+
+	tpl.fp = 0
+	drh.defaultServeRequest(&testutil.ErrorTestingConnection{}, &RequestInfo{Path: "/testpath"})
+
+	if len(events) != 0 {
+		t.Error("Unexpected number of events:", len(events))
+		return
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package dudeldu
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+jsonLogFields maps labels of debug output to fields of JSON log events
+*/
+var jsonLogFields = map[string]string{
+	"handling request from": "client",
+	"client":                "client",
+	"serve request path":    "path",
+	"written bytes":         "bytes",
+}
+
+/*
+JSONLogger is a DebugLogger which writes one JSON object per log event. This
+makes the debug output easy to ingest into a log aggregator.
+*/
+type JSONLogger struct {
+	DebugOutput bool       // Enable debugging output
+	Out         io.Writer  // Writer for log events
+	lock        sync.Mutex // Lock for writing log events
+}
+
+/*
+NewJSONLogger creates a new JSONLogger which writes to a given writer.
+*/
+func NewJSONLogger(out io.Writer, debugOutput bool) *JSONLogger {
+	return &JSONLogger{DebugOutput: debugOutput, Out: out}
+}
+
+/*
+IsDebugOutputEnabled returns true if debug output is enabled.
+*/
+func (jl *JSONLogger) IsDebugOutputEnabled() bool {
+	return jl.DebugOutput
+}
+
+/*
+PrintDebug writes a log event if `DebugOutput` is enabled. Well-known labelled
+values (e.g. "Serve request path:", path) are written as separate fields.
+*/
+func (jl *JSONLogger) PrintDebug(v ...interface{}) {
+	if !jl.DebugOutput {
+		return
+	}
+
+	event := map[string]interface{}{
+		"level":     "debug",
+		"timestamp": time.Now().UTC().Format(time.RFC3339Nano),
+	}
+
+	// Request IDs are written as a separate field
+
+	if len(v) > 0 {
+		if id, ok := v[0].(requestID); ok {
+			event["request"] = string(id)
+			v = v[1:]
+		}
+	}
+
+	event["msg"] = fmt.Sprint(v...)
+
+	for i, val := range v {
+
+		if _, ok := val.(error); ok {
+			event["level"] = "error"
+
+		} else if label, ok := val.(string); ok && i+1 < len(v) {
+
+			if field, ok := jsonLogFields[strings.ToLower(strings.Trim(label, " :"))]; ok {
+
+				// Use numbers as they are - everything else is converted to a string
+
+				switch fv := v[i+1].(type) {
+				case int, int64, uint64:
+					event[field] = fv
+				default:
+					event[field] = fmt.Sprint(fv)
+				}
+			}
+		}
+	}
+
+	line, _ := json.Marshal(event)
+
+	jl.lock.Lock()
+	defer jl.lock.Unlock()
+
+	jl.Out.Write(append(line, '\n'))
+}
@@ -0,0 +1,102 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package dudeldu
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"devt.de/krotik/common/testutil"
+)
+
+func TestJSONLogger(t *testing.T) {
+	var out bytes.Buffer
+
+	tpl := &testPlaylist{[][]byte{[]byte("123")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+	drh.SetDebugLogger(NewJSONLogger(&out, true))
+
+	testConn := &testutil.ErrorTestingConnection{}
+	testConn.In.WriteString("GET /testpath HTTP/1.1\r\n\r\n")
+
+	drh.HandleRequest(testConn, nil)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	events := make([]map[string]interface{}, 0, len(lines))
+
+	for _, line := range lines {
+		var event map[string]interface{}
+
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Error("Unparsable log line:", line, err)
+			return
+		}
+
+		if event["level"] != "debug" || event["msg"] == "" || len(event["request"].(string)) != 8 {
+			t.Error("Unexpected log event:", event)
+			return
+		}
+
+		if _, err := time.Parse(time.RFC3339Nano, event["timestamp"].(string)); err != nil {
+			t.Error("Unexpected timestamp:", event)
+			return
+		}
+
+		events = append(events, event)
+	}
+
+	if len(events) != 6 {
+		t.Error("Unexpected number of log events:", out.String())
+		return
+	}
+
+	if events[0]["client"] != "<nil>" || events[0]["msg"] != "Handling request from: <nil>" {
+		t.Error("Unexpected log event:", events[0])
+		return
+	}
+
+	if events[2]["path"] != "/testpath" {
+		t.Error("Unexpected log event:", events[2])
+		return
+	}
+
+	if events[3]["bytes"] != float64(0) {
+		t.Error("Unexpected log event:", events[3])
+		return
+	}
+
+	// Errors are logged with the error level
+
+	out.Reset()
+
+	NewJSONLogger(&out, true).PrintDebug(errors.New("test error"))
+
+	if res := out.String(); !strings.Contains(res, `"level":"error"`) ||
+		!strings.Contains(res, `"msg":"test error"`) {
+		t.Error("Unexpected log event:", res)
+		return
+	}
+
+	// No output if debug output is disabled
+
+	out.Reset()
+
+	NewJSONLogger(&out, false).PrintDebug("test")
+
+	if out.Len() != 0 {
+		t.Error("Unexpected output:", out.String())
+		return
+	}
+}
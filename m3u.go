@@ -0,0 +1,85 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package dudeldu
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+/*
+PlaylistsM3UPath is the path which returns a M3U playlist with the stream URLs
+of all paths which can be served.
+*/
+const PlaylistsM3UPath = "/playlists.m3u"
+
+/*
+requestHostPattern is the pattern which is used to extract the requested host
+(i case-insensitive / m multi-line mode: ^ and $ match begin/end line)
+*/
+var requestHostPattern = regexp.MustCompile("(?im)^Host:\\s*(\\S+).*$")
+
+/*
+writePlaylistsM3U writes a M3U playlist with the stream URLs of all paths
+which can be served by the current playlist factory. The URLs are built from
+the Host header of the request.
+*/
+func (drh *DefaultRequestHandler) writePlaylistsM3U(c net.Conn, request string) error {
+	var buf bytes.Buffer
+
+	version := requestHTTPVersion(request)
+	paths := drh.Paths()
+	pf := drh.playlistFactory()
+
+	if paths == nil || pf == nil {
+		return drh.writeStreamNotFoundResponse(c, version)
+	}
+
+	// Use the local address if the client did not send a Host header
+
+	host := ""
+	if res := requestHostPattern.FindStringSubmatch(request); len(res) > 1 {
+		host = res[1]
+	} else if c.LocalAddr() != nil {
+		host = c.LocalAddr().String()
+	}
+
+	buf.WriteString("#EXTM3U\n")
+
+	for _, path := range paths {
+		name := path
+
+		// Playlists are not created here since factories may return shared
+		// instances which must not be closed
+
+		if ipf, ok := pf.(PlaylistInfoFactory); ok {
+			if n := ipf.DisplayName(path); n != "" {
+				name = n
+			}
+		}
+
+		// Line breaks would start a new entry
+
+		name = strings.NewReplacer("\r", " ", "\n", " ").Replace(name)
+
+		buf.WriteString(fmt.Sprintf("#EXTINF:-1,%v\nhttp://%v%v\n", name, host, path))
+	}
+
+	_, err := c.Write([]byte(fmt.Sprintf("%v 200 OK\r\n"+
+		"Content-Type: audio/x-mpegurl\r\n"+
+		"Content-Length: %v\r\n"+
+		"Connection: close\r\n\r\n%s", version, buf.Len(), buf.Bytes())))
+
+	return err
+}
@@ -0,0 +1,115 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package dudeldu
+
+import (
+	"sort"
+	"testing"
+
+	"devt.de/krotik/common/testutil"
+)
+
+/*
+testListablePlaylistFactory is a playlist factory for testing which knows its paths
+*/
+type testListablePlaylistFactory struct {
+	playlists map[string]Playlist
+}
+
+func (tf *testListablePlaylistFactory) Playlist(path string, shuffle bool) Playlist {
+	return tf.playlists[path]
+}
+
+func (tf *testListablePlaylistFactory) DisplayName(path string) string {
+	if pl, ok := tf.playlists[path]; ok {
+		return displayName(pl)
+	}
+	return ""
+}
+
+func (tf *testListablePlaylistFactory) PlaylistName(path string) string {
+	if pl, ok := tf.playlists[path]; ok {
+		return pl.Name()
+	}
+	return ""
+}
+
+func (tf *testListablePlaylistFactory) Cover(path string) string {
+	return ""
+}
+
+func (tf *testListablePlaylistFactory) Paths() []string {
+	var paths []string
+	for path := range tf.playlists {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+/*
+testNamedPlaylist is a playlist for testing which has a display name
+*/
+type testNamedPlaylist struct {
+	testPlaylist
+	name string
+}
+
+func (tp *testNamedPlaylist) DisplayName() string {
+	return tp.name
+}
+
+func TestPlaylistsM3U(t *testing.T) {
+
+	rock := &testPlaylist{[][]byte{[]byte("123")}, nil, 1}
+
+	drh := NewDefaultRequestHandler(&testListablePlaylistFactory{map[string]Playlist{
+		"/jazz": &testNamedPlaylist{testPlaylist{[][]byte{[]byte("123")}, nil, 0}, "Jazz Radio"},
+		"/rock": rock,
+	}}, false, false, "")
+
+	request := func(req string) string {
+		testConn := &testutil.ErrorTestingConnection{}
+		testConn.In.WriteString(req)
+		drh.HandleRequest(testConn, nil)
+		return testConn.Out.String()
+	}
+
+	m3u := "#EXTM3U\n" +
+		"#EXTINF:-1,Jazz Radio\n" +
+		"http://myserver:9091/jazz\n" +
+		"#EXTINF:-1,TestPlaylist\n" +
+		"http://myserver:9091/rock\n"
+
+	if res := request("GET /playlists.m3u HTTP/1.1\r\nHost: myserver:9091\r\n\r\n"); res != "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: audio/x-mpegurl\r\n"+
+		"Content-Length: 106\r\n"+
+		"Connection: close\r\n\r\n"+m3u {
+		t.Errorf("Unexpected response: %q", res)
+		return
+	}
+
+	// The playlists of the factory are not closed
+
+	if rock.fp != 1 {
+		t.Error("Playlist should not have been closed")
+		return
+	}
+
+	// Factories which cannot list their paths have no list
+
+	drh = NewDefaultRequestHandler(&testPlaylistFactory{}, false, false, "")
+
+	if res := request("GET /playlists.m3u HTTP/1.1\r\nHost: myserver:9091\r\n\r\n"); res != "HTTP/1.1 404 Not found\r\nConnection: close\r\n\r\n" {
+		t.Errorf("Unexpected response: %q", res)
+		return
+	}
+}
@@ -0,0 +1,180 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package dudeldu
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+)
+
+/*
+MetaDataPathSuffix is the path suffix which requests information about the
+current track of a stream (e.g. /foo/bar/metadata.json for the stream /foo/bar).
+*/
+const MetaDataPathSuffix = "/metadata.json"
+
+/*
+TrackInfo holds information about the current track of a stream.
+*/
+type TrackInfo struct {
+	Artist      string `json:"artist"`      // Artist of the track
+	Title       string `json:"title"`       // Title of the track
+	ContentType string `json:"contenttype"` // Content type of the stream
+	Genre       string `json:"genre"`       // Genre of the track (may be empty)
+	URL         string `json:"url"`         // URL of the track (may be empty)
+	Position    int    `json:"position"`    // Position of the track in the playlist (-1 if unknown)
+}
+
+/*
+nowPlaying holds the current track of a playlist and the number of active streams.
+*/
+type nowPlaying struct {
+	info    *TrackInfo // Current track
+	cover   string     // Cover image of the current track (may be empty)
+	streams int        // Number of connections which stream the playlist
+}
+
+/*
+NowPlaying returns information about the current track of a given path or nil
+if the path is not streamed at the moment. All paths which serve the same
+playlist (e.g. aliases) report the same track.
+*/
+func (drh *DefaultRequestHandler) NowPlaying(path string) *TrackInfo {
+	name := drh.playlistName(path)
+
+	drh.nowPlayingLock.RLock()
+	defer drh.nowPlayingLock.RUnlock()
+
+	if np, ok := drh.nowPlaying[name]; ok && np.info != nil {
+		info := *np.info
+		return &info
+	}
+
+	return nil
+}
+
+/*
+startNowPlaying registers a new stream for a given playlist name.
+*/
+func (drh *DefaultRequestHandler) startNowPlaying(name string) {
+	drh.nowPlayingLock.Lock()
+	defer drh.nowPlayingLock.Unlock()
+
+	np, ok := drh.nowPlaying[name]
+	if !ok {
+		np = &nowPlaying{}
+		drh.nowPlaying[name] = np
+	}
+
+	np.streams++
+}
+
+/*
+startListener registers a new listener of a playlist. The listener is not
+registered if the playlist already has maxListeners listeners (0 is unlimited).
+Listeners are counted by the playlist name so all paths which serve the same
+playlist (e.g. aliases) share the limit. Returns if the listener was registered.
+*/
+func (drh *DefaultRequestHandler) startListener(name string, maxListeners int) bool {
+	drh.listenersLock.Lock()
+	defer drh.listenersLock.Unlock()
+
+	if maxListeners > 0 && drh.listeners[name] >= maxListeners {
+		return false
+	}
+
+	drh.listeners[name]++
+
+	return true
+}
+
+/*
+stopListener removes a listener of a playlist.
+*/
+func (drh *DefaultRequestHandler) stopListener(name string) {
+	drh.listenersLock.Lock()
+	defer drh.listenersLock.Unlock()
+
+	if drh.listeners[name]--; drh.listeners[name] <= 0 {
+		delete(drh.listeners, name)
+	}
+}
+
+/*
+updateNowPlaying stores the current track of a given playlist name. This is
+called from the streaming connection so the playlist is never accessed
+concurrently.
+*/
+func (drh *DefaultRequestHandler) updateNowPlaying(name string, pl Playlist) {
+	info := &TrackInfo{
+		Artist:      pl.Artist(),
+		Title:       pl.Title(),
+		ContentType: pl.ContentType(),
+		Position:    -1,
+	}
+
+	if ipl, ok := pl.(TrackInfoPlaylist); ok {
+		info.Genre = ipl.Genre()
+		info.Position = ipl.Position()
+	}
+
+	if upl, ok := pl.(StreamURLPlaylist); ok {
+		info.URL = upl.StreamURL()
+	}
+
+	cover := ""
+	if cpl, ok := pl.(CoverPlaylist); ok {
+		cover = cpl.Cover()
+	}
+
+	drh.nowPlayingLock.Lock()
+	defer drh.nowPlayingLock.Unlock()
+
+	if np, ok := drh.nowPlaying[name]; ok {
+		np.info = info
+		np.cover = cover
+	}
+}
+
+/*
+stopNowPlaying unregisters a stream for a given playlist name.
+*/
+func (drh *DefaultRequestHandler) stopNowPlaying(name string) {
+	drh.nowPlayingLock.Lock()
+	defer drh.nowPlayingLock.Unlock()
+
+	if np, ok := drh.nowPlaying[name]; ok {
+		if np.streams--; np.streams <= 0 {
+			delete(drh.nowPlaying, name)
+		}
+	}
+}
+
+/*
+writeMetaDataJSON writes information about the current track of a given path
+as JSON to the client.
+*/
+func (drh *DefaultRequestHandler) writeMetaDataJSON(c net.Conn, path string, version string) error {
+	info := drh.NowPlaying(path)
+
+	if info == nil {
+		return drh.writeStreamNotFoundResponse(c, version)
+	}
+
+	data, _ := json.Marshal(info)
+
+	_, err := c.Write([]byte(fmt.Sprintf("HTTP/1.1 200 OK\r\n"+
+		"Content-Type: application/json\r\n"+
+		"Content-Length: %v\r\n\r\n%s", len(data), data)))
+
+	return err
+}
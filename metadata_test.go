@@ -0,0 +1,129 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package dudeldu
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"devt.de/krotik/common/testutil"
+)
+
+/*
+testInfoPlaylist is a playlist for testing which provides track information
+*/
+type testInfoPlaylist struct {
+	testURLPlaylist
+}
+
+func (tp *testInfoPlaylist) Genre() string {
+	return "Test Genre"
+}
+
+func (tp *testInfoPlaylist) Position() int {
+	return tp.fp
+}
+
+func TestMetaDataJSON(t *testing.T) {
+
+	tpl := &testInfoPlaylist{testURLPlaylist{testPlaylist{[][]byte{[]byte("123"), []byte("4567")}, nil, 0}, "http://example.com"}}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, true, false, "")
+
+	request := func() string {
+		testConn := &testutil.ErrorTestingConnection{}
+		testConn.In.WriteString("GET /testpath" + MetaDataPathSuffix + " HTTP/1.1\r\n\r\n")
+		drh.HandleRequest(testConn, nil)
+		return testConn.Out.String()
+	}
+
+	// Nothing is known about paths which are not streamed
+
+	if res := request(); res != "HTTP/1.1 404 Not found\r\nConnection: close\r\n\r\n" {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// Start streaming - the playlist loops forever
+
+	c1, c2 := net.Pipe()
+
+	go drh.HandleRequest(c1, nil)
+
+	c2.Write([]byte("GET /testpath HTTP/1.1\r\n\r\n"))
+
+	// Read the headers and the first frame
+
+	io.ReadFull(c2, make([]byte, 69))
+
+	if res := request(); res != "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: application/json\r\n"+
+		"Content-Length: 135\r\n\r\n"+
+		`{"artist":"Test Artist","title":"Test Title","contenttype":"Test/Content",`+
+		`"genre":"Test Genre","url":"http://example.com","position":0}` {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	if info := drh.NowPlaying("/testpath"); info == nil || info.Title != "Test Title" {
+		t.Error("Unexpected result:", info)
+		return
+	}
+
+	// Information is removed once the stream ends
+
+	c2.Close()
+
+	for i := 0; i < 100 && drh.NowPlaying("/testpath") != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if res := request(); res != "HTTP/1.1 404 Not found\r\nConnection: close\r\n\r\n" {
+		t.Error("Unexpected response:", res)
+		return
+	}
+}
+
+func TestMetaDataJSONStreamPath(t *testing.T) {
+
+	tpl := &testPlaylist{[][]byte{[]byte("123")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testListablePlaylistFactory{map[string]Playlist{
+		"/show" + MetaDataPathSuffix: tpl,
+		"/show" + CoverPathSuffix:    tpl,
+	}}, false, false, "")
+
+	request := func(path string) string {
+		testConn := &testutil.ErrorTestingConnection{}
+		testConn.In.WriteString("GET " + path + " HTTP/1.1\r\n\r\n")
+		drh.HandleRequest(testConn, nil)
+		return testConn.Out.String()
+	}
+
+	// Paths which end with a suffix are streamed if their prefix is unknown
+
+	for _, path := range []string{"/show" + MetaDataPathSuffix, "/show" + CoverPathSuffix} {
+		tpl.fp = 0
+
+		if res := request(path); !strings.HasPrefix(res, "ICY 200 OK\r\n") || !strings.HasSuffix(res, "123") {
+			t.Error("Unexpected response:", path, res)
+			return
+		}
+	}
+
+	// Unknown paths are not found
+
+	if res := request("/other" + MetaDataPathSuffix); !strings.Contains(res, "404 Not found") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+}
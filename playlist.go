@@ -23,8 +23,10 @@ Theoretical frame sizes for Layer III range from 24 to 1441 bytes
 there is a "soft" limit imposed by the standard of 960 bytes.
 
 see: http://www.mars.org/pipermail/mad-dev/2002-January/000425.html
+
+The frame size can be changed before any connection is served.
 */
-const FrameSize = 3000
+var FrameSize = 3000
 
 /*
 ErrPlaylistEnd is a special error code which signals that the end of the playlist has been reached
@@ -73,12 +75,163 @@ type Playlist interface {
 	Finished() bool
 
 	/*
-		Close any open files by this playlist and reset the current pointer. After this
-		call the playlist can be played again unless an error is returned.
+		Close releases all resources of this playlist (e.g. open files). Close is
+		called once the playlist is no longer needed.
 	*/
 	Close() error
 }
 
+/*
+DisplayNamePlaylist is a Playlist which has a display name for clients (e.g. a
+station name) besides the name which identifies it.
+*/
+type DisplayNamePlaylist interface {
+	Playlist
+
+	/*
+		DisplayName returns the display name of the playlist or an empty string.
+	*/
+	DisplayName() string
+}
+
+/*
+LoopingPlaylist is a Playlist which may define its own looping behaviour
+(overriding the looping of the request handler).
+*/
+type LoopingPlaylist interface {
+	Playlist
+
+	/*
+		Loop returns if the playlist should be looped and how often it is
+		looped (-1 loops forever). A count of 0 means that the playlist does
+		not define its own looping behaviour.
+	*/
+	Loop() (bool, int)
+}
+
+/*
+ResettablePlaylist is a Playlist which can be rewound for looping without
+releasing its resources. Playlists which do not implement this interface are
+rewound with Close.
+*/
+type ResettablePlaylist interface {
+	Playlist
+
+	/*
+		Reset rewinds the playlist so it can be played again. An error is
+		returned if the playlist cannot be played again.
+	*/
+	Reset() error
+}
+
+/*
+ListenerLimitPlaylist is a Playlist which limits the number of clients which
+may stream its path at the same time.
+*/
+type ListenerLimitPlaylist interface {
+	Playlist
+
+	/*
+		MaxListeners returns the maximum number of clients which may stream
+		the path of the playlist at the same time (0 is unlimited).
+	*/
+	MaxListeners() int
+}
+
+/*
+SizedPlaylist is a Playlist which knows the total length of its data.
+*/
+type SizedPlaylist interface {
+	Playlist
+
+	/*
+		Size returns the total length of the playlist data in bytes or -1 if
+		the length is unknown.
+	*/
+	Size() int64
+}
+
+/*
+SkippablePlaylist is a Playlist which can skip the current track.
+*/
+type SkippablePlaylist interface {
+	Playlist
+
+	/*
+		Skip advances the playlist to the next track.
+	*/
+	Skip() error
+}
+
+/*
+SeekablePlaylist is a Playlist which can jump directly to a byte offset.
+*/
+type SeekablePlaylist interface {
+	Playlist
+
+	/*
+		SeekTo positions the playlist at a byte offset from the start of the
+		playlist data. The playlist is unchanged if an error is returned.
+	*/
+	SeekTo(offset int64) error
+}
+
+/*
+StreamURLPlaylist is a Playlist which provides a URL for the current track
+(e.g. a link to a website or cover art).
+*/
+type StreamURLPlaylist interface {
+	Playlist
+
+	/*
+		StreamURL returns the URL for the current track or an empty string.
+	*/
+	StreamURL() string
+}
+
+/*
+TrackInfoPlaylist is a Playlist which provides additional information about the
+current track.
+*/
+type TrackInfoPlaylist interface {
+	Playlist
+
+	/*
+		Genre returns the genre of the current track or an empty string.
+	*/
+	Genre() string
+
+	/*
+		Position returns the position of the current track in the playlist.
+	*/
+	Position() int
+}
+
+/*
+AlbumPlaylist is a Playlist which knows the album of the current track.
+*/
+type AlbumPlaylist interface {
+	Playlist
+
+	/*
+		Album returns the album of the current track or an empty string.
+	*/
+	Album() string
+}
+
+/*
+CoverPlaylist is a Playlist which knows the cover image of the current track.
+*/
+type CoverPlaylist interface {
+	Playlist
+
+	/*
+		Cover returns the path of a local image file for the current track or an
+		empty string.
+	*/
+	Cover() string
+}
+
 /*
 PlaylistFactory produces a Playlist for a given path.
 */
@@ -89,3 +242,42 @@ type PlaylistFactory interface {
 	*/
 	Playlist(path string, shuffle bool) Playlist
 }
+
+/*
+PlaylistInfoFactory is a PlaylistFactory which provides information about the
+playlists of its paths without creating (and closing) a playlist.
+*/
+type PlaylistInfoFactory interface {
+	PlaylistFactory
+
+	/*
+		DisplayName returns the name which is shown to clients for the playlist
+		of a given path or an empty string if the path is unknown.
+	*/
+	DisplayName(path string) string
+
+	/*
+		PlaylistName returns the name of the playlist (see Playlist.Name) which
+		is served for a given path or an empty string if the path is unknown.
+		Paths which serve the same playlist (e.g. aliases) have the same name.
+	*/
+	PlaylistName(path string) string
+
+	/*
+		Cover returns the path of a local image file for the playlist of a
+		given path (e.g. the cover of its first track) or an empty string.
+	*/
+	Cover(path string) string
+}
+
+/*
+ListablePlaylistFactory is a PlaylistFactory which knows all paths it can serve.
+*/
+type ListablePlaylistFactory interface {
+	PlaylistFactory
+
+	/*
+		Paths returns all paths which can be served in sorted order.
+	*/
+	Paths() []string
+}
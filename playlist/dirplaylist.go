@@ -0,0 +1,73 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package playlist
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+/*
+NewDirPlaylistFactory creates a new FilePlaylistFactory from a given directory.
+Every subdirectory which contains audio files (files with an extension in
+FileExtContentTypes) becomes a playlist. The web path of a playlist is the
+relative path of its directory (e.g. rootDir/foo/bar would be /foo/bar). Files
+in rootDir itself are served at /.
+
+Artist and title are taken from file names of the form "<artist> - <title>.mp3".
+All other file names are used as title.
+*/
+func NewDirPlaylistFactory(rootDir string) (*FilePlaylistFactory, error) {
+	data := make(map[string][]map[string]string)
+
+	err := filepath.Walk(rootDir, func(p string, info os.FileInfo, err error) error {
+
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		ext := filepath.Ext(p)
+
+		if _, ok := FileExtContentTypes[strings.ToLower(ext)]; !ok {
+			return nil
+		}
+
+		rel, err := filepath.Rel(rootDir, filepath.Dir(p))
+		if err != nil {
+			return err
+		}
+
+		webPath := path.Clean("/" + filepath.ToSlash(rel))
+
+		artist := ""
+		title := strings.TrimSuffix(info.Name(), ext)
+
+		if i := strings.Index(title, " - "); i >= 0 {
+			artist, title = title[:i], title[i+3:]
+		}
+
+		data[webPath] = append(data[webPath], map[string]string{
+			"artist": artist,
+			"title":  title,
+			"path":   p,
+		})
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newFilePlaylistFactory(data, ""), nil
+}
@@ -0,0 +1,121 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package playlist
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"devt.de/krotik/dudeldu"
+)
+
+func TestDirPlaylistFactory(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "dirplaylisttest")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(root)
+
+	for _, f := range []string{
+		"intro.mp3",
+		"rock/b.mp3",
+		"rock/Artist1 - a.mp3",
+		"rock/cover.jpg",
+		"jazz/live/c.ogg",
+		"jazz/live/notes.txt",
+		"empty/readme.txt",
+	} {
+		f = filepath.Join(root, filepath.FromSlash(f))
+		os.MkdirAll(filepath.Dir(f), 0770)
+
+		if err := ioutil.WriteFile(f, []byte("123"), 0644); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	plf, err := NewDirPlaylistFactory(root)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var paths []string
+	for p := range plf.data {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	if res := fmt.Sprint(paths); res != "[/ /jazz/live /rock]" {
+		t.Error("Unexpected paths:", res)
+		return
+	}
+
+	pl := plf.Playlist("/rock", false).(*FilePlaylist)
+
+	if len(pl.data) != 2 ||
+		pl.data[0]["artist"] != "Artist1" || pl.data[0]["title"] != "a" ||
+		pl.data[0]["path"] != filepath.Join(root, "rock", "Artist1 - a.mp3") ||
+		pl.data[1]["artist"] != "" || pl.data[1]["title"] != "b" ||
+		pl.data[1]["path"] != filepath.Join(root, "rock", "b.mp3") {
+		t.Error("Unexpected playlist data:", pl.data)
+		return
+	}
+
+	if pl.ContentType() != "audio/mpeg" || pl.Title() != "a" || pl.Artist() != "Artist1" {
+		t.Error("Unexpected playlist state:", pl.ContentType(), pl.Title(), pl.Artist())
+		return
+	}
+
+	if pl := plf.Playlist("/jazz/live", false); pl.ContentType() != "audio/ogg" || pl.Title() != "c" {
+		t.Error("Unexpected playlist state:", pl.ContentType(), pl.Title())
+		return
+	}
+
+	// The files of the absolute root are played from disk
+
+	if !filepath.IsAbs(root) {
+		t.Error("Root should be absolute:", root)
+		return
+	}
+
+	var data []byte
+
+	for !pl.Finished() {
+		frame, err := pl.Frame()
+		if err != nil && err != dudeldu.ErrPlaylistEnd {
+			t.Error(err)
+			return
+		}
+		data = append(data, frame...)
+	}
+
+	if string(data) != "123123" {
+		t.Error("Unexpected data:", string(data))
+		return
+	}
+
+	if pl := plf.Playlist("/empty", false); pl != nil {
+		t.Error("Directory without audio files should not be a playlist")
+		return
+	}
+
+	if _, err := NewDirPlaylistFactory(filepath.Join(root, "nonexist")); err == nil {
+		t.Error("Non existing directory should return an error")
+		return
+	}
+}
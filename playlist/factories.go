@@ -0,0 +1,115 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package playlist
+
+import (
+	"sort"
+
+	"devt.de/krotik/dudeldu"
+)
+
+/*
+NullPlaylistFactory is a PlaylistFactory which has no playlists.
+*/
+type NullPlaylistFactory struct {
+}
+
+/*
+Playlist always returns nil.
+*/
+func (nf NullPlaylistFactory) Playlist(path string, shuffle bool) dudeldu.Playlist {
+	return nil
+}
+
+/*
+FuncPlaylistFactory is an adapter which allows the use of an ordinary function
+as a PlaylistFactory.
+*/
+type FuncPlaylistFactory func(path string, shuffle bool) dudeldu.Playlist
+
+/*
+Playlist calls the function.
+*/
+func (ff FuncPlaylistFactory) Playlist(path string, shuffle bool) dudeldu.Playlist {
+	return ff(path, shuffle)
+}
+
+/*
+StaticPlaylistFactory is a PlaylistFactory which returns fixed playlists for
+web paths. The shuffle flag is ignored.
+*/
+type StaticPlaylistFactory map[string]dudeldu.Playlist
+
+/*
+Playlist returns the playlist of a given path or nil if the path is unknown.
+*/
+func (sf StaticPlaylistFactory) Playlist(path string, shuffle bool) dudeldu.Playlist {
+	return sf[path]
+}
+
+/*
+DisplayName returns the display name of the playlist of a given path (the
+playlist name if it has no display name) or an empty string if the path is
+unknown. The playlist is not changed.
+*/
+func (sf StaticPlaylistFactory) DisplayName(path string) string {
+	pl, ok := sf[path]
+	if !ok {
+		return ""
+	}
+
+	if dpl, ok := pl.(dudeldu.DisplayNamePlaylist); ok {
+		if name := dpl.DisplayName(); name != "" {
+			return name
+		}
+	}
+
+	return pl.Name()
+}
+
+/*
+PlaylistName returns the name of the playlist of a given path or an empty
+string if the path is unknown.
+*/
+func (sf StaticPlaylistFactory) PlaylistName(path string) string {
+	if pl, ok := sf[path]; ok {
+		return pl.Name()
+	}
+
+	return ""
+}
+
+/*
+Cover returns the cover image of the current track of the playlist of a given
+path or an empty string. The playlist is not changed.
+*/
+func (sf StaticPlaylistFactory) Cover(path string) string {
+	if cpl, ok := sf[path].(dudeldu.CoverPlaylist); ok {
+		return cpl.Cover()
+	}
+
+	return ""
+}
+
+/*
+Paths returns all paths of the factory in sorted order.
+*/
+func (sf StaticPlaylistFactory) Paths() []string {
+	paths := make([]string, 0, len(sf))
+
+	for path := range sf {
+		paths = append(paths, path)
+	}
+
+	sort.Strings(paths)
+
+	return paths
+}
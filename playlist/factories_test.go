@@ -0,0 +1,109 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package playlist
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"devt.de/krotik/common/testutil"
+	"devt.de/krotik/dudeldu"
+)
+
+func TestFactories(t *testing.T) {
+
+	pl := NewReaderPlaylist("/reader", "audio/mpeg", "artist1", "title1",
+		bytes.NewReader([]byte("12345678")))
+
+	var nf dudeldu.PlaylistFactory = NullPlaylistFactory{}
+
+	if res := nf.Playlist("/reader", false); res != nil {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	var calls []bool
+
+	var ff dudeldu.PlaylistFactory = FuncPlaylistFactory(func(path string, shuffle bool) dudeldu.Playlist {
+		calls = append(calls, shuffle)
+
+		if path == "/reader" {
+			return pl
+		}
+
+		return nil
+	})
+
+	if res := ff.Playlist("/reader", true); res != pl || len(calls) != 1 || !calls[0] {
+		t.Error("Unexpected result:", res, calls)
+		return
+	}
+
+	if res := ff.Playlist("/foo", false); res != nil || len(calls) != 2 || calls[1] {
+		t.Error("Unexpected result:", res, calls)
+		return
+	}
+
+	var sf dudeldu.PlaylistFactory = StaticPlaylistFactory{"/reader": pl}
+
+	if res := sf.Playlist("/reader", true); res != pl {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if res := sf.Playlist("/foo", false); res != nil {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	sf = StaticPlaylistFactory{"/reader": pl, "/other": pl}
+
+	if res := sf.(dudeldu.ListablePlaylistFactory).Paths(); len(res) != 2 || res[0] != "/other" || res[1] != "/reader" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Display names are looked up without closing the shared playlist
+
+	if res := sf.(dudeldu.PlaylistInfoFactory).DisplayName("/reader"); res != pl.Name() || pl.Finished() {
+		t.Error("Unexpected result:", res, pl.Finished())
+		return
+	}
+
+	if res := sf.(dudeldu.PlaylistInfoFactory).DisplayName("/foo"); res != "" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if res := sf.(dudeldu.PlaylistInfoFactory).PlaylistName("/reader"); res != pl.Name() {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if res := sf.(dudeldu.PlaylistInfoFactory).PlaylistName("/foo"); res != "" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Listing the streams does not close the shared playlist
+
+	drh := dudeldu.NewDefaultRequestHandler(sf, false, false, "")
+	testConn := &testutil.ErrorTestingConnection{}
+	testConn.In.WriteString("GET /playlists.m3u HTTP/1.1\r\nHost: myserver\r\n\r\n")
+	drh.HandleRequest(testConn, nil)
+
+	if res := testConn.Out.String(); !strings.HasSuffix(res, "#EXTINF:-1,/reader\nhttp://myserver/reader\n") ||
+		pl.Finished() {
+		t.Error("Unexpected result:", res, pl.Finished())
+		return
+	}
+}
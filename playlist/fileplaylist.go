@@ -22,31 +22,75 @@ a file. The definition file is expected to be a JSON encoded datastructure of th
 	            "artist" : <artist>
 	            "title"  : <title>
 	            "path"   : <file path / url>
+	            "contenttype" : <optional content type>
+	            "genre"  : <optional genre>
+	            "album"  : <optional album>
+	            "cover"  : <optional cover image file>
+	            "start"  : <optional byte offset where playback starts>
+	            "end"    : <optional byte offset where playback ends>
 	        }
 	    ]
 	}
 
+Instead of a list of items a web path can also be mapped to an object which
+defines a frame size for the playlist (the global FrameSize is used otherwise),
+a display name which is send to clients as the station name (the web path
+is used otherwise), if the playlist should be looped (the looping of the
+request handler is used otherwise), the maximum number of clients which may
+stream the playlist at the same time and additional web paths which serve the
+same playlist:
+
+	{
+	    <web path> : {
+	        "framesize"    : <frame size in bytes>
+	        "name"         : <display name>
+	        "loop"         : <true / false>
+	        "looptimes"    : <optional number of loops (loops forever by default)>
+	        "maxlisteners" : <optional maximum number of listeners>
+	        "aliases"      : [ <web path>, ... ]
+	        "items"        : [ ... ]
+	    }
+	}
+
 The web path is the absolute path which may be requested by the streaming
 client (e.g. /foo/bar would be http://myserver:1234/foo/bar).
 The path is either a physical file or a web url reachable by the server process.
-The file ending determines the content type which is send to the client.
+The file ending determines the content type which is send to the client unless
+the item defines an explicit content type. Web urls use the content type of the
+upstream response once the upstream source has reported one.
+The start and end offsets (given as strings) restrict an item to a segment of
+its data. The whole item is played if they are omitted.
+If artist or title are omitted they are read from the Vorbis comments of local
+Ogg files (.ogg, .oga and .opus).
+
+A web path with the suffix ?one (e.g. /foo/bar?one) plays a single randomly
+chosen item of the playlist.
 */
 package playlist
 
 import (
 	"bytes"
+	crand "crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"devt.de/krotik/common/errorutil"
 	"devt.de/krotik/common/stringutil"
 	"devt.de/krotik/dudeldu"
 )
@@ -57,8 +101,11 @@ FileExtContentTypes maps file extensions to content types
 var FileExtContentTypes = map[string]string{
 	".mp3":  "audio/mpeg",
 	".flac": "audio/flac",
+	".fla":  "audio/flac",
 	".aac":  "audio/x-aac",
 	".mp4a": "audio/mp4",
+	".m4a":  "audio/mp4",
+	".m4b":  "audio/mp4",
 	".mp4":  "video/mp4",
 	".nsv":  "video/nsv",
 	".ogg":  "audio/ogg",
@@ -70,42 +117,96 @@ var FileExtContentTypes = map[string]string{
 	".webm": "video/webm",
 	".axa":  "audio/annodex",
 	".axv":  "video/annodex",
+	".wav":  "audio/wav",
+	".wave": "audio/wav",
 }
 
+/*
+DefaultContentType is the content type of items with an unknown file extension
+*/
+const DefaultContentType = "application/octet-stream"
+
 /*
 FrameSize is the frame size which is used by the playlists
 */
 var FrameSize = dudeldu.FrameSize
 
+/*
+SingleTrackSuffix is the path suffix which requests a single random track of a playlist
+*/
+const SingleTrackSuffix = "?one"
+
 /*
 FilePlaylistFactory data structure
 */
 type FilePlaylistFactory struct {
-	data           map[string][]map[string]string
-	itemPathPrefix string
+	data              map[string][]map[string]string
+	frameSizes        map[string]int    // Frame sizes of playlists which do not use the global FrameSize
+	displayNames      map[string]string // Display names of playlists
+	loops             map[string]int    // Number of loops of playlists which define their looping (-1 loops forever, 1 plays once)
+	aliases           map[string]string // Alias web paths and the web paths they refer to
+	maxListeners      map[string]int    // Maximum number of listeners of playlists which limit their listeners
+	duplicatePaths    []string          // Web paths which were defined more than once
+	itemPathPrefix    string
+	VerifyUpstreamTLS bool           // Flag if certificates of upstream URL sources should be verified
+	UpstreamRootCAs   *x509.CertPool // Optional root CAs for verifying upstream URL sources
+	UpstreamTimeout   time.Duration  // Timeout for connecting to upstream URL sources (0 waits forever)
+	UpstreamRetries   int            // Number of retries if an upstream URL source cannot be reached
+	UpstreamBackoff   time.Duration  // Initial wait time between retries (doubled on every retry)
+	UpstreamHeaders   http.Header    // Additional headers which are send to upstream URL sources
+	MaxUpstreamConns  int            // Maximum number of concurrently open upstream connections (0 is unlimited)
+	Prefetch          bool           // Flag if the next item should be opened in the background
+	ReshuffleOnLoop   bool           // Flag if shuffled playlists should be shuffled again when looping
+	ShuffleSeed       int64          // Optional seed for reproducible shuffle orders (0 uses a random seed)
+	FallbackType      string         // Content type of items with an unknown file extension (empty uses DefaultContentType)
+	SniffContentType  bool           // Flag if the content type of local files with an unknown file extension is detected from their data
+
+	Jingle            map[string]string // Optional item (artist, title, path) which is inserted between tracks
+	JingleEveryTracks int               // Insert the jingle after this number of tracks (0 disables)
+	JingleEvery       time.Duration     // Insert the jingle after this amount of time (0 disables)
+
+	upstreamSlots     chan struct{} // Slots for open upstream connections
+	upstreamSlotsOnce sync.Once     // Initialisation of the upstream slots
+
+	upstreamHTTP       *http.Client   // Client for upstream URL sources (shared by all playlists)
+	upstreamHTTPConfig upstreamConfig // Settings which were used to build the upstream client
+	upstreamHTTPLock   sync.Mutex     // Lock for the upstream client
+
+	detectedTypes     map[string]string // Detected content types of local files and upstream URL sources
+	detectedTypesLock sync.Mutex        // Lock for detected content types
 }
 
+/*
+stdin is the reader which is used for playlist definitions given as "-" (can be
+replaced for unit tests).
+*/
+var stdin io.Reader = os.Stdin
+
 /*
 NewFilePlaylistFactory creates a new FilePlaylistFactory from a given definition
-file.
+file. A path of "-" reads the definition from stdin.
 */
 func NewFilePlaylistFactory(path string, itemPathPrefix string) (*FilePlaylistFactory, error) {
+	var pl []byte
+	var err error
 
-	// Try to read the playlist file
+	// Try to read the playlist file - a path of "-" reads from stdin
+
+	if path == "-" {
+		pl, err = ioutil.ReadAll(stdin)
+	} else {
+		pl, err = ioutil.ReadFile(path)
+	}
 
-	pl, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
 	// Unmarshal json
 
-	ret := &FilePlaylistFactory{
-		data:           nil,
-		itemPathPrefix: itemPathPrefix,
-	}
+	ret := newFilePlaylistFactory(nil, itemPathPrefix)
 
-	err = json.Unmarshal(pl, &ret.data)
+	err = ret.unmarshalDefinition(pl)
 
 	if err != nil {
 
@@ -113,7 +214,7 @@ func NewFilePlaylistFactory(path string, itemPathPrefix string) (*FilePlaylistFa
 
 		pl = stringutil.StripCStyleComments(pl)
 
-		err = json.Unmarshal(pl, &ret.data)
+		err = ret.unmarshalDefinition(pl)
 	}
 
 	if err != nil {
@@ -124,302 +225,1914 @@ func NewFilePlaylistFactory(path string, itemPathPrefix string) (*FilePlaylistFa
 }
 
 /*
-Playlist returns a playlist for a given path.
+unmarshalDefinition reads a JSON encoded playlist definition.
 */
-func (fp *FilePlaylistFactory) Playlist(path string, shuffle bool) dudeldu.Playlist {
-	if data, ok := fp.data[path]; ok {
+func (fp *FilePlaylistFactory) unmarshalDefinition(pl []byte) error {
+	var def map[string]json.RawMessage
 
-		// Check if the playlist should be shuffled
+	if err := json.Unmarshal(pl, &def); err != nil {
+		return err
+	}
+
+	fp.data = make(map[string][]map[string]string)
+	fp.frameSizes = make(map[string]int)
+	fp.displayNames = make(map[string]string)
+	fp.loops = make(map[string]int)
+	fp.aliases = make(map[string]string)
+	fp.maxListeners = make(map[string]int)
+	fp.duplicatePaths = duplicateKeys(pl)
+
+	for path, raw := range def {
+		var items []map[string]string
+
+		if err := json.Unmarshal(raw, &items); err != nil {
+
+			// Check if the playlist is defined as an object
+
+			var obj struct {
+				FrameSize    int                 `json:"framesize"`
+				Name         string              `json:"name"`
+				Loop         *bool               `json:"loop"`
+				LoopTimes    int                 `json:"looptimes"`
+				MaxListeners int                 `json:"maxlisteners"`
+				Aliases      []string            `json:"aliases"`
+				Items        []map[string]string `json:"items"`
+			}
+
+			if json.Unmarshal(raw, &obj) != nil {
+				return fmt.Errorf("Invalid playlist definition for %v: %v", path, err)
+			}
+
+			items = obj.Items
+
+			if obj.FrameSize > 0 {
+				fp.frameSizes[path] = obj.FrameSize
+			}
+
+			if obj.Name != "" {
+				fp.displayNames[path] = obj.Name
+			}
+
+			if obj.Loop != nil {
+				fp.loops[path] = 1
 
-		if shuffle {
-			r := rand.New(rand.NewSource(time.Now().UnixNano()))
+				if *obj.Loop {
+					fp.loops[path] = -1
 
-			shuffledData := make([]map[string]string, len(data), len(data))
+					if obj.LoopTimes > 0 {
+						fp.loops[path] = obj.LoopTimes
+					}
+				}
+			}
 
-			for i, j := range r.Perm(len(data)) {
-				shuffledData[i] = data[j]
+			if obj.MaxListeners > 0 {
+				fp.maxListeners[path] = obj.MaxListeners
 			}
 
-			data = shuffledData
+			for _, alias := range obj.Aliases {
+				if _, ok := def[alias]; ok || fp.aliases[alias] != "" {
+					return fmt.Errorf("Alias %v of %v is already defined", alias, path)
+				}
+
+				fp.aliases[alias] = path
+			}
 		}
 
-		return &FilePlaylist{path, fp.itemPathPrefix, 0, data, nil, false,
-			&sync.Pool{New: func() interface{} { return make([]byte, FrameSize, FrameSize) }}}
+		fp.data[path] = items
 	}
+
 	return nil
 }
 
 /*
-FilePlaylist data structure
+newFilePlaylistFactory creates a new FilePlaylistFactory with default options.
 */
-type FilePlaylist struct {
-	path       string              // Path of this playlist
-	pathPrefix string              // Prefix for all paths
-	current    int                 // Pointer to the current playing item
-	data       []map[string]string // Playlist items
-	stream     io.ReadCloser       // Current open stream
-	finished   bool                // Flag if this playlist has finished
-	framePool  *sync.Pool          // Pool for byte arrays
+func newFilePlaylistFactory(data map[string][]map[string]string, itemPathPrefix string) *FilePlaylistFactory {
+	return &FilePlaylistFactory{
+		data:            data,
+		itemPathPrefix:  itemPathPrefix,
+		UpstreamTimeout: 30 * time.Second,
+		UpstreamRetries: 2,
+		UpstreamBackoff: 500 * time.Millisecond,
+	}
 }
 
 /*
-currentItem returns the current playlist item
+duplicateKeys returns all keys which occur more than once in a JSON object.
 */
-func (fp *FilePlaylist) currentItem() map[string]string {
-	if fp.current < len(fp.data) {
-		return fp.data[fp.current]
+func duplicateKeys(pl []byte) []string {
+	var dups []string
+
+	dec := json.NewDecoder(bytes.NewReader(pl))
+
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil
 	}
 
-	return fp.data[len(fp.data)-1]
+	seen := make(map[string]bool)
+
+	for dec.More() {
+		var val json.RawMessage
+
+		t, err := dec.Token()
+		if err != nil {
+			break
+		}
+
+		if key, ok := t.(string); ok {
+			if seen[key] {
+				dups = append(dups, key)
+			}
+			seen[key] = true
+		}
+
+		if err = dec.Decode(&val); err != nil {
+			break
+		}
+	}
+
+	return dups
 }
 
 /*
-Name is the name of the playlist.
+Validate checks the playlist definition. It reports web paths which were
+defined more than once and items whose local files cannot be read (URL items
+are not checked). All found problems are returned as a single error.
 */
-func (fp *FilePlaylist) Name() string {
-	return fp.path
+func (fp *FilePlaylistFactory) Validate() error {
+	errs := errorutil.NewCompositeError()
+
+	for _, path := range fp.duplicatePaths {
+		errs.Add(fmt.Errorf("Web path %v is defined more than once", path))
+	}
+
+	// Check the items in a stable order
+
+	for _, path := range fp.Paths() {
+		for _, item := range fp.data[path] {
+			itemPath, err := resolveItemPath(fp.itemPathPrefix, item["path"])
+			if err != nil {
+				errs.Add(fmt.Errorf("Item %v of %v cannot be read: %v", item["path"], path, err))
+				continue
+			}
+
+			if isURL(itemPath) {
+				continue
+			}
+
+			stream, err := openFile(itemPath)
+			if err != nil {
+				errs.Add(fmt.Errorf("Item %v of %v cannot be read: %v", itemPath, path, err))
+				continue
+			}
+
+			stream.Close()
+		}
+	}
+
+	if errs.HasErrors() {
+		return errs
+	}
+
+	return nil
 }
 
 /*
-ContentType returns the content type of this playlist e.g. audio/mpeg.
+Paths returns all web paths (including aliases) of the playlist definition in
+sorted order.
 */
-func (fp *FilePlaylist) ContentType() string {
-	ext := filepath.Ext(fp.currentItem()["path"])
+func (fp *FilePlaylistFactory) Paths() []string {
+	paths := make([]string, 0, len(fp.data)+len(fp.aliases))
 
-	if ctype, ok := FileExtContentTypes[ext]; ok {
-		return ctype
+	for path := range fp.data {
+		paths = append(paths, path)
+	}
+
+	for alias := range fp.aliases {
+		paths = append(paths, alias)
 	}
 
-	return "audio"
+	sort.Strings(paths)
+
+	return paths
 }
 
 /*
-Artist returns the artist which is currently playing.
+resolvePath returns the web path of the playlist definition which serves a
+given path and if only a single random track was requested.
 */
-func (fp *FilePlaylist) Artist() string {
-	return fp.currentItem()["artist"]
+func (fp *FilePlaylistFactory) resolvePath(path string) (string, bool) {
+
+	// Check if only a single random track was requested
+
+	single := strings.HasSuffix(path, SingleTrackSuffix)
+	if single {
+		path = strings.TrimSuffix(path, SingleTrackSuffix)
+	}
+
+	// Aliases serve the playlist of the web path they refer to
+
+	if target, ok := fp.aliases[path]; ok {
+		path = target
+	}
+
+	return path, single
 }
 
 /*
-Title returns the title which is currently playing.
+DisplayName returns the display name of the playlist of a given path. The web
+path of the playlist is returned if it has no display name and an empty string
+if the path is unknown.
 */
-func (fp *FilePlaylist) Title() string {
-	return fp.currentItem()["title"]
+func (fp *FilePlaylistFactory) DisplayName(path string) string {
+	path, _ = fp.resolvePath(path)
+
+	if _, ok := fp.data[path]; !ok {
+		return ""
+	}
+
+	if name := fp.displayNames[path]; name != "" {
+		return name
+	}
+
+	return path
 }
 
 /*
-Frame returns the current audio frame which is playing.
+PlaylistName returns the name of the playlist of a given path (its web path) or
+an empty string if the path is unknown. Aliases return the name of the playlist
+they refer to.
 */
-func (fp *FilePlaylist) Frame() ([]byte, error) {
-	var err error
-	var frame []byte
+func (fp *FilePlaylistFactory) PlaylistName(path string) string {
+	path, _ = fp.resolvePath(path)
 
-	if fp.finished {
-		return nil, dudeldu.ErrPlaylistEnd
+	if _, ok := fp.data[path]; !ok {
+		return ""
 	}
 
-	if fp.stream == nil {
+	return path
+}
 
-		// Make sure first file is loaded
+/*
+Cover returns the cover image of the first item of the playlist of a given path
+or an empty string.
+*/
+func (fp *FilePlaylistFactory) Cover(path string) string {
+	path, _ = fp.resolvePath(path)
 
-		err = fp.nextFile()
+	data := fp.data[path]
+	if len(data) == 0 || data[0]["cover"] == "" {
+		return ""
 	}
 
-	if err == nil {
+	coverPath, err := resolveItemPath(fp.itemPathPrefix, data[0]["cover"])
+	if err != nil {
+		return ""
+	}
 
-		// Get new byte array from a pool
+	return coverPath
+}
 
-		frame = fp.framePool.Get().([]byte)
+/*
+Playlist returns a playlist for a given path.
+*/
+func (fp *FilePlaylistFactory) Playlist(path string, shuffle bool) dudeldu.Playlist {
+	path, single := fp.resolvePath(path)
 
-		n := 0
-		nn := 0
+	if data, ok := fp.data[path]; ok {
 
-		for n < len(frame) && err == nil {
+		var r *rand.Rand
 
-			nn, err = fp.stream.Read(frame[n:])
-			n += nn
+		// Check if the playlist should be shuffled
 
-			// Check if we need to read the next file
+		if single && len(data) > 0 {
+			i := fp.newRandom().Intn(len(data))
+			data = data[i : i+1]
 
-			if n < len(frame) || err == io.EOF {
-				err = fp.nextFile()
-			}
+		} else if shuffle {
+			r = fp.newRandom()
+			data = shuffleItems(data, r)
 		}
 
-		// Make sure the frame has no old data if it was only partially filled
+		ret := &FilePlaylist{
+			path:         path,
+			pathPrefix:   fp.itemPathPrefix,
+			data:         data,
+			frameSize:    fp.frameSizes[path],
+			displayName:  fp.displayNames[path],
+			loopTimes:    fp.loops[path],
+			maxListeners: fp.maxListeners[path],
+			factory:      fp,
+			lastJingle:   time.Now(),
+			random:       r,
+		}
 
-		if n == 0 {
+		ret.framePool = &sync.Pool{New: func() interface{} {
+			size := ret.getFrameSize()
+			return make([]byte, size, size)
+		}}
 
-			// Special case we reached the end of the playlist
+		return ret
+	}
+	return nil
+}
 
-			frame = nil
-			if err != nil {
-				err = dudeldu.ErrPlaylistEnd
-			}
+/*
+newRandom returns a new random source for a playlist. The source is seeded with
+ShuffleSeed if it is set otherwise with a random seed.
+*/
+func (fp *FilePlaylistFactory) newRandom() *rand.Rand {
+	seed := fp.ShuffleSeed
 
-		} else if n < len(frame) {
+	if seed == 0 {
+		var b [8]byte
 
-			// Resize frame if we have less data
+		// Time based seeds may collide if playlists are requested at the same time
 
-			frame = frame[:n]
+		if _, err := crand.Read(b[:]); err == nil {
+			seed = int64(binary.LittleEndian.Uint64(b[:]))
+		} else {
+			seed = time.Now().UnixNano()
 		}
 	}
 
-	if err == dudeldu.ErrPlaylistEnd {
-		fp.finished = true
-	}
-
-	return frame, err
+	return rand.New(rand.NewSource(seed))
 }
 
 /*
-nextFile jumps to the next file for the playlist.
+shuffleItems returns a shuffled copy of a list of playlist items.
 */
-func (fp *FilePlaylist) nextFile() error {
-	var err error
-	var stream io.ReadCloser
-
-	// Except for the first call advance the current pointer
+func shuffleItems(data []map[string]string, r *rand.Rand) []map[string]string {
+	shuffledData := make([]map[string]string, len(data), len(data))
 
-	if fp.stream != nil {
-		fp.current++
-
-		fp.stream.Close()
-		fp.stream = nil
-
-		// Return special error if the end of the playlist has been reached
-
-		if fp.current >= len(fp.data) {
-			return dudeldu.ErrPlaylistEnd
-		}
+	for i, j := range r.Perm(len(data)) {
+		shuffledData[i] = data[j]
 	}
 
-	// Check if a file is already open
-
-	if fp.stream == nil {
+	return shuffledData
+}
 
-		item := fp.pathPrefix + fp.currentItem()["path"]
+/*
+upstreamIdleConnTimeout is the time after which unused upstream connections are
+closed.
+*/
+const upstreamIdleConnTimeout = 90 * time.Second
 
-		if _, err = url.ParseRequestURI(item); err == nil {
-			var resp *http.Response
+/*
+upstreamConfig holds the settings of the upstream client.
+*/
+type upstreamConfig struct {
+	verifyTLS bool           // Flag if certificates should be verified
+	rootCAs   *x509.CertPool // Optional root CAs
+	timeout   time.Duration  // Timeout for connecting
+}
 
-			// We got an url - access it without SSL verification
+/*
+upstreamClient returns the HTTP client which is used to access upstream URL
+sources. Certificates are only verified if VerifyUpstreamTLS is set.
 
-			client := &http.Client{Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-			}}
+The client is shared by all playlists of the factory so connections can be
+reused. It is only rebuilt if the upstream settings of the factory change.
 
-			if resp, err = client.Get(item); err == nil {
-				buf := &StreamBuffer{}
-				buf.ReadFrom(resp.Body)
-				stream = buf
-			}
+The timeout applies only to establishing the connection and receiving the
+response header - the body of an upstream source may stream forever.
+*/
+func (fp *FilePlaylistFactory) upstreamClient() *http.Client {
+	fp.upstreamHTTPLock.Lock()
+	defer fp.upstreamHTTPLock.Unlock()
 
-		} else {
+	config := upstreamConfig{fp.VerifyUpstreamTLS, fp.UpstreamRootCAs, fp.UpstreamTimeout}
 
-			// Open a new file
+	if fp.upstreamHTTP != nil && fp.upstreamHTTPConfig == config {
+		return fp.upstreamHTTP
+	}
 
-			stream, err = os.Open(item)
-		}
+	// Close unused connections of the previous client
 
-		if err != nil {
+	if fp.upstreamHTTP != nil {
+		fp.upstreamHTTP.Transport.(*http.Transport).CloseIdleConnections()
+	}
 
-			// Jump to the next file if there is an error
+	fp.upstreamHTTP = &http.Client{Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: config.timeout,
+		}).DialContext,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: !config.verifyTLS,
+			RootCAs:            config.rootCAs,
+		},
+		TLSHandshakeTimeout:   config.timeout,
+		ResponseHeaderTimeout: config.timeout,
+		IdleConnTimeout:       upstreamIdleConnTimeout,
+	}}
+	fp.upstreamHTTPConfig = config
+
+	return fp.upstreamHTTP
+}
 
-			fp.current++
+/*
+acquireUpstream waits until an upstream connection can be opened. The returned
+function must be called once the connection has been closed.
+*/
+func (fp *FilePlaylistFactory) acquireUpstream() func() {
 
-			return err
+	fp.upstreamSlotsOnce.Do(func() {
+		if fp.MaxUpstreamConns > 0 {
+			fp.upstreamSlots = make(chan struct{}, fp.MaxUpstreamConns)
 		}
+	})
 
-		fp.stream = stream
+	if fp.upstreamSlots == nil {
+		return func() {}
 	}
 
-	return err
-}
+	fp.upstreamSlots <- struct{}{}
 
-/*
-ReleaseFrame releases a frame which has been written to the client.
-*/
-func (fp *FilePlaylist) ReleaseFrame(frame []byte) {
-	if len(frame) == FrameSize {
-		fp.framePool.Put(frame)
+	return func() {
+		<-fp.upstreamSlots
 	}
 }
 
 /*
-Finished returns if the playlist has finished playing.
+upstreamBody is the body of an upstream connection. The body is closed once
+it has been read completely, a read error occurred or the playlist closes it.
 */
-func (fp *FilePlaylist) Finished() bool {
-	return fp.finished
+type upstreamBody struct {
+	io.ReadCloser           // Body of the upstream response
+	release       func()    // Function which is called once the body was closed
+	closeOnce     sync.Once // Make sure the body is only closed once
 }
 
 /*
-Close any open files by this playlist and reset the current pointer. After this
-call the playlist can be played again.
+Read reads from the body and closes it once there is no more data.
 */
-func (fp *FilePlaylist) Close() error {
-	if fp.stream != nil {
-		fp.stream.Close()
-		fp.stream = nil
+func (ub *upstreamBody) Read(p []byte) (int, error) {
+	n, err := ub.ReadCloser.Read(p)
+
+	if err != nil {
+		ub.Close()
 	}
-	fp.current = 0
-	fp.finished = false
 
-	return nil
+	return n, err
 }
 
 /*
-StreamBuffer is a buffer which implements io.ReadCloser and can be used to stream
-one stream into another. The buffer detects a potential underflow and waits
-until enough bytes were read from the source stream.
+Close closes the body and releases the upstream connection.
 */
-type StreamBuffer struct {
-	bytes.Buffer    // Buffer which is used to hold the data
-	readFromOngoing bool
+func (ub *upstreamBody) Close() error {
+	var err error
+
+	ub.closeOnce.Do(func() {
+		err = ub.ReadCloser.Close()
+		ub.release()
+	})
+
+	return err
 }
 
-func (b *StreamBuffer) Read(p []byte) (int, error) {
+/*
+fetchUpstream requests an upstream URL source. The data is requested from a
+given offset onwards (upstream sources may ignore the requested range). Only
+successful (2xx) responses and unsatisfiable ranges are returned. Failed
+requests and server errors are retried (with an increasing wait time) up to UpstreamRetries times.
+*/
+func (fp *FilePlaylistFactory) fetchUpstream(item string, offset int64) (*http.Response, error) {
+	var req *http.Request
+	var resp *http.Response
+	var err error
 
-	if b.readFromOngoing && b.Buffer.Len() < len(p) {
+	if req, err = http.NewRequest("GET", item, nil); err != nil {
+		return nil, err
+	}
 
-		// Prevent buffer underflow and wait until we got enough data for
-		// the next read
+	for k, v := range fp.UpstreamHeaders {
+		req.Header[k] = v
+	}
 
-		time.Sleep(10 * time.Millisecond)
-		return b.Read(p)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%v-", offset))
 	}
 
-	n, err := b.Buffer.Read(p)
+	client := fp.upstreamClient()
+	backoff := fp.UpstreamBackoff
 
-	// Return EOF if the buffer is empty
+	for i := 0; i <= fp.UpstreamRetries; i++ {
 
-	if err == nil {
-		if _, err = b.ReadByte(); err == nil {
-			b.UnreadByte()
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		if resp, err = client.Do(req); err == nil {
+
+			// Unsatisfiable ranges are reported by the caller
+
+			if (resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices) ||
+				(offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable) {
+				return resp, nil
+			}
+
+			resp.Body.Close()
+			err = fmt.Errorf("Upstream source %v returned: %v", item, resp.Status)
+
+			// Only server errors are worth another try - error pages must
+			// not be streamed as audio
+
+			if resp.StatusCode < http.StatusInternalServerError {
+				break
+			}
 		}
 	}
 
-	return n, err
+	return nil, err
 }
 
 /*
-ReadFrom reads the source stream into the buffer.
+FilePlaylist data structure
 */
-func (b *StreamBuffer) ReadFrom(r io.Reader) (int64, error) {
-	b.readFromOngoing = true
-	go func() {
-		b.Buffer.ReadFrom(r)
-		b.readFromOngoing = false
-	}()
-	return 0, nil
+type FilePlaylist struct {
+	path         string               // Path of this playlist
+	displayName  string               // Display name of this playlist (may be empty)
+	loopTimes    int                  // Number of loops of this playlist (0 uses the looping of the request handler)
+	maxListeners int                  // Maximum number of listeners of this playlist (0 is unlimited)
+	pathPrefix   string               // Prefix for all paths
+	current      int                  // Pointer to the current playing item
+	advance      bool                 // Flag if the current item has been used and the pointer needs to be advanced
+	data         []map[string]string  // Playlist items
+	stream       io.ReadCloser        // Current open stream
+	finished     bool                 // Flag if this playlist has finished
+	framePool    *sync.Pool           // Pool for byte arrays
+	frameSize    int                  // Frame size of this playlist (0 uses the global FrameSize)
+	factory      *FilePlaylistFactory // Factory which created this playlist
+	prefetch     chan *openResult     // Result of opening the next item in the background
+
+	playingJingle     bool      // Flag if the jingle is currently playing
+	tracksSinceJingle int       // Number of tracks since the last jingle
+	lastJingle        time.Time // Time when the last jingle was played
+
+	random *rand.Rand // Random source for shuffling (nil if the playlist is not shuffled)
+
+	wavHeaderSent bool // Flag if a WAV header has been send (following WAV headers are skipped)
+
+	comments map[string]string // Comments which were read from the current item (e.g. Vorbis comments)
 }
 
 /*
-Close does nothing but must be there to implement io.ReadCloser.
+openResult is the result of opening a playlist item
 */
-func (b *StreamBuffer) Close() error {
+type openResult struct {
+	stream io.ReadCloser
+	err    error
+}
+
+/*
+openFile opens a local file (can be replaced for unit tests).
+*/
+var openFile = func(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+/*
+currentItem returns the current playlist item
+*/
+func (fp *FilePlaylist) currentItem() map[string]string {
+	if fp.playingJingle {
+		return fp.factory.Jingle
+	}
 
-	// We are in memory so no need to close anything
+	if fp.current < len(fp.data) {
+		return fp.data[fp.current]
+	}
+
+	return fp.data[len(fp.data)-1]
+}
+
+/*
+Name is the name of the playlist.
+*/
+func (fp *FilePlaylist) Name() string {
+	return fp.path
+}
+
+/*
+DisplayName returns the display name of the playlist or an empty string.
+*/
+func (fp *FilePlaylist) DisplayName() string {
+	return fp.displayName
+}
+
+/*
+Loop returns if the playlist should be looped and how often it is looped. A
+count of 0 means that the playlist definition does not define the looping.
+*/
+func (fp *FilePlaylist) Loop() (bool, int) {
+	return fp.loopTimes != 1 && fp.loopTimes != 0, fp.loopTimes
+}
+
+/*
+MaxListeners returns the maximum number of clients which may stream this
+playlist at the same time (0 is unlimited).
+*/
+func (fp *FilePlaylist) MaxListeners() int {
+	return fp.maxListeners
+}
+
+/*
+ContentType returns the content type of this playlist e.g. audio/mpeg.
+*/
+func (fp *FilePlaylist) ContentType() string {
+	if ctype, ok := fp.currentItem()["contenttype"]; ok && ctype != "" {
+		return ctype
+	}
+
+	if ctype := fp.upstreamContentType(fp.currentItem()); ctype != "" {
+		return ctype
+	}
+
+	ext := filepath.Ext(fp.currentItem()["path"])
+
+	if ctype, ok := FileExtContentTypes[ext]; ok {
+		return ctype
+	}
+
+	if fp.factory.SniffContentType {
+		if ctype := fp.sniffContentType(fp.currentItem()); ctype != "" {
+			return ctype
+		}
+	}
+
+	if fp.factory.FallbackType != "" {
+		return fp.factory.FallbackType
+	}
+
+	return DefaultContentType
+}
+
+/*
+upstreamContentType returns the content type which was reported by the upstream
+source of an URL item when it was last opened. Returns an empty string if the
+item is not an URL item or no content type has been reported yet.
+*/
+func (fp *FilePlaylist) upstreamContentType(item map[string]string) string {
+
+	itemPath, err := resolveItemPath(fp.pathPrefix, item["path"])
+	if err != nil {
+		return ""
+	}
+
+	if !isURL(itemPath) {
+		return ""
+	}
+
+	fp.factory.detectedTypesLock.Lock()
+	defer fp.factory.detectedTypesLock.Unlock()
+
+	return fp.factory.detectedTypes[itemPath]
+}
+
+/*
+setDetectedType stores the detected content type of an item path (an empty
+content type removes the entry).
+*/
+func (f *FilePlaylistFactory) setDetectedType(itemPath string, ctype string) {
+	f.detectedTypesLock.Lock()
+	defer f.detectedTypesLock.Unlock()
+
+	if ctype == "" {
+		delete(f.detectedTypes, itemPath)
+		return
+	}
+
+	if f.detectedTypes == nil {
+		f.detectedTypes = make(map[string]string)
+	}
+
+	f.detectedTypes[itemPath] = ctype
+}
+
+/*
+sniffContentType detects the content type of a local file from its first
+bytes. The result is cached for each file. Returns an empty string if the
+content type could not be detected.
+*/
+func (fp *FilePlaylist) sniffContentType(item map[string]string) string {
+
+	itemPath, err := resolveItemPath(fp.pathPrefix, item["path"])
+	if err != nil {
+		return ""
+	}
+
+	if isURL(itemPath) {
+		return ""
+	}
+
+	fp.factory.detectedTypesLock.Lock()
+	ctype, ok := fp.factory.detectedTypes[itemPath]
+	fp.factory.detectedTypesLock.Unlock()
+
+	if ok {
+		return ctype
+	}
+
+	// The file is read without holding the lock so slow files do not block
+	// other playlists of the factory
+
+	f, err := openFile(itemPath)
+	if err != nil {
+		return ""
+	}
+
+	data := make([]byte, 512)
+	n, _ := io.ReadFull(f, data)
+	f.Close()
+
+	ctype = detectContentType(data[:n])
+
+	fp.factory.detectedTypesLock.Lock()
+	defer fp.factory.detectedTypesLock.Unlock()
+
+	if fp.factory.detectedTypes == nil {
+		fp.factory.detectedTypes = make(map[string]string)
+	}
+
+	// Unknown content types are cached as well
+
+	fp.factory.detectedTypes[itemPath] = ctype
+
+	return ctype
+}
+
+/*
+detectContentType detects the content type of audio data. Returns an empty
+string if the content type is unknown.
+*/
+func detectContentType(data []byte) string {
+
+	// Check for the sync word of a MPEG audio frame and for Ogg pages
+
+	if len(data) > 1 && data[0] == 0xFF && data[1]&0xE0 == 0xE0 {
+		return "audio/mpeg"
+	} else if bytes.HasPrefix(data, []byte("OggS")) {
+		return "audio/ogg"
+	}
+
+	ctype := http.DetectContentType(data)
+
+	if ctype == "application/octet-stream" {
+		return ""
+	}
+
+	return ctype
+}
+
+/*
+Artist returns the artist which is currently playing.
+*/
+func (fp *FilePlaylist) Artist() string {
+	return fp.itemField("artist")
+}
+
+/*
+Title returns the title which is currently playing.
+*/
+func (fp *FilePlaylist) Title() string {
+	return fp.itemField("title")
+}
+
+/*
+itemField returns a field of the current item. Missing fields are taken from
+the comments of the item file.
+*/
+func (fp *FilePlaylist) itemField(name string) string {
+	if val := fp.currentItem()[name]; val != "" || fp.playingJingle {
+		return val
+	}
+
+	return fp.comments[name]
+}
+
+/*
+Size returns the total length of the playlist data in bytes. The length is
+unknown (-1) if the playlist contains URLs, missing files or a jingle.
+*/
+func (fp *FilePlaylist) Size() int64 {
+	var size int64
+
+	if fp.factory.Jingle != nil {
+		return -1
+	}
+
+	for _, item := range fp.data {
+		itemPath, err := resolveItemPath(fp.pathPrefix, item["path"])
+		if err != nil {
+			return -1
+		}
+
+		if isURL(itemPath) {
+			return -1
+		}
+
+		info, err := os.Stat(itemPath)
+		if err != nil {
+			return -1
+		}
+
+		start, end, err := itemRange(item)
+		if err != nil {
+			return -1
+		}
+
+		if end < 0 || end > info.Size() {
+			end = info.Size()
+		}
+
+		if end > start {
+			size += end - start
+		}
+	}
+
+	return size
+}
+
+/*
+Frame returns the current audio frame which is playing.
+*/
+func (fp *FilePlaylist) Frame() ([]byte, error) {
+	var err error
+	var frame []byte
+
+	if fp.finished {
+		return nil, dudeldu.ErrPlaylistEnd
+	}
+
+	if fp.stream == nil {
+
+		// Make sure first file is loaded
+
+		err = fp.nextFile()
+	}
+
+	if err == nil {
+
+		// Get new byte array from a pool
+
+		frame = fp.framePool.Get().([]byte)
+
+		n := 0
+		nn := 0
+
+		for n < len(frame) && err == nil {
+
+			nn, err = fp.stream.Read(frame[n:])
+			n += nn
+
+			// Check if we need to read the next file
+
+			if n < len(frame) || err == io.EOF {
+				err = fp.nextFile()
+			}
+		}
+
+		// Make sure the frame has no old data if it was only partially filled
+
+		if n == 0 {
+
+			// Special case we reached the end of the playlist or the next
+			// item could not be opened
+
+			frame = nil
+
+		} else if n < len(frame) {
+
+			// Resize frame if we have less data
+
+			frame = frame[:n]
+		}
+	}
+
+	if err == dudeldu.ErrPlaylistEnd {
+		fp.finished = true
+	}
+
+	return frame, err
+}
+
+/*
+nextFile jumps to the next file for the playlist.
+*/
+func (fp *FilePlaylist) nextFile() error {
+	var err error
+	var stream io.ReadCloser
+
+	if fp.stream != nil {
+		fp.stream.Close()
+		fp.stream = nil
+		fp.comments = nil
+	}
+
+	// Advance the current pointer if the current item has already been
+	// played or could not be opened
+
+	if fp.advance {
+
+		if fp.playingJingle {
+
+			// The current item has already been advanced before the jingle
+
+			fp.playingJingle = false
+
+		} else {
+
+			if err = fp.advanceItem(); err != nil {
+				return err
+			}
+
+			fp.playingJingle = fp.jingleDue()
+		}
+	}
+
+	// Every item is opened only once - also if the open fails
+
+	fp.advance = true
+
+	if fp.playingJingle {
+
+		// Keep a prefetched stream for the item after the jingle
+
+		if stream, err = fp.openItem(fp.factory.Jingle); err == nil {
+			err = fp.skipRepeatedHeader(fp.factory.Jingle, stream)
+		}
+
+		if err != nil {
+
+			// Open the current item next
+
+			fp.playingJingle = false
+			fp.advance = false
+
+			return err
+		}
+
+		fp.stream = stream
+
+		return nil
+
+	} else if fp.prefetch != nil {
+
+		// Use the stream which was opened in the background
+
+		res := <-fp.prefetch
+		fp.prefetch = nil
+
+		stream, err = res.stream, res.err
+
+	} else {
+
+		stream, err = fp.openItem(fp.currentItem())
+	}
+
+	if err == nil {
+		err = fp.skipRepeatedHeader(fp.currentItem(), stream)
+	}
+
+	if err != nil {
+
+		// The next call jumps to the next item
+
+		return err
+	}
+
+	fp.stream = stream
+	fp.comments = fp.readComments(fp.currentItem())
+
+	fp.prefetchNext()
+
+	return nil
+}
+
+/*
+advanceItem moves the current pointer to the next item. Returns a special
+error if the end of the playlist has been reached.
+*/
+func (fp *FilePlaylist) advanceItem() error {
+	fp.current++
+
+	if fp.current >= len(fp.data) {
+		return dudeldu.ErrPlaylistEnd
+	}
+
+	return nil
+}
+
+/*
+jingleDue checks if the jingle should be played before the next track.
+*/
+func (fp *FilePlaylist) jingleDue() bool {
+	if fp.factory.Jingle == nil {
+		return false
+	}
+
+	fp.tracksSinceJingle++
+
+	if (fp.factory.JingleEveryTracks > 0 && fp.tracksSinceJingle >= fp.factory.JingleEveryTracks) ||
+		(fp.factory.JingleEvery > 0 && time.Since(fp.lastJingle) >= fp.factory.JingleEvery) {
+
+		fp.tracksSinceJingle = 0
+		fp.lastJingle = time.Now()
+
+		return true
+	}
+
+	return false
+}
+
+/*
+openItem opens the stream of a given playlist item.
+*/
+func (fp *FilePlaylist) openItem(item map[string]string) (io.ReadCloser, error) {
+	var stream io.ReadCloser
+
+	itemPath, err := resolveItemPath(fp.pathPrefix, item["path"])
+	if err != nil {
+		return nil, err
+	}
+
+	start, end, err := itemRange(item)
+	if err != nil {
+		return nil, err
+	}
+
+	skip := start
+
+	if isURL(itemPath) {
+		var resp *http.Response
+
+		// We got an url - access it (SSL verification depends on the factory)
+
+		release := fp.factory.acquireUpstream()
+
+		if resp, err = fp.factory.fetchUpstream(itemPath, start); err == nil {
+
+			if start > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+				resp.Body.Close()
+				release()
+
+				return nil, fmt.Errorf("Upstream source %v cannot start at offset %v", itemPath, start)
+			}
+
+			// The data before the start offset must only be skipped if the
+			// upstream source ignored the requested range
+
+			if resp.StatusCode == http.StatusPartialContent {
+				skip = 0
+			}
+
+			fp.factory.setDetectedType(itemPath, resp.Header.Get("Content-Type"))
+
+			buf := &StreamBuffer{}
+			buf.ReadFrom(&upstreamBody{ReadCloser: resp.Body, release: release})
+			stream = buf
+		} else {
+			release()
+		}
+
+	} else {
+
+		// Open a new file
+
+		stream, err = openFile(itemPath)
+	}
+
+	if err == nil {
+
+		length := int64(-1)
+		if end >= 0 {
+			length = end - start
+		}
+
+		if stream, err = trimStream(stream, skip, length); err != nil {
+			stream = nil
+		}
+	}
+
+	return stream, err
+}
+
+/*
+itemRange returns the start and end offsets of a playlist item. The end is -1
+if the item has no end offset.
+*/
+func itemRange(item map[string]string) (int64, int64, error) {
+	var start, end int64 = 0, -1
+	var err error
+
+	if s, ok := item["start"]; ok && s != "" {
+		if start, err = strconv.ParseInt(s, 10, 64); err != nil || start < 0 {
+			return 0, -1, fmt.Errorf("Invalid start offset %v for %v", s, item["path"])
+		}
+	}
+
+	if e, ok := item["end"]; ok && e != "" {
+		if end, err = strconv.ParseInt(e, 10, 64); err != nil || end < start {
+			return 0, -1, fmt.Errorf("Invalid end offset %v for %v", e, item["path"])
+		}
+	}
+
+	return start, end, nil
+}
+
+/*
+trimmedStream is the stream of an item which ends before its data ends.
+*/
+type trimmedStream struct {
+	io.Reader // Reader which stops at the end offset
+	io.Closer // Closer of the underlying stream
+}
+
+/*
+trimStream skips a number of bytes at the start of a stream and limits the
+stream to a given length (-1 is unlimited). The stream is closed if an error
+occurs.
+*/
+func trimStream(stream io.ReadCloser, skip int64, length int64) (io.ReadCloser, error) {
+	var err error
+
+	if skip > 0 {
+
+		// Seek if possible otherwise skip the data
+
+		if seeker, ok := stream.(io.Seeker); ok {
+			_, err = seeker.Seek(skip, io.SeekStart)
+		} else {
+			_, err = io.CopyN(ioutil.Discard, stream, skip)
+		}
+	}
+
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	if length >= 0 {
+		stream = &trimmedStream{io.LimitReader(stream, length), stream}
+	}
+
+	return stream, nil
+}
+
+/*
+isURL checks if an item path is an absolute URL.
+*/
+func isURL(itemPath string) bool {
+	u, err := url.Parse(itemPath)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
+
+/*
+resolveItemPath prefixes the path of an item with a given path prefix. Local
+paths which resolve to a location outside of the prefix are refused. URLs are
+not checked.
+*/
+func resolveItemPath(pathPrefix string, itemPath string) (string, error) {
+	fullPath := pathPrefix + itemPath
+
+	if pathPrefix == "" {
+		return fullPath, nil
+	}
+
+	if isURL(fullPath) {
+		return fullPath, nil
+	}
+
+	root := filepath.Clean(pathPrefix)
+	cleanPath := filepath.Clean(fullPath)
+
+	// Directory prefixes must be followed by a separator
+
+	if (strings.HasSuffix(pathPrefix, "/") || strings.HasSuffix(pathPrefix, string(filepath.Separator))) &&
+		!strings.HasSuffix(root, string(filepath.Separator)) {
+
+		root += string(filepath.Separator)
+	}
+
+	if !strings.HasPrefix(cleanPath, root) {
+		return "", fmt.Errorf("Item path %v is outside of %v", itemPath, pathPrefix)
+	}
+
+	return fullPath, nil
+}
+
+/*
+readComments reads the comments of a local Ogg item if the item definition
+does not specify an artist or title. Unreadable comments are ignored.
+*/
+func (fp *FilePlaylist) readComments(item map[string]string) map[string]string {
+
+	if item["artist"] != "" && item["title"] != "" {
+		return nil
+	}
+
+	switch strings.ToLower(filepath.Ext(item["path"])) {
+	case ".ogg", ".oga", ".opus":
+	default:
+		return nil
+	}
+
+	itemPath, err := resolveItemPath(fp.pathPrefix, item["path"])
+	if err != nil {
+		return nil
+	}
+
+	if isURL(itemPath) {
+		return nil
+	}
+
+	// Read the comments with a separate reader so the stream is not affected
+
+	stream, err := openFile(itemPath)
+	if err != nil {
+		return nil
+	}
+	defer stream.Close()
+
+	comments, _ := readOggComments(stream)
+
+	return comments
+}
+
+/*
+skipRepeatedHeader skips the header of a WAV item if a WAV header has already
+been send. A client expects a single header at the beginning of the stream -
+also if the playlist contains several WAV items or is looped.
+*/
+func (fp *FilePlaylist) skipRepeatedHeader(item map[string]string, stream io.ReadCloser) error {
+
+	if strings.ToLower(filepath.Ext(item["path"])) != ".wav" {
+		return nil
+	}
+
+	if !fp.wavHeaderSent {
+		fp.wavHeaderSent = true
+		return nil
+	}
+
+	err := skipWavHeader(stream)
+
+	if err != nil {
+		stream.Close()
+	}
+
+	return err
+}
+
+/*
+skipWavHeader reads all RIFF chunks of a WAV stream until the start of the
+audio data.
+*/
+func skipWavHeader(r io.Reader) error {
+	header := make([]byte, 12)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+
+	if string(header[:4]) != "RIFF" || string(header[8:]) != "WAVE" {
+		return fmt.Errorf("Invalid WAV header")
+	}
+
+	chunk := make([]byte, 8)
+
+	for {
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return err
+		}
+
+		if string(chunk[:4]) == "data" {
+			return nil
+		}
+
+		// Skip the chunk - chunks are padded to an even size
+
+		size := int64(binary.LittleEndian.Uint32(chunk[4:]))
+
+		if _, err := io.CopyN(ioutil.Discard, r, size+size%2); err != nil {
+			return err
+		}
+	}
+}
+
+/*
+prefetchNext opens the item after the current item in the background. Does
+nothing if prefetching is disabled or the current item is the last item.
+*/
+func (fp *FilePlaylist) prefetchNext() {
+
+	if !fp.factory.Prefetch || fp.current+1 >= len(fp.data) {
+		return
+	}
+
+	item := fp.data[fp.current+1]
+	fp.prefetch = make(chan *openResult, 1)
+
+	go func(res chan *openResult) {
+		stream, err := fp.openItem(item)
+		res <- &openResult{stream, err}
+	}(fp.prefetch)
+}
+
+/*
+cancelPrefetch discards an ongoing or completed background open operation.
+*/
+func (fp *FilePlaylist) cancelPrefetch() {
+
+	if fp.prefetch != nil {
+
+		go func(res chan *openResult) {
+			if r := <-res; r.stream != nil {
+				r.stream.Close()
+			}
+		}(fp.prefetch)
+
+		fp.prefetch = nil
+	}
+}
+
+/*
+Skip advances the playlist to the next track.
+*/
+func (fp *FilePlaylist) Skip() error {
+	var err error
+
+	if fp.finished {
+		return dudeldu.ErrPlaylistEnd
+	}
+
+	if fp.stream != nil {
+
+		// Close the current stream and open the next one
+
+		err = fp.nextFile()
+
+	} else {
+
+		// Nothing is playing - just move the pointer (an item which could
+		// not be opened is left by the next call to nextFile)
+
+		err = fp.advanceItem()
+	}
+
+	if err == dudeldu.ErrPlaylistEnd {
+		fp.finished = true
+	}
+
+	return err
+}
+
+/*
+SeekTo positions the playlist at a byte offset from the start of the playlist
+data. Playlists with a jingle do not support seeking. The length of URL items is
+unknown - offsets are assumed to be within the first URL item of a playlist.
+*/
+func (fp *FilePlaylist) SeekTo(offset int64) error {
+
+	if fp.factory.Jingle != nil {
+		return fmt.Errorf("Cannot seek in a playlist with a jingle")
+	}
+
+	index, itemOffset, err := fp.seekTarget(offset)
+	if err != nil {
+		return err
+	}
+
+	// Open the item at the new start offset
+
+	item := make(map[string]string)
+	for k, v := range fp.data[index] {
+		item[k] = v
+	}
+
+	start, _, _ := itemRange(item)
+	item["start"] = strconv.FormatInt(start+itemOffset, 10)
+
+	stream, err := fp.openItem(item)
+	if err != nil {
+		return err
+	}
+
+	fp.cancelPrefetch()
+
+	if fp.stream != nil {
+		fp.stream.Close()
+	}
+
+	fp.stream = stream
+	fp.current = index
+	fp.advance = true
+	fp.finished = false
+	fp.playingJingle = false
+	fp.comments = fp.readComments(item)
+
+	// The data before the offset contained a WAV header
+
+	if offset > 0 {
+		fp.wavHeaderSent = true
+	}
+
+	fp.prefetchNext()
+
+	return nil
+}
+
+/*
+seekTarget returns the item which contains a given byte offset and the offset
+within the item.
+*/
+func (fp *FilePlaylist) seekTarget(offset int64) (int, int64, error) {
+
+	if offset < 0 {
+		return 0, 0, fmt.Errorf("Invalid offset %v", offset)
+	}
+
+	for i, item := range fp.data {
+		itemPath, err := resolveItemPath(fp.pathPrefix, item["path"])
+		if err != nil {
+			return 0, 0, err
+		}
+
+		// The length of URL items is unknown - the offset must be within
+		// the first URL item
+
+		if isURL(itemPath) {
+			return i, offset, nil
+		}
+
+		info, err := os.Stat(itemPath)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		start, end, err := itemRange(item)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if end < 0 || end > info.Size() {
+			end = info.Size()
+		}
+
+		if length := end - start; offset < length {
+			return i, offset, nil
+		} else if length > 0 {
+			offset -= length
+		}
+	}
+
+	return 0, 0, fmt.Errorf("Offset is beyond the end of the playlist")
+}
+
+/*
+ReleaseFrame releases a frame which has been written to the client.
+*/
+func (fp *FilePlaylist) ReleaseFrame(frame []byte) {
+	if len(frame) == fp.getFrameSize() {
+		fp.framePool.Put(frame)
+	}
+}
+
+/*
+getFrameSize returns the frame size of this playlist.
+*/
+func (fp *FilePlaylist) getFrameSize() int {
+	if fp.frameSize > 0 {
+		return fp.frameSize
+	}
+	return FrameSize
+}
+
+/*
+Genre returns the genre of the current item or an empty string.
+*/
+func (fp *FilePlaylist) Genre() string {
+	return fp.currentItem()["genre"]
+}
+
+/*
+Album returns the album of the current item or an empty string.
+*/
+func (fp *FilePlaylist) Album() string {
+	return fp.itemField("album")
+}
+
+/*
+Cover returns the path of the cover image file of the current item or an empty
+string.
+*/
+func (fp *FilePlaylist) Cover() string {
+	cover := fp.currentItem()["cover"]
+
+	if cover == "" {
+		return ""
+	}
+
+	coverPath, err := resolveItemPath(fp.pathPrefix, cover)
+	if err != nil {
+		return ""
+	}
+
+	return coverPath
+}
+
+/*
+Position returns the position of the current item in the playlist.
+*/
+func (fp *FilePlaylist) Position() int {
+	return fp.current
+}
+
+/*
+Finished returns if the playlist has finished playing.
+*/
+func (fp *FilePlaylist) Finished() bool {
+	return fp.finished
+}
+
+/*
+Close any open files by this playlist and reset the current pointer.
+*/
+func (fp *FilePlaylist) Close() error {
+	fp.cancelPrefetch()
+
+	if fp.stream != nil {
+		fp.stream.Close()
+		fp.stream = nil
+		fp.comments = nil
+	}
+	fp.current = 0
+	fp.advance = false
+	fp.finished = false
+	fp.playingJingle = false
+	fp.tracksSinceJingle = 0
+
+	return nil
+}
+
+/*
+Reset rewinds the playlist so it can be played again. Shuffled playlists are
+shuffled again if the factory requests it.
+*/
+func (fp *FilePlaylist) Reset() error {
+	fp.Close()
+
+	if fp.random != nil && fp.factory.ReshuffleOnLoop {
+		fp.reshuffle()
+	}
+
+	return nil
+}
+
+/*
+reshuffle shuffles the playlist again. The last played item will not be the
+first item of the new order. Playlists with less than two items keep their order.
+*/
+func (fp *FilePlaylist) reshuffle() {
+	if len(fp.data) < 2 {
+		return
+	}
+
+	last := fp.data[len(fp.data)-1]
+
+	fp.data = shuffleItems(fp.data, fp.random)
+
+	if fp.data[0]["path"] == last["path"] {
+
+		// Swap the first item with any other item
+
+		i := 1 + fp.random.Intn(len(fp.data)-1)
+		fp.data[0], fp.data[i] = fp.data[i], fp.data[0]
+	}
+}
+
+/*
+DefaultStreamBufferCapacity is the capacity of a StreamBuffer which does not
+define its own capacity.
+*/
+const DefaultStreamBufferCapacity = 256 * 1024
+
+/*
+MaxStreamBufferBytes is the maximum number of bytes which can be held by all
+StreamBuffers together (0 is unlimited). Reading from a source stream pauses
+while the budget is exhausted and resumes once any buffer is read.
+*/
+var MaxStreamBufferBytes = 0
+
+/*
+byteBudget is a counting semaphore of bytes which is shared by all StreamBuffers.
+*/
+type byteBudget struct {
+	used int        // Number of bytes which are currently held
+	lock sync.Mutex // Lock for the budget
+	cond *sync.Cond // Condition which signals released bytes
+}
+
+/*
+streamBufferBudget is the global budget of all StreamBuffers.
+*/
+var streamBufferBudget = newByteBudget()
+
+/*
+newByteBudget creates a new byteBudget.
+*/
+func newByteBudget() *byteBudget {
+	bb := &byteBudget{}
+	bb.cond = sync.NewCond(&bb.lock)
+	return bb
+}
+
+/*
+tryAcquire takes up to want bytes from the budget without waiting. Returns the
+number of taken bytes.
+*/
+func (bb *byteBudget) tryAcquire(want int) int {
+	bb.lock.Lock()
+	defer bb.lock.Unlock()
+
+	return bb.take(want)
+}
+
+/*
+acquire takes up to want bytes from the budget. Waits until bytes are available
+or the cancelled function returns true. Returns the number of taken bytes.
+*/
+func (bb *byteBudget) acquire(want int, cancelled func() bool) int {
+	bb.lock.Lock()
+	defer bb.lock.Unlock()
+
+	for MaxStreamBufferBytes > 0 && bb.used >= MaxStreamBufferBytes && !cancelled() {
+		bb.cond.Wait()
+	}
+
+	if cancelled() {
+		return 0
+	}
+
+	return bb.take(want)
+}
+
+/*
+take takes up to want bytes from the budget. The budget lock must be held.
+*/
+func (bb *byteBudget) take(want int) int {
+	if MaxStreamBufferBytes > 0 && want > MaxStreamBufferBytes-bb.used {
+		want = MaxStreamBufferBytes - bb.used
+	}
+
+	if want < 0 {
+		want = 0
+	}
+
+	bb.used += want
+
+	return want
+}
+
+/*
+release returns bytes to the budget and wakes up all waiting buffers.
+*/
+func (bb *byteBudget) release(n int) {
+	bb.lock.Lock()
+	bb.used -= n
+	bb.cond.Broadcast()
+	bb.lock.Unlock()
+}
+
+/*
+StreamBuffer is a buffer which implements io.ReadCloser and can be used to stream
+one stream into another. The buffer detects a potential underflow and waits
+until enough bytes were read from the source stream.
+
+The data is held in a ring buffer of a fixed capacity - reading from the
+source stream pauses while the buffer is full or the global budget of all
+buffers (MaxStreamBufferBytes) is exhausted.
+*/
+type StreamBuffer struct {
+	Capacity        int        // Capacity of the buffer (0 uses DefaultStreamBufferCapacity)
+	buf             []byte     // Ring buffer which is used to hold the data
+	start           int        // Position of the first unread byte in the ring buffer
+	size            int        // Number of unread bytes in the ring buffer
+	src             io.Reader  // Source stream
+	readFromOngoing bool       // Flag if the source stream is still being read
+	starved         bool       // Flag if reading the source stream waits for the global budget
+	closed          bool       // Flag if the buffer has been closed
+	budget          int        // Number of bytes of the global budget held by the buffer
+	lock            sync.Mutex // Lock for the buffer state
+	cond            *sync.Cond // Condition which signals changes of the buffer state
+}
+
+/*
+init allocates the ring buffer. The buffer lock must be held.
+*/
+func (b *StreamBuffer) init() {
+	if b.buf == nil {
+		capacity := b.Capacity
+		if capacity <= 0 {
+			capacity = DefaultStreamBufferCapacity
+		}
+
+		b.buf = make([]byte, capacity)
+		b.cond = sync.NewCond(&b.lock)
+	}
+}
+
+/*
+Read reads data from the buffer. Returns EOF once the source stream has ended
+and all data has been read.
+*/
+func (b *StreamBuffer) Read(p []byte) (int, error) {
+	var released int
+
+	// Return the read bytes to the global budget once the buffer is unlocked
+
+	defer func() {
+		if released > 0 {
+			streamBufferBudget.release(released)
+		}
+	}()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.init()
+
+	want := len(p)
+	if want > len(b.buf) {
+		want = len(b.buf)
+	}
+
+	// Prevent buffer underflow and wait until we got enough data for
+	// the next read - do not wait for data which cannot be buffered
+	// because the global budget is exhausted
+
+	for b.readFromOngoing && !b.closed && !b.starved && b.size < want {
+		b.cond.Wait()
+	}
+
+	// Copy the data - the unread data may wrap around the end of the ring
+
+	n := 0
+
+	for n < len(p) && b.size > 0 {
+		end := b.start + b.size
+		if end > len(b.buf) {
+			end = len(b.buf)
+		}
+
+		nn := copy(p[n:], b.buf[b.start:end])
+
+		n += nn
+		b.start = (b.start + nn) % len(b.buf)
+		b.size -= nn
+	}
+
+	released = n
+	if released > b.budget {
+		released = b.budget
+	}
+	b.budget -= released
+
+	b.cond.Broadcast()
+
+	// Return EOF if the buffer is empty
+
+	if b.size == 0 && (!b.readFromOngoing || b.closed) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+/*
+ReadFrom reads the source stream into the buffer.
+*/
+func (b *StreamBuffer) ReadFrom(r io.Reader) (int64, error) {
+	b.lock.Lock()
+	b.init()
+	b.src = r
+	b.readFromOngoing = true
+	b.lock.Unlock()
+
+	go func() {
+		var err error
+
+		for err == nil {
+			var n int
+
+			b.lock.Lock()
+
+			// Wait until there is free space in the ring
+
+			for b.size == len(b.buf) && !b.closed {
+				b.cond.Wait()
+			}
+
+			if b.closed {
+				b.lock.Unlock()
+				break
+			}
+
+			// Read into the free space after the unread data - the reader
+			// does not touch this part of the ring
+
+			end := (b.start + b.size) % len(b.buf)
+			free := len(b.buf) - end
+			if end < b.start {
+				free = b.start - end
+			}
+
+			b.lock.Unlock()
+
+			// Take the free space from the global budget - signal waiting
+			// reads if the budget is exhausted
+
+			granted := streamBufferBudget.tryAcquire(free)
+
+			if granted == 0 {
+				b.lock.Lock()
+				b.starved = true
+				b.cond.Broadcast()
+				b.lock.Unlock()
+
+				granted = streamBufferBudget.acquire(free, b.isClosed)
+
+				b.lock.Lock()
+				b.starved = false
+				b.lock.Unlock()
+
+				if granted == 0 {
+					break
+				}
+			}
+
+			n, err = r.Read(b.buf[end : end+granted])
+
+			b.lock.Lock()
+			b.size += n
+
+			unused := granted - n
+			if b.closed {
+				unused = granted
+			} else {
+				b.budget += n
+			}
+
+			b.cond.Broadcast()
+			b.lock.Unlock()
+
+			if unused > 0 {
+				streamBufferBudget.release(unused)
+			}
+		}
+
+		b.lock.Lock()
+		b.readFromOngoing = false
+		b.cond.Broadcast()
+		b.lock.Unlock()
+	}()
+
+	return 0, nil
+}
+
+/*
+isClosed returns if the buffer has been closed.
+*/
+func (b *StreamBuffer) isClosed() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.closed
+}
+
+/*
+Close closes the buffer and the source stream (if it can be closed). Waiting
+reads return immediately.
+*/
+func (b *StreamBuffer) Close() error {
+	b.lock.Lock()
+	b.init()
+	b.closed = true
+	b.cond.Broadcast()
+	src := b.src
+	budget := b.budget
+	b.budget = 0
+	b.lock.Unlock()
+
+	// Return the held bytes to the global budget - this also wakes up
+	// a source stream which waits for the budget
+
+	streamBufferBudget.release(budget)
+
+	if c, ok := src.(io.Closer); ok {
+		return c.Close()
+	}
 
 	return nil
 }
@@ -11,16 +11,28 @@
 package playlist
 
 import (
+	"bytes"
+	"crypto/x509"
+	"encoding/binary"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"devt.de/krotik/common/fileutil"
 	"devt.de/krotik/common/httputil"
+	"devt.de/krotik/common/testutil"
 	"devt.de/krotik/dudeldu"
 )
 
@@ -82,7 +94,7 @@ const testPlaylist2 = `{
 	]
 }`
 
-const invalidFileName = "**" + string(0x0)
+const invalidFileName = "**" + string(rune(0x0))
 
 func TestMain(m *testing.M) {
 	flag.Parse()
@@ -392,7 +404,7 @@ func TestFilePlaylist(t *testing.T) {
 		return
 	}
 
-	if pl.ContentType() != "audio" {
+	if pl.ContentType() != "application/octet-stream" {
 		t.Error("Content type should be generic not:", pl.ContentType())
 		return
 	}
@@ -578,3 +590,2332 @@ func stopServer(hs *httputil.HTTPServer, wg *sync.WaitGroup) {
 		panic("Server was not running as expected")
 	}
 }
+
+func TestUpstreamTLSVerification(t *testing.T) {
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("securedata"))
+	}))
+	ts.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	defer ts.Close()
+
+	oldFrameSize := FrameSize
+	FrameSize = 10
+	defer func() {
+		FrameSize = oldFrameSize
+	}()
+
+	plf := &FilePlaylistFactory{
+		data: map[string][]map[string]string{
+			"/secure": {{"artist": "artist1", "title": "test1", "path": ts.URL + "/song.mp3"}},
+		},
+	}
+
+	// Default behaviour does not verify the certificate
+
+	pl := plf.Playlist("/secure", false)
+
+	if frame, err := pl.Frame(); err != dudeldu.ErrPlaylistEnd || string(frame) != "securedata" {
+		t.Error("Unexpected result:", string(frame), err)
+		return
+	}
+	pl.Close()
+
+	// Enabling verification must fail for an untrusted certificate
+
+	plf.VerifyUpstreamTLS = true
+
+	pl = plf.Playlist("/secure", false)
+
+	if frame, err := pl.Frame(); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Error("Unexpected result:", string(frame), err)
+		return
+	}
+	pl.Close()
+
+	// Trust the certificate of the test server
+
+	plf.UpstreamRootCAs = x509.NewCertPool()
+	plf.UpstreamRootCAs.AddCert(ts.Certificate())
+
+	pl = plf.Playlist("/secure", false)
+
+	if frame, err := pl.Frame(); err != dudeldu.ErrPlaylistEnd || string(frame) != "securedata" {
+		t.Error("Unexpected result:", string(frame), err)
+		return
+	}
+	pl.Close()
+}
+
+func TestUpstreamClientReuse(t *testing.T) {
+	var lock sync.Mutex
+	remotes := make(map[string]bool)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		remotes[r.RemoteAddr] = true
+		lock.Unlock()
+		w.Write([]byte("keepalive"))
+	}))
+	defer ts.Close()
+
+	oldFrameSize := FrameSize
+	FrameSize = 9
+	defer func() {
+		FrameSize = oldFrameSize
+	}()
+
+	plf := &FilePlaylistFactory{
+		data: map[string][]map[string]string{
+			"/keepalive": {{"artist": "artist1", "title": "test1", "path": ts.URL + "/song.mp3"}},
+		},
+	}
+
+	// All playlists of a factory share the same client and connection
+
+	for i := 0; i < 3; i++ {
+		pl := plf.Playlist("/keepalive", false)
+
+		if frame, err := pl.Frame(); err != dudeldu.ErrPlaylistEnd || string(frame) != "keepalive" {
+			t.Error("Unexpected result:", string(frame), err)
+			return
+		}
+		pl.Close()
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if len(remotes) != 1 {
+		t.Error("Upstream connection should be reused:", remotes)
+		return
+	}
+
+	if client := plf.upstreamClient(); client != plf.upstreamClient() {
+		t.Error("Upstream client should be shared")
+		return
+	}
+
+	// Changing the upstream settings builds a new client
+
+	client := plf.upstreamClient()
+	plf.UpstreamTimeout = time.Second
+
+	if plf.upstreamClient() == client {
+		t.Error("Upstream client should have been rebuilt")
+		return
+	}
+}
+
+func TestUpstreamRetry(t *testing.T) {
+	var requests int
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("flakydata"))
+	}))
+	defer ts.Close()
+
+	oldFrameSize := FrameSize
+	FrameSize = 9
+	defer func() {
+		FrameSize = oldFrameSize
+	}()
+
+	plf := &FilePlaylistFactory{
+		data: map[string][]map[string]string{
+			"/flaky": {{"artist": "artist1", "title": "test1", "path": ts.URL + "/song.mp3"}},
+		},
+		UpstreamTimeout: time.Second,
+		UpstreamBackoff: time.Millisecond,
+	}
+
+	// Without retries the item is skipped
+
+	pl := plf.Playlist("/flaky", false)
+
+	if frame, err := pl.Frame(); err == nil || err.Error() != "Upstream source "+ts.URL+
+		"/song.mp3 returned: 503 Service Unavailable" {
+		t.Error("Unexpected result:", string(frame), err)
+		return
+	}
+	pl.Close()
+
+	// A retry recovers from a single failure
+
+	requests = 0
+	plf.UpstreamRetries = 2
+
+	pl = plf.Playlist("/flaky", false)
+
+	if frame, err := pl.Frame(); err != dudeldu.ErrPlaylistEnd || string(frame) != "flakydata" {
+		t.Error("Unexpected result:", string(frame), err)
+		return
+	}
+	pl.Close()
+
+	if requests != 2 {
+		t.Error("Unexpected number of requests:", requests)
+		return
+	}
+}
+
+func TestUpstreamHeaders(t *testing.T) {
+
+	var requests int
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Authorization") != "Bearer secret" || r.UserAgent() != "DudelDu" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("authdata"))
+	}))
+	defer ts.Close()
+
+	oldFrameSize := FrameSize
+	FrameSize = 8
+	defer func() {
+		FrameSize = oldFrameSize
+	}()
+
+	plf := &FilePlaylistFactory{
+		data: map[string][]map[string]string{
+			"/auth": {{"artist": "artist1", "title": "test1", "path": ts.URL + "/song.mp3"}},
+		},
+		UpstreamRetries: 2,
+		UpstreamBackoff: time.Millisecond,
+	}
+
+	// Without the headers the upstream source refuses the request - the error
+	// page is not streamed and client errors are not retried
+
+	pl := plf.Playlist("/auth", false)
+
+	if frame, err := pl.Frame(); err == nil || frame != nil || err.Error() != "Upstream source "+ts.URL+
+		"/song.mp3 returned: 401 Unauthorized" {
+		t.Error("Unexpected result:", string(frame), err)
+		return
+	}
+	pl.Close()
+
+	if requests != 1 {
+		t.Error("Unexpected number of requests:", requests)
+		return
+	}
+
+	plf.UpstreamHeaders = http.Header{}
+	plf.UpstreamHeaders.Set("Authorization", "Bearer secret")
+	plf.UpstreamHeaders.Set("User-Agent", "DudelDu")
+
+	pl = plf.Playlist("/auth", false)
+
+	if frame, err := pl.Frame(); err != dudeldu.ErrPlaylistEnd || string(frame) != "authdata" {
+		t.Error("Unexpected result:", string(frame), err)
+		return
+	}
+	pl.Close()
+}
+
+func TestMaxUpstreamConns(t *testing.T) {
+	var lock sync.Mutex
+	var active, maxActive, requests int
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		if active++; active > maxActive {
+			maxActive = active
+		}
+		lock.Unlock()
+
+		defer func() {
+			lock.Lock()
+			active--
+			lock.Unlock()
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("data"))
+	}))
+	defer ts.Close()
+
+	oldFrameSize := FrameSize
+	FrameSize = 4
+	defer func() {
+		FrameSize = oldFrameSize
+	}()
+
+	plf := &FilePlaylistFactory{
+		data: map[string][]map[string]string{
+			"/upstream": {
+				{"artist": "artist1", "title": "test1", "path": ts.URL + "/song1.mp3"},
+				{"artist": "artist2", "title": "test2", "path": ts.URL + "/song2.mp3"},
+				{"artist": "artist3", "title": "test3", "path": ts.URL + "/song3.mp3"},
+			},
+		},
+		MaxUpstreamConns: 2,
+	}
+
+	var wg sync.WaitGroup
+
+	results := make([]string, 4)
+
+	for i := range results {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			pl := plf.Playlist("/upstream", false)
+			defer pl.Close()
+
+			for !pl.Finished() {
+				if frame, _ := pl.Frame(); frame != nil {
+					results[i] += string(frame)
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	for _, res := range results {
+		if res != "datadatadata" {
+			t.Error("Unexpected result:", results)
+			return
+		}
+	}
+
+	if maxActive != 2 || requests != 12 {
+		t.Error("Unexpected number of upstream connections:", maxActive, requests)
+		return
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+
+	err := ioutil.WriteFile(pdir+"/prefetch1.mp3", []byte("12"), 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = ioutil.WriteFile(pdir+"/prefetch2.mp3", []byte("34"), 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	oldFrameSize := FrameSize
+	FrameSize = 2
+	oldOpenFile := openFile
+	openFile = func(name string) (io.ReadCloser, error) {
+		if strings.HasSuffix(name, "prefetch2.mp3") {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return os.Open(name)
+	}
+	defer func() {
+		FrameSize = oldFrameSize
+		openFile = oldOpenFile
+	}()
+
+	plf := &FilePlaylistFactory{
+		data: map[string][]map[string]string{
+			"/prefetch": {
+				{"artist": "artist1", "title": "test1", "path": pdir + "/prefetch1.mp3"},
+				{"artist": "artist2", "title": "test2", "path": pdir + "/prefetch2.mp3"},
+			},
+		},
+		Prefetch: true,
+	}
+
+	pl := plf.Playlist("/prefetch", false).(*FilePlaylist)
+
+	if frame, err := pl.Frame(); err != nil || string(frame) != "12" {
+		t.Error("Unexpected result:", string(frame), err)
+		return
+	}
+
+	// Simulate the time it takes to play the first frame
+
+	time.Sleep(300 * time.Millisecond)
+
+	start := time.Now()
+
+	if frame, err := pl.Frame(); err != nil || string(frame) != "34" {
+		t.Error("Unexpected result:", string(frame), err)
+		return
+	}
+
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Error("Opening the next item should not stall:", d)
+		return
+	}
+
+	// The last item must not prefetch anything
+
+	if pl.prefetch != nil {
+		t.Error("Nothing should be prefetched after the last item")
+		return
+	}
+
+	if frame, err := pl.Frame(); err != dudeldu.ErrPlaylistEnd || frame != nil {
+		t.Error("Unexpected result:", string(frame), err)
+		return
+	}
+
+	// Closing the playlist cancels an ongoing prefetch
+
+	pl.Close()
+
+	if frame, err := pl.Frame(); err != nil || string(frame) != "12" {
+		t.Error("Unexpected result:", string(frame), err)
+		return
+	}
+
+	if pl.prefetch == nil {
+		t.Error("Next item should be prefetched")
+		return
+	}
+
+	pl.Close()
+
+	if pl.prefetch != nil || pl.stream != nil {
+		t.Error("Playlist should have been closed")
+		return
+	}
+
+	// Without prefetching the next item is opened synchronously
+
+	plf.Prefetch = false
+	pl = plf.Playlist("/prefetch", false).(*FilePlaylist)
+	defer pl.Close()
+
+	pl.Frame()
+
+	start = time.Now()
+
+	if frame, err := pl.Frame(); err != nil || string(frame) != "34" {
+		t.Error("Unexpected result:", string(frame), err)
+		return
+	}
+
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Error("Opening the next item should have taken longer:", d)
+		return
+	}
+}
+
+func TestJingle(t *testing.T) {
+
+	for i, data := range []string{"11", "22", "33", "JJ"} {
+		err := ioutil.WriteFile(fmt.Sprintf("%v/jingletest%v.mp3", pdir, i), []byte(data), 0644)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	oldFrameSize := FrameSize
+	FrameSize = 2
+	defer func() {
+		FrameSize = oldFrameSize
+	}()
+
+	plf := &FilePlaylistFactory{
+		data: map[string][]map[string]string{
+			"/jingle": {
+				{"artist": "artist1", "title": "test1", "path": pdir + "/jingletest0.mp3"},
+				{"artist": "artist2", "title": "test2", "path": pdir + "/jingletest1.mp3"},
+				{"artist": "artist3", "title": "test3", "path": pdir + "/jingletest2.mp3"},
+			},
+		},
+		Jingle:            map[string]string{"artist": "DudelDu", "title": "Station ID", "path": pdir + "/jingletest3.mp3"},
+		JingleEveryTracks: 1,
+	}
+
+	pl := plf.Playlist("/jingle", false)
+	defer pl.Close()
+
+	var played []string
+
+	for !pl.Finished() {
+		frame, err := pl.Frame()
+		if err != nil && err != dudeldu.ErrPlaylistEnd {
+			t.Error(err)
+			return
+		}
+		if frame != nil {
+			played = append(played, fmt.Sprintf("%v:%v - %v", string(frame), pl.Title(), pl.Artist()))
+		}
+	}
+
+	if res := strings.Join(played, ", "); res != "11:test1 - artist1, JJ:Station ID - DudelDu, "+
+		"22:test2 - artist2, JJ:Station ID - DudelDu, 33:test3 - artist3" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+}
+
+func TestPlaylistSize(t *testing.T) {
+
+	err := ioutil.WriteFile(pdir+"/size1.mp3", []byte("123"), 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = ioutil.WriteFile(pdir+"/size2.mp3", []byte("4567"), 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	plf := &FilePlaylistFactory{
+		data: map[string][]map[string]string{
+			"/local": {
+				{"artist": "artist1", "title": "test1", "path": pdir + "/size1.mp3"},
+				{"artist": "artist2", "title": "test2", "path": pdir + "/size2.mp3"},
+			},
+			"/url": {
+				{"artist": "artist1", "title": "test1", "path": pdir + "/size1.mp3"},
+				{"artist": "artist2", "title": "test2", "path": "http://localhost/song.mp3"},
+			},
+			"/missing": {
+				{"artist": "artist1", "title": "test1", "path": pdir + "/sizemissing.mp3"},
+			},
+		},
+	}
+
+	if size := plf.Playlist("/local", false).(dudeldu.SizedPlaylist).Size(); size != 7 {
+		t.Error("Unexpected size:", size)
+		return
+	}
+
+	if size := plf.Playlist("/url", false).(dudeldu.SizedPlaylist).Size(); size != -1 {
+		t.Error("Unexpected size:", size)
+		return
+	}
+
+	if size := plf.Playlist("/missing", false).(dudeldu.SizedPlaylist).Size(); size != -1 {
+		t.Error("Unexpected size:", size)
+		return
+	}
+}
+
+func TestReshuffleOnLoop(t *testing.T) {
+
+	plf := &FilePlaylistFactory{
+		data: map[string][]map[string]string{
+			"/shuffle": {
+				{"artist": "artist1", "title": "test1", "path": "1.mp3"},
+				{"artist": "artist2", "title": "test2", "path": "2.mp3"},
+				{"artist": "artist3", "title": "test3", "path": "3.mp3"},
+				{"artist": "artist4", "title": "test4", "path": "4.mp3"},
+			},
+			"/empty": {},
+			"/single": {
+				{"artist": "artist1", "title": "test1", "path": "1.mp3"},
+			},
+		},
+	}
+
+	order := func(pl *FilePlaylist) string {
+		var res []string
+		for _, item := range pl.data {
+			res = append(res, item["path"])
+		}
+		return strings.Join(res, " ")
+	}
+
+	// Without the option the order stays the same
+
+	pl := plf.Playlist("/shuffle", true).(*FilePlaylist)
+	first := order(pl)
+	pl.Reset()
+
+	if o := order(pl); o != first {
+		t.Error("Order should not have changed:", first, o)
+		return
+	}
+
+	// Unshuffled playlists are never reshuffled
+
+	plf.ReshuffleOnLoop = true
+
+	pl = plf.Playlist("/shuffle", false).(*FilePlaylist)
+	pl.Reset()
+
+	if o := order(pl); o != "1.mp3 2.mp3 3.mp3 4.mp3" {
+		t.Error("Unexpected order:", o)
+		return
+	}
+
+	pl = plf.Playlist("/shuffle", true).(*FilePlaylist)
+
+	orders := map[string]bool{order(pl): true}
+
+	for i := 0; i < 50; i++ {
+		last := pl.data[len(pl.data)-1]["path"]
+
+		pl.Reset()
+
+		if len(pl.data) != 4 {
+			t.Error("Unexpected playlist length:", order(pl))
+			return
+		}
+
+		if pl.data[0]["path"] == last {
+			t.Error("Last item should not be played again:", last, order(pl))
+			return
+		}
+
+		orders[order(pl)] = true
+	}
+
+	if len(orders) < 2 {
+		t.Error("Order should change when looping:", orders)
+		return
+	}
+
+	// Empty and single item playlists can be reset
+
+	if pl = plf.Playlist("/empty", true).(*FilePlaylist); pl.Reset() != nil || len(pl.data) != 0 {
+		t.Error("Unexpected order:", order(pl))
+		return
+	}
+
+	if pl = plf.Playlist("/single", true).(*FilePlaylist); pl.Reset() != nil || order(pl) != "1.mp3" {
+		t.Error("Unexpected order:", order(pl))
+		return
+	}
+}
+
+func TestShuffleSeed(t *testing.T) {
+	var items []map[string]string
+
+	for i := 0; i < 20; i++ {
+		items = append(items, map[string]string{"path": fmt.Sprintf("%v.mp3", i)})
+	}
+
+	plf := &FilePlaylistFactory{
+		data: map[string][]map[string]string{
+			"/shuffle": items,
+		},
+		ShuffleSeed: 42,
+	}
+
+	order := func() string {
+		var res []string
+		for _, item := range plf.Playlist("/shuffle", true).(*FilePlaylist).data {
+			res = append(res, item["path"])
+		}
+		return strings.Join(res, " ")
+	}
+
+	// The same seed gives the same order
+
+	first := order()
+
+	for i := 0; i < 10; i++ {
+		if o := order(); o != first {
+			t.Error("Order should be reproducible:", first, o)
+			return
+		}
+	}
+
+	plf.ShuffleSeed = 43
+
+	if o := order(); o == first {
+		t.Error("Order should depend on the seed:", o)
+		return
+	}
+
+	// Random seeds do not collide if playlists are requested at the same time
+
+	plf.ShuffleSeed = 0
+
+	seen := make(map[int64]bool)
+
+	for i := 0; i < 100; i++ {
+		v := plf.newRandom().Int63()
+
+		if seen[v] {
+			t.Error("Random sources should be independent")
+			return
+		}
+
+		seen[v] = true
+	}
+}
+
+func TestSkip(t *testing.T) {
+
+	for i, data := range []string{"11", "22", "33"} {
+		err := ioutil.WriteFile(fmt.Sprintf("%v/skiptest%v.mp3", pdir, i), []byte(data), 0644)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	oldFrameSize := FrameSize
+	FrameSize = 1
+	defer func() {
+		FrameSize = oldFrameSize
+	}()
+
+	plf := &FilePlaylistFactory{
+		data: map[string][]map[string]string{
+			"/skip": {
+				{"artist": "artist1", "title": "test1", "path": pdir + "/skiptest0.mp3"},
+				{"artist": "artist2", "title": "test2", "path": pdir + "/skiptest1.mp3"},
+				{"artist": "artist3", "title": "test3", "path": pdir + "/skiptest2.mp3"},
+			},
+		},
+	}
+
+	pl := plf.Playlist("/skip", false).(*FilePlaylist)
+	defer pl.Close()
+
+	// Skip before anything was played
+
+	if err := pl.Skip(); err != nil || pl.Title() != "test2" {
+		t.Error("Unexpected result:", pl.Title(), err)
+		return
+	}
+
+	if frame, err := pl.Frame(); err != nil || string(frame) != "2" {
+		t.Error("Unexpected result:", string(frame), err)
+		return
+	}
+
+	// Skip in the middle of a track
+
+	if err := pl.Skip(); err != nil || pl.Title() != "test3" {
+		t.Error("Unexpected result:", pl.Title(), err)
+		return
+	}
+
+	if frame, err := pl.Frame(); err != nil || string(frame) != "3" {
+		t.Error("Unexpected result:", string(frame), err)
+		return
+	}
+
+	// Skipping the last track finishes the playlist
+
+	if err := pl.Skip(); err != dudeldu.ErrPlaylistEnd || !pl.Finished() {
+		t.Error("Unexpected result:", pl.Finished(), err)
+		return
+	}
+
+	if err := pl.Skip(); err != dudeldu.ErrPlaylistEnd {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
+
+func TestReset(t *testing.T) {
+
+	for i, data := range []string{"11", "22"} {
+		err := ioutil.WriteFile(fmt.Sprintf("%v/resettest%v.mp3", pdir, i), []byte(data), 0644)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	oldFrameSize := FrameSize
+	FrameSize = 1
+	defer func() {
+		FrameSize = oldFrameSize
+	}()
+
+	plf := &FilePlaylistFactory{
+		data: map[string][]map[string]string{
+			"/reset": {
+				{"artist": "artist1", "title": "test1", "path": pdir + "/resettest0.mp3"},
+				{"artist": "artist2", "title": "test2", "path": pdir + "/resettest1.mp3"},
+			},
+		},
+	}
+
+	pl := plf.Playlist("/reset", false).(*FilePlaylist)
+
+	play := func() string {
+		var res []string
+		for !pl.Finished() {
+			frame, err := pl.Frame()
+			if err != nil && err != dudeldu.ErrPlaylistEnd {
+				t.Error(err)
+				return ""
+			}
+			res = append(res, string(frame))
+		}
+		return strings.Join(res, "")
+	}
+
+	if res := play(); res != "1122" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// The playlist plays again after it was reset
+
+	if err := pl.Reset(); err != nil || pl.Finished() {
+		t.Error("Unexpected result:", pl.Finished(), err)
+		return
+	}
+
+	if res := play(); res != "1122" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Closing the playlist releases the open file
+
+	pl.Reset()
+
+	if frame, err := pl.Frame(); err != nil || string(frame) != "1" || pl.stream == nil {
+		t.Error("Unexpected result:", string(frame), err)
+		return
+	}
+
+	if err := pl.Close(); err != nil || pl.stream != nil {
+		t.Error("Unexpected result:", pl.stream, err)
+		return
+	}
+}
+
+func TestMissingItems(t *testing.T) {
+
+	for i, data := range []string{"11", "22"} {
+		err := ioutil.WriteFile(fmt.Sprintf("%v/missingtest%v.mp3", pdir, i), []byte(data), 0644)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	oldFrameSize := FrameSize
+	FrameSize = 2
+	defer func() {
+		FrameSize = oldFrameSize
+	}()
+
+	plf := &FilePlaylistFactory{
+		data: map[string][]map[string]string{
+			"/missing": {
+				{"title": "test1", "path": pdir + "/missingtest0.mp3"},
+				{"title": "test2", "path": pdir + "/nonexist1.mp3"},
+				{"title": "test3", "path": pdir + "/nonexist2.mp3"},
+				{"title": "test4", "path": pdir + "/missingtest1.mp3"},
+				{"title": "test5", "path": pdir + "/nonexist3.mp3"},
+			},
+		},
+	}
+
+	for _, prefetch := range []bool{false, true} {
+		var res []string
+
+		plf.Prefetch = prefetch
+		pl := plf.Playlist("/missing", false)
+
+		for i := 0; i < 10 && !pl.Finished(); i++ {
+			frame, err := pl.Frame()
+
+			if err != nil && err != dudeldu.ErrPlaylistEnd {
+				err = fmt.Errorf("error")
+			}
+
+			res = append(res, fmt.Sprintf("%v:%s:%v", pl.Title(), frame, err))
+		}
+
+		pl.Close()
+
+		// Every missing item produces exactly one error
+
+		if r := strings.Join(res, " "); r != "test1:11:<nil> test2::error test3::error "+
+			"test4:22:<nil> test5::error test5::End of playlist" {
+			t.Error("Unexpected result:", r)
+			return
+		}
+	}
+
+	// Skipping after an error skips the next playable item
+
+	pl := plf.Playlist("/missing", false)
+	defer pl.Close()
+
+	pl.Frame()
+
+	if _, err := pl.Frame(); err == nil {
+		t.Error("Error expected")
+		return
+	}
+
+	if err := pl.(*FilePlaylist).Skip(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if frame, err := pl.Frame(); string(frame) != "22" || err != nil || pl.Title() != "test4" {
+		t.Error("Unexpected result:", string(frame), err)
+		return
+	}
+}
+
+func TestContentTypeOverride(t *testing.T) {
+
+	err := ioutil.WriteFile(pdir+"/override.bin", []byte("123"), 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	plf := &FilePlaylistFactory{
+		data: map[string][]map[string]string{
+			"/override": {
+				{"artist": "artist1", "title": "test1", "path": pdir + "/override.bin", "contenttype": "audio/mpeg"},
+				{"artist": "artist2", "title": "test2", "path": pdir + "/override.bin"},
+			},
+		},
+	}
+
+	drh := dudeldu.NewDefaultRequestHandler(plf, false, false, "")
+	testConn := &testutil.ErrorTestingConnection{}
+
+	drh.ServeRequest(testConn, &dudeldu.RequestInfo{Path: "/override"})
+
+	if !strings.HasPrefix(testConn.Out.String(), "ICY 200 OK\r\n"+
+		"Content-Type: audio/mpeg\r\n") {
+		t.Error("Unexpected response:", testConn.Out.String())
+		return
+	}
+
+	// The override only applies to the item which defines it
+
+	pl := plf.Playlist("/override", false).(*FilePlaylist)
+	pl.current = 1
+
+	if ctype := pl.ContentType(); ctype != "application/octet-stream" {
+		t.Error("Unexpected content type:", ctype)
+		return
+	}
+
+	// The fallback for unknown extensions can be configured
+
+	plf.FallbackType = "audio"
+
+	if ctype := pl.ContentType(); ctype != "audio" {
+		t.Error("Unexpected content type:", ctype)
+		return
+	}
+}
+
+func TestContentTypeExtensions(t *testing.T) {
+
+	plf := &FilePlaylistFactory{
+		data: map[string][]map[string]string{
+			"/ext": {
+				{"artist": "artist1", "title": "test1", "path": "track.m4a"},
+				{"artist": "artist2", "title": "test2", "path": "book.m4b"},
+				{"artist": "artist3", "title": "test3", "path": "track.fla"},
+				{"artist": "artist4", "title": "test4", "path": "track.wave"},
+			},
+		},
+	}
+
+	pl := plf.Playlist("/ext", false).(*FilePlaylist)
+
+	for i, expected := range []string{"audio/mp4", "audio/mp4", "audio/flac", "audio/wav"} {
+
+		pl.current = i
+
+		if ctype := pl.ContentType(); ctype != expected {
+			t.Error("Unexpected content type:", i, ctype, "expected:", expected)
+			return
+		}
+	}
+}
+
+func TestSniffContentType(t *testing.T) {
+
+	ioutil.WriteFile(pdir+"/sniffmp3", []byte("ID3\x03\x00\x00\x00\x00\x00\x00123"), 0644)
+	ioutil.WriteFile(pdir+"/sniffframe", []byte("\xff\xfb\x90\x00123"), 0644)
+	ioutil.WriteFile(pdir+"/sniffogg", []byte("OggS\x00\x02123"), 0644)
+	ioutil.WriteFile(pdir+"/sniffunknown", []byte("\x00\x01\x02\x03"), 0644)
+
+	plf := &FilePlaylistFactory{
+		data: map[string][]map[string]string{
+			"/sniff": {
+				{"artist": "artist1", "title": "test1", "path": pdir + "/sniffmp3"},
+				{"artist": "artist2", "title": "test2", "path": pdir + "/sniffframe"},
+				{"artist": "artist3", "title": "test3", "path": pdir + "/sniffogg"},
+				{"artist": "artist4", "title": "test4", "path": pdir + "/sniffunknown"},
+				{"artist": "artist5", "title": "test5", "path": "http://localhost/sniff"},
+			},
+		},
+	}
+
+	pl := plf.Playlist("/sniff", false).(*FilePlaylist)
+
+	// Content types are only detected if requested
+
+	if ctype := pl.ContentType(); ctype != "application/octet-stream" {
+		t.Error("Unexpected content type:", ctype)
+		return
+	}
+
+	plf.SniffContentType = true
+
+	for i, expected := range []string{"audio/mpeg", "audio/mpeg", "audio/ogg",
+		"application/octet-stream", "application/octet-stream"} {
+
+		pl.current = i
+
+		if ctype := pl.ContentType(); ctype != expected {
+			t.Error("Unexpected content type:", i, ctype, "expected:", expected)
+			return
+		}
+	}
+
+	// Detected content types are cached
+
+	os.Remove(pdir + "/sniffmp3")
+
+	pl.current = 0
+
+	if ctype := pl.ContentType(); ctype != "audio/mpeg" {
+		t.Error("Unexpected content type:", ctype)
+		return
+	}
+
+	// Files are read without blocking the cache of the factory
+
+	ioutil.WriteFile(pdir+"/sniffmp3", []byte("ID3\x03\x00\x00\x00\x00\x00\x00123"), 0644)
+
+	oldOpenFile := openFile
+	defer func() {
+		openFile = oldOpenFile
+	}()
+
+	unlocked := false
+	openFile = func(name string) (io.ReadCloser, error) {
+		locked := make(chan struct{})
+
+		go func() {
+			plf.detectedTypesLock.Lock()
+			plf.detectedTypesLock.Unlock()
+			close(locked)
+		}()
+
+		select {
+		case <-locked:
+			unlocked = true
+		case <-time.After(time.Second):
+		}
+
+		return os.Open(name)
+	}
+
+	plf.detectedTypes = nil
+
+	if ctype := pl.ContentType(); ctype != "audio/mpeg" || !unlocked {
+		t.Error("Unexpected content type:", ctype, unlocked)
+		return
+	}
+}
+
+func TestFilePlaylistFactoryStdin(t *testing.T) {
+
+	oldStdin := stdin
+	defer func() {
+		stdin = oldStdin
+	}()
+
+	stdin = strings.NewReader(`
+/*
+ * Playlist from a pipe
+ */
+{
+	"/stdin" : [
+		{
+			"artist" : "artist1",  // Comments are allowed
+			"title"  : "test1",
+			"path"   : "playlisttest/test1.mp3"
+		}
+	]
+}`)
+
+	plf, err := NewFilePlaylistFactory("-", "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	pl := plf.Playlist("/stdin", false)
+
+	if pl == nil || pl.Artist() != "artist1" || pl.Title() != "test1" {
+		t.Error("Unexpected playlist:", pl)
+		return
+	}
+
+	stdin = strings.NewReader("{")
+
+	if _, err = NewFilePlaylistFactory("-", ""); err == nil {
+		t.Error("Invalid input should return an error")
+		return
+	}
+}
+
+func TestSingleTrack(t *testing.T) {
+
+	for i, data := range []string{"11", "22", "33"} {
+		err := ioutil.WriteFile(fmt.Sprintf("%v/singletest%v.mp3", pdir, i), []byte(data), 0644)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	oldFrameSize := FrameSize
+	FrameSize = 1
+	defer func() {
+		FrameSize = oldFrameSize
+	}()
+
+	plf := &FilePlaylistFactory{
+		data: map[string][]map[string]string{
+			"/single": {
+				{"artist": "artist1", "title": "test1", "path": pdir + "/singletest0.mp3"},
+				{"artist": "artist2", "title": "test2", "path": pdir + "/singletest1.mp3"},
+				{"artist": "artist3", "title": "test3", "path": pdir + "/singletest2.mp3"},
+			},
+		},
+	}
+
+	if pl := plf.Playlist("/nonexist"+SingleTrackSuffix, false); pl != nil {
+		t.Error("Unexpected result:", pl)
+		return
+	}
+
+	pl := plf.Playlist("/single"+SingleTrackSuffix, false)
+	defer pl.Close()
+
+	if pl.Name() != "/single" {
+		t.Error("Unexpected name:", pl.Name())
+		return
+	}
+
+	title := pl.Title()
+
+	var played string
+
+	for !pl.Finished() {
+		frame, err := pl.Frame()
+		if err != nil && err != dudeldu.ErrPlaylistEnd {
+			t.Error(err)
+			return
+		}
+
+		played += string(frame)
+
+		if !pl.Finished() && pl.Title() != title {
+			t.Error("Unexpected track change:", title, pl.Title())
+			return
+		}
+	}
+
+	if expected := strings.Repeat(title[len(title)-1:], 2); played != expected {
+		t.Error("Unexpected played data:", played, "expected:", expected)
+		return
+	}
+}
+
+func TestPlaylistFrameSize(t *testing.T) {
+
+	err := ioutil.WriteFile(pdir+"/framesizetest.mp3", []byte("1234567"), 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ioutil.WriteFile(pdir+"/framesizetest.json", []byte(`{
+	"/default" : [
+		{ "artist" : "artist1", "title" : "test1", "path" : "`+pdir+`/framesizetest.mp3" }
+	],
+	"/small" : {
+		"framesize" : 2,
+		"items" : [
+			{ "artist" : "artist1", "title" : "test1", "path" : "`+pdir+`/framesizetest.mp3" }
+		]
+	}
+}`), 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	oldFrameSize := FrameSize
+	FrameSize = 3
+	defer func() {
+		FrameSize = oldFrameSize
+	}()
+
+	plf, err := NewFilePlaylistFactory(pdir+"/framesizetest.json", "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	readFrames := func(path string) []string {
+		var frames []string
+
+		pl := plf.Playlist(path, false)
+		defer pl.Close()
+
+		for !pl.Finished() {
+			frame, _ := pl.Frame()
+			if frame != nil {
+				frames = append(frames, string(frame))
+			}
+			pl.ReleaseFrame(frame)
+		}
+
+		return frames
+	}
+
+	if res := fmt.Sprint(readFrames("/default")); res != "[123 456 7]" {
+		t.Error("Unexpected frames:", res)
+		return
+	}
+
+	if res := fmt.Sprint(readFrames("/small")); res != "[12 34 56 7]" {
+		t.Error("Unexpected frames:", res)
+		return
+	}
+
+	// Released frames are reused according to the playlist frame size
+
+	pl := plf.Playlist("/small", false).(*FilePlaylist)
+	defer pl.Close()
+
+	pl.ReleaseFrame(make([]byte, 2))
+	pl.ReleaseFrame(make([]byte, 3))
+
+	if frame := pl.framePool.Get().([]byte); len(frame) != 2 {
+		t.Error("Unexpected frame:", frame)
+		return
+	}
+
+	// Invalid definitions are reported
+
+	err = ioutil.WriteFile(pdir+"/framesizetest.json", []byte(`{ "/invalid" : "foo" }`), 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err = NewFilePlaylistFactory(pdir+"/framesizetest.json", ""); err == nil ||
+		!strings.HasPrefix(err.Error(), "Invalid playlist definition for /invalid") {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
+
+func TestValidate(t *testing.T) {
+
+	err := ioutil.WriteFile(pdir+"/validatetest.mp3", []byte("123"), 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ioutil.WriteFile(pdir+"/validatetest.json", []byte(`{
+	"/test" : [
+		{ "artist" : "artist1", "title" : "test1", "path" : "`+pdir+`/validatetest.mp3" },
+		{ "artist" : "artist2", "title" : "test2", "path" : "`+pdir+`/validatetest_missing.mp3" },
+		{ "artist" : "artist3", "title" : "test3", "path" : "http://localhost:9092/test.mp3" }
+	],
+	"/test2" : [
+		{ "artist" : "artist1", "title" : "test1", "path" : "`+pdir+`/validatetest.mp3" }
+	],
+	"/test2" : [
+		{ "artist" : "artist1", "title" : "test1", "path" : "`+pdir+`/validatetest.mp3" }
+	]
+}`), 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	plf, err := NewFilePlaylistFactory(pdir+"/validatetest.json", "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = plf.Validate()
+
+	if err == nil || err.Error() != "Web path /test2 is defined more than once; "+
+		"Item "+pdir+"/validatetest_missing.mp3 of /test cannot be read: "+
+		"open "+pdir+"/validatetest_missing.mp3: no such file or directory" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	// The playlist can still be used
+
+	if pl := plf.Playlist("/test", false); pl == nil || pl.Title() != "test1" {
+		t.Error("Unexpected playlist:", pl)
+		return
+	}
+
+	// A valid definition has no problems
+
+	plf = &FilePlaylistFactory{
+		data: map[string][]map[string]string{
+			"/test": {
+				{"artist": "artist1", "title": "test1", "path": pdir + "/validatetest.mp3"},
+			},
+		},
+	}
+
+	if err := plf.Validate(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Missing files with an absolute path are reported
+
+	absPath, err := filepath.Abs(pdir + "/validatetest_missing.mp3")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	plf = &FilePlaylistFactory{
+		data: map[string][]map[string]string{
+			"/test": {
+				{"artist": "artist1", "title": "test1", "path": absPath},
+			},
+		},
+	}
+
+	if err := plf.Validate(); err == nil || err.Error() != "Item "+absPath+" of /test cannot be read: "+
+		"open "+absPath+": no such file or directory" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
+
+func TestWavPlaylist(t *testing.T) {
+
+	wavFile := func(data string) []byte {
+		var buf bytes.Buffer
+
+		buf.WriteString("RIFF")
+		binary.Write(&buf, binary.LittleEndian, uint32(36+len(data)))
+		buf.WriteString("WAVEfmt ")
+		binary.Write(&buf, binary.LittleEndian, uint32(16))
+		buf.Write(make([]byte, 16))
+		buf.WriteString("data")
+		binary.Write(&buf, binary.LittleEndian, uint32(len(data)))
+		buf.WriteString(data)
+
+		return buf.Bytes()
+	}
+
+	ioutil.WriteFile(pdir+"/wavtest1.wav", wavFile("1234"), 0644)
+	ioutil.WriteFile(pdir+"/wavtest2.wav", wavFile("5678"), 0644)
+	ioutil.WriteFile(pdir+"/wavtest3.wav", []byte("invalid header data"), 0644)
+
+	oldFrameSize := FrameSize
+	FrameSize = 100
+	defer func() {
+		FrameSize = oldFrameSize
+	}()
+
+	plf := &FilePlaylistFactory{
+		data: map[string][]map[string]string{
+			"/wav": {
+				{"artist": "artist1", "title": "test1", "path": pdir + "/wavtest1.wav"},
+				{"artist": "artist2", "title": "test2", "path": pdir + "/wavtest2.wav"},
+			},
+			"/invalidwav": {
+				{"artist": "artist1", "title": "test1", "path": pdir + "/wavtest1.wav"},
+				{"artist": "artist3", "title": "test3", "path": pdir + "/wavtest3.wav"},
+			},
+		},
+	}
+
+	pl := plf.Playlist("/wav", false)
+
+	if pl.ContentType() != "audio/wav" {
+		t.Error("Unexpected content type:", pl.ContentType())
+		return
+	}
+
+	// Only the first header is send
+
+	frame, err := pl.Frame()
+
+	if err != dudeldu.ErrPlaylistEnd || string(frame) != string(wavFile("1234"))+"5678" {
+		t.Error("Unexpected frame:", frame, err)
+		return
+	}
+
+	// No header is send if the playlist is looped
+
+	pl.Close()
+
+	frame, err = pl.Frame()
+
+	if err != dudeldu.ErrPlaylistEnd || string(frame) != "12345678" {
+		t.Error("Unexpected frame:", frame, err)
+		return
+	}
+
+	// Items with invalid headers are skipped
+
+	pl = plf.Playlist("/invalidwav", false)
+	defer pl.Close()
+
+	frame, err = pl.Frame()
+
+	if err == nil || err.Error() != "Invalid WAV header" || string(frame) != string(wavFile("1234")) {
+		t.Error("Unexpected frame:", frame, err)
+		return
+	}
+}
+
+func TestTrackInfo(t *testing.T) {
+
+	plf := &FilePlaylistFactory{
+		data: map[string][]map[string]string{
+			"/info": {
+				{"artist": "artist1", "title": "test1", "path": "test1.mp3", "genre": "Rock", "album": "album1", "cover": "cover1.png"},
+				{"artist": "artist2", "title": "test2", "path": "test2.mp3"},
+			},
+		},
+	}
+
+	pl := plf.Playlist("/info", false).(*FilePlaylist)
+
+	// The factory knows the cover of the first item
+
+	if res := plf.Cover("/info"); res != "cover1.png" {
+		t.Error("Unexpected cover:", res)
+		return
+	}
+
+	if res := plf.Cover("/foo"); res != "" {
+		t.Error("Unexpected cover:", res)
+		return
+	}
+
+	var _ dudeldu.TrackInfoPlaylist = pl
+	var _ dudeldu.AlbumPlaylist = pl
+	var _ dudeldu.CoverPlaylist = pl
+
+	if pl.Cover() != "cover1.png" {
+		t.Error("Unexpected cover:", pl.Cover())
+		return
+	}
+
+	pl.pathPrefix = "covers/"
+
+	if pl.Cover() != "covers/cover1.png" {
+		t.Error("Unexpected cover:", pl.Cover())
+		return
+	}
+
+	if pl.Genre() != "Rock" || pl.Position() != 0 || pl.Album() != "album1" {
+		t.Error("Unexpected track info:", pl.Genre(), pl.Position(), pl.Album())
+		return
+	}
+
+	pl.current++
+
+	if pl.Genre() != "" || pl.Position() != 1 || pl.Cover() != "" {
+		t.Error("Unexpected track info:", pl.Genre(), pl.Position())
+		return
+	}
+}
+
+func TestPathTraversal(t *testing.T) {
+
+	for _, test := range []struct {
+		prefix, path, result string
+	}{
+		{"", "../test.mp3", "../test.mp3"},
+		{"media/", "test.mp3", "media/test.mp3"},
+		{"media/", "sub/../test.mp3", "media/sub/../test.mp3"},
+		{"media/", "../test.mp3", ""},
+		{"media/", "../media2/test.mp3", ""},
+		{"media/", "sub/../../test.mp3", ""},
+		{"/media/", "../../etc/passwd", ""},
+		{"/", "etc/passwd", "/etc/passwd"},
+		{"media/x_", "test.mp3", "media/x_test.mp3"},
+		{"media/x_", "/../../test.mp3", ""},
+		{"media/", "http://localhost:9092/../test.mp3", "media/http://localhost:9092/../test.mp3"},
+		{"http://localhost:9092/", "../test.mp3", "http://localhost:9092/../test.mp3"},
+	} {
+		res, err := resolveItemPath(test.prefix, test.path)
+
+		if res != test.result || (err == nil) != (test.result != "") {
+			t.Error("Unexpected result for", test.prefix, test.path, ":", res, err)
+			return
+		}
+	}
+
+	// Items outside of the prefix are refused
+
+	err := ioutil.WriteFile(pdir+"/traversaltest.mp3", []byte("123"), 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	oldFrameSize := FrameSize
+	FrameSize = 3
+	defer func() {
+		FrameSize = oldFrameSize
+	}()
+
+	plf := newFilePlaylistFactory(map[string][]map[string]string{
+		"/traversal": {
+			{"artist": "artist1", "title": "test1", "path": "../traversaltest.mp3"},
+			{"artist": "artist2", "title": "test2", "path": "traversaltest.mp3"},
+		},
+	}, pdir+"/")
+
+	pl := plf.Playlist("/traversal", false)
+	defer pl.Close()
+
+	if frame, err := pl.Frame(); err == nil || err.Error() != "Item path ../traversaltest.mp3 is outside of "+pdir+"/" || frame != nil {
+		t.Error("Unexpected result:", string(frame), err)
+		return
+	}
+
+	if frame, err := pl.Frame(); err != nil || string(frame) != "123" {
+		t.Error("Unexpected result:", string(frame), err)
+		return
+	}
+
+	if err := plf.Validate(); err == nil || !strings.Contains(err.Error(), "is outside of") {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
+
+/*
+testPatternReader produces a deterministic byte pattern of a given length
+*/
+type testPatternReader struct {
+	pos    int
+	length int
+}
+
+func (r *testPatternReader) Read(p []byte) (int, error) {
+	if r.pos >= r.length {
+		return 0, io.EOF
+	}
+
+	// Produce small chunks so the ring wraps at different positions
+
+	n := len(p)
+	if n > 777 {
+		n = 777
+	}
+	if n > r.length-r.pos {
+		n = r.length - r.pos
+	}
+
+	for i := 0; i < n; i++ {
+		p[i] = byte((r.pos + i) % 251)
+	}
+
+	r.pos += n
+
+	return n, nil
+}
+
+func TestStreamBuffer(t *testing.T) {
+	const length = 10 * 1024 * 1024
+
+	var before, after runtime.MemStats
+
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	buf := &StreamBuffer{Capacity: 4096}
+	buf.ReadFrom(&testPatternReader{length: length})
+
+	p := make([]byte, 1000)
+	pos := 0
+
+	for {
+		n, err := buf.Read(p)
+
+		for i := 0; i < n; i++ {
+			if p[i] != byte((pos+i)%251) {
+				t.Error("Unexpected data at position:", pos+i)
+				return
+			}
+		}
+
+		pos += n
+
+		// Only the last read may return less data than requested
+
+		if err == nil && n != len(p) {
+			t.Error("Unexpected read length:", n, pos)
+			return
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	runtime.ReadMemStats(&after)
+
+	if pos != length {
+		t.Error("Unexpected number of read bytes:", pos)
+		return
+	}
+
+	// The buffer must not grow with the amount of streamed data
+
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1024*1024 {
+		t.Error("Unexpected allocations:", alloc)
+		return
+	}
+
+	if n, err := buf.Read(p); n != 0 || err != io.EOF {
+		t.Error("Unexpected result:", n, err)
+		return
+	}
+
+	// Closing the buffer stops the source stream and waiting reads
+
+	buf = &StreamBuffer{Capacity: 10}
+	buf.ReadFrom(&testPatternReader{length: length})
+
+	if n, err := buf.Read(p[:5]); n != 5 || err != nil {
+		t.Error("Unexpected result:", n, err)
+		return
+	}
+
+	buf.Close()
+
+	for {
+		if _, err := buf.Read(p); err == io.EOF {
+			break
+		}
+	}
+}
+
+func TestMaxStreamBufferBytes(t *testing.T) {
+	const length = 100 * 1024
+
+	MaxStreamBufferBytes = 1000
+	defer func() {
+		MaxStreamBufferBytes = 0
+	}()
+
+	bufs := []*StreamBuffer{{Capacity: 4096}, {Capacity: 4096}}
+
+	for _, buf := range bufs {
+		buf.ReadFrom(&testPatternReader{length: length})
+	}
+
+	buffered := func() int {
+		var res int
+		for _, buf := range bufs {
+			buf.lock.Lock()
+			res += buf.size
+			buf.lock.Unlock()
+		}
+		return res
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if b := buffered(); b != 1000 {
+		t.Error("Unexpected number of buffered bytes:", b)
+		return
+	}
+
+	// Reading the buffers releases the budget - the combined buffered
+	// bytes must stay within the budget
+
+	p := make([]byte, 300)
+	pos := []int{0, 0}
+
+	for pos[0] < length || pos[1] < length {
+		for i, buf := range bufs {
+			n, err := buf.Read(p)
+
+			for j := 0; j < n; j++ {
+				if p[j] != byte((pos[i]+j)%251) {
+					t.Error("Unexpected data at position:", pos[i]+j)
+					return
+				}
+			}
+
+			pos[i] += n
+
+			if err != nil && err != io.EOF {
+				t.Error(err)
+				return
+			}
+
+			if b := buffered(); b > 1000 {
+				t.Error("Unexpected number of buffered bytes:", b)
+				return
+			}
+		}
+	}
+
+	if pos[0] != length || pos[1] != length {
+		t.Error("Unexpected number of read bytes:", pos)
+		return
+	}
+
+	// Closing a buffer returns its bytes to the budget
+
+	buf := &StreamBuffer{Capacity: 4096}
+	buf.ReadFrom(&testPatternReader{length: length})
+
+	time.Sleep(100 * time.Millisecond)
+
+	buf.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	streamBufferBudget.lock.Lock()
+	used := streamBufferBudget.used
+	streamBufferBudget.lock.Unlock()
+
+	if used != 0 {
+		t.Error("Unexpected used budget:", used)
+		return
+	}
+}
+
+func TestTrimmedItems(t *testing.T) {
+
+	ioutil.WriteFile(pdir+"/trimtest.mp3", []byte("0123456789"), 0644)
+
+	oldFrameSize := FrameSize
+	FrameSize = 100
+	defer func() {
+		FrameSize = oldFrameSize
+	}()
+
+	plf := &FilePlaylistFactory{
+		data: map[string][]map[string]string{
+			"/trim": {
+				{"artist": "artist1", "title": "test1", "path": pdir + "/trimtest.mp3", "start": "3", "end": "7"},
+				{"artist": "artist2", "title": "test2", "path": pdir + "/trimtest.mp3", "start": "8"},
+				{"artist": "artist3", "title": "test3", "path": pdir + "/trimtest.mp3", "end": "2"},
+			},
+			"/invalidtrim": {
+				{"artist": "artist1", "title": "test1", "path": pdir + "/trimtest.mp3", "start": "5", "end": "4"},
+			},
+		},
+	}
+
+	pl := plf.Playlist("/trim", false)
+	defer pl.Close()
+
+	if size := pl.(dudeldu.SizedPlaylist).Size(); size != 8 {
+		t.Error("Unexpected size:", size)
+		return
+	}
+
+	// Only the segments of the items are served
+
+	frame, err := pl.Frame()
+
+	if err != dudeldu.ErrPlaylistEnd || string(frame) != "34568901" {
+		t.Error("Unexpected frame:", string(frame), err)
+		return
+	}
+
+	pl = plf.Playlist("/invalidtrim", false)
+	defer pl.Close()
+
+	if size := pl.(dudeldu.SizedPlaylist).Size(); size != -1 {
+		t.Error("Unexpected size:", size)
+		return
+	}
+
+	if frame, err := pl.Frame(); frame != nil || err == nil ||
+		err.Error() != "Invalid end offset 4 for "+pdir+"/trimtest.mp3" {
+
+		t.Error("Unexpected frame:", string(frame), err)
+		return
+	}
+}
+
+func TestSeekTo(t *testing.T) {
+
+	ioutil.WriteFile(pdir+"/seektest1.mp3", []byte("0123456789"), 0644)
+	ioutil.WriteFile(pdir+"/seektest2.mp3", []byte("abcdef"), 0644)
+
+	oldFrameSize := FrameSize
+	FrameSize = 100
+	defer func() {
+		FrameSize = oldFrameSize
+	}()
+
+	plf := &FilePlaylistFactory{
+		data: map[string][]map[string]string{
+			"/seek": {
+				{"artist": "artist1", "title": "test1", "path": pdir + "/seektest1.mp3"},
+				{"artist": "artist2", "title": "test2", "path": pdir + "/seektest2.mp3", "start": "1"},
+			},
+		},
+	}
+
+	pl := plf.Playlist("/seek", false).(*FilePlaylist)
+	defer pl.Close()
+
+	var _ dudeldu.SeekablePlaylist = pl
+
+	if err := pl.SeekTo(3); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if frame, err := pl.Frame(); err != dudeldu.ErrPlaylistEnd || string(frame) != "3456789bcdef" {
+		t.Error("Unexpected frame:", string(frame), err)
+		return
+	}
+
+	// Seek into the trimmed second item
+
+	if err := pl.SeekTo(12); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if pl.Position() != 1 || pl.Title() != "test2" {
+		t.Error("Unexpected position:", pl.Position(), pl.Title())
+		return
+	}
+
+	if frame, err := pl.Frame(); err != dudeldu.ErrPlaylistEnd || string(frame) != "def" {
+		t.Error("Unexpected frame:", string(frame), err)
+		return
+	}
+
+	// The playlist is unchanged if the offset cannot be reached
+
+	pl.Close()
+
+	if err := pl.SeekTo(15); err == nil || err.Error() != "Offset is beyond the end of the playlist" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if frame, err := pl.Frame(); err != dudeldu.ErrPlaylistEnd || string(frame) != "0123456789bcdef" {
+		t.Error("Unexpected frame:", string(frame), err)
+		return
+	}
+
+	plf.Jingle = map[string]string{"path": pdir + "/seektest2.mp3"}
+
+	if err := pl.SeekTo(1); err == nil || err.Error() != "Cannot seek in a playlist with a jingle" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
+
+func TestSeekToURL(t *testing.T) {
+	var ranges []string
+	var honorRange bool
+
+	content := []byte("0123456789")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+
+		if honorRange {
+			http.ServeContent(w, r, "test.mp3", time.Time{}, bytes.NewReader(content))
+			return
+		}
+
+		w.Write(content)
+	}))
+	defer ts.Close()
+
+	ioutil.WriteFile(pdir+"/seektest3.mp3", []byte("abc"), 0644)
+
+	oldFrameSize := FrameSize
+	FrameSize = 100
+	defer func() {
+		FrameSize = oldFrameSize
+	}()
+
+	plf := newFilePlaylistFactory(map[string][]map[string]string{
+		"/seekurl": {
+			{"artist": "artist1", "title": "test1", "path": pdir + "/seektest3.mp3"},
+			{"artist": "artist2", "title": "test2", "path": ts.URL + "/test.mp3"},
+		},
+	}, "")
+
+	seek := func(offset int64) string {
+		pl := plf.Playlist("/seekurl", false).(*FilePlaylist)
+		defer pl.Close()
+
+		if err := pl.SeekTo(offset); err != nil {
+			return err.Error()
+		}
+
+		frame, _ := pl.Frame()
+
+		return string(frame)
+	}
+
+	// Only the requested tail is fetched
+
+	honorRange = true
+
+	if res := seek(7); res != "456789" || len(ranges) != 1 || ranges[0] != "bytes=4-" {
+		t.Error("Unexpected result:", res, ranges)
+		return
+	}
+
+	// Offsets beyond the end cannot be satisfied
+
+	if res := seek(20); res != "Upstream source "+ts.URL+"/test.mp3 cannot start at offset 17" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Upstream sources which ignore the range still work
+
+	honorRange = false
+	ranges = nil
+
+	if res := seek(7); res != "456789" || len(ranges) != 1 || ranges[0] != "bytes=4-" {
+		t.Error("Unexpected result:", res, ranges)
+		return
+	}
+
+	// No range is requested without an offset
+
+	ranges = nil
+
+	if res := seek(1); res != "bc0123456789" || len(ranges) != 1 || ranges[0] != "" {
+		t.Error("Unexpected result:", res, ranges)
+		return
+	}
+}
+
+func TestPlaylistDisplayName(t *testing.T) {
+
+	ioutil.WriteFile(pdir+"/displaynametest.mp3", []byte("1234567"), 0644)
+	ioutil.WriteFile(pdir+"/displaynametest.json", []byte(`{
+	"/plain" : [
+		{ "artist" : "artist1", "title" : "test1", "path" : "`+pdir+`/displaynametest.mp3" }
+	],
+	"/station" : {
+		"name" : "My Station",
+		"items" : [
+			{ "artist" : "artist1", "title" : "test1", "path" : "`+pdir+`/displaynametest.mp3" }
+		]
+	}
+}`), 0644)
+
+	plf, err := NewFilePlaylistFactory(pdir+"/displaynametest.json", "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	pl := plf.Playlist("/station", false).(*FilePlaylist)
+
+	var _ dudeldu.DisplayNamePlaylist = pl
+
+	if pl.Name() != "/station" || pl.DisplayName() != "My Station" {
+		t.Error("Unexpected names:", pl.Name(), pl.DisplayName())
+		return
+	}
+
+	drh := dudeldu.NewDefaultRequestHandler(plf, false, false, "")
+
+	request := func(path string) string {
+		testConn := &testutil.ErrorTestingConnection{}
+		drh.ServeRequest(testConn, &dudeldu.RequestInfo{Path: path})
+		return testConn.Out.String()
+	}
+
+	// The display name is send as station name - the web path is used for routing
+
+	if res := request("/station"); !strings.HasPrefix(res, "ICY 200 OK\r\n"+
+		"Content-Type: audio/mpeg\r\n"+
+		"icy-name: My Station\r\n") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	if res := request("/plain"); !strings.HasPrefix(res, "ICY 200 OK\r\n"+
+		"Content-Type: audio/mpeg\r\n"+
+		"icy-name: /plain\r\n") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	if res := request("/My Station"); !strings.HasPrefix(res, "HTTP/1.1 404") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// Display names are available without creating a playlist
+
+	var ipf dudeldu.PlaylistInfoFactory = plf
+
+	if res := fmt.Sprint(ipf.DisplayName("/station"), ipf.DisplayName("/plain"),
+		ipf.DisplayName("/station"+SingleTrackSuffix), ipf.DisplayName("/foo")); res != "My Station/plainMy Station" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+}
+
+func TestPaths(t *testing.T) {
+
+	plf := &FilePlaylistFactory{
+		data: map[string][]map[string]string{
+			"/b": {{"artist": "artist1", "title": "test1", "path": "test1.mp3"}},
+			"/c": {{"artist": "artist2", "title": "test2", "path": "test2.mp3"}},
+			"/a": {},
+		},
+	}
+
+	var _ dudeldu.ListablePlaylistFactory = plf
+
+	if res := fmt.Sprint(plf.Paths()); res != "[/a /b /c]" {
+		t.Error("Unexpected paths:", res)
+		return
+	}
+
+	// The request handler delegates to its factory
+
+	drh := dudeldu.NewDefaultRequestHandler(plf, false, false, "")
+
+	if res := fmt.Sprint(drh.Paths()); res != "[/a /b /c]" {
+		t.Error("Unexpected paths:", res)
+		return
+	}
+
+	drh.SetPlaylistFactory(NullPlaylistFactory{})
+
+	if res := drh.Paths(); res != nil {
+		t.Error("Unexpected paths:", res)
+		return
+	}
+}
+
+func TestPlaylistLoop(t *testing.T) {
+
+	ioutil.WriteFile(pdir+"/looptest.mp3", []byte("123"), 0644)
+	ioutil.WriteFile(pdir+"/looptest.json", []byte(`{
+	"/default" : [
+		{ "artist" : "artist1", "title" : "test1", "path" : "`+pdir+`/looptest.mp3" }
+	],
+	"/looped" : {
+		"loop" : true,
+		"looptimes" : 3,
+		"items" : [
+			{ "artist" : "artist1", "title" : "test1", "path" : "`+pdir+`/looptest.mp3" }
+		]
+	},
+	"/once" : {
+		"loop" : false,
+		"items" : [
+			{ "artist" : "artist1", "title" : "test1", "path" : "`+pdir+`/looptest.mp3" }
+		]
+	}
+}`), 0644)
+
+	oldFrameSize := FrameSize
+	FrameSize = 3
+	defer func() {
+		FrameSize = oldFrameSize
+	}()
+
+	plf, err := NewFilePlaylistFactory(pdir+"/looptest.json", "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var _ dudeldu.LoopingPlaylist = plf.Playlist("/looped", false).(*FilePlaylist)
+
+	drh := dudeldu.NewDefaultRequestHandler(plf, true, false, "")
+	drh.LoopTimes = 2
+
+	request := func(path string) string {
+		testConn := &testutil.ErrorTestingConnection{}
+		drh.ServeRequest(testConn, &dudeldu.RequestInfo{Path: path})
+		return strings.SplitN(testConn.Out.String(), "\r\n\r\n", 2)[1]
+	}
+
+	if res := request("/looped"); res != "123123123" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if res := request("/once"); res != "123" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Playlists without a loop definition use the looping of the handler
+
+	if res := request("/default"); res != "123123" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+}
+
+func TestUpstreamContentType(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/mpeg")
+		w.Write([]byte("0123456789"))
+	}))
+	defer ts.Close()
+
+	ioutil.WriteFile(pdir+"/upstreamtype.ogg", []byte("abc"), 0644)
+
+	plf := newFilePlaylistFactory(map[string][]map[string]string{
+		"/upstreamtype": {
+			{"artist": "artist1", "title": "test1", "path": ts.URL + "/relay"},
+			{"artist": "artist2", "title": "test2", "path": pdir + "/upstreamtype.ogg"},
+		},
+	}, "")
+
+	// The content type is unknown until the URL item has been opened -
+	// asking for it does not open the item
+
+	pl := plf.Playlist("/upstreamtype", false).(*FilePlaylist)
+	defer pl.Close()
+
+	if ctype := pl.ContentType(); ctype != DefaultContentType || pl.stream != nil {
+		t.Error("Unexpected content type:", ctype, pl.stream)
+		return
+	}
+
+	drh := dudeldu.NewDefaultRequestHandler(plf, false, false, "")
+
+	request := func() string {
+		testConn := &testutil.ErrorTestingConnection{}
+		drh.ServeRequest(testConn, &dudeldu.RequestInfo{Path: "/upstreamtype"})
+		return testConn.Out.String()
+	}
+
+	if res := request(); !strings.HasPrefix(res, "ICY 200 OK\r\n"+
+		"Content-Type: "+DefaultContentType+"\r\n") || !strings.HasSuffix(res, "0123456789abc") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// The content type of the upstream response is used from now on
+
+	if res := request(); !strings.HasPrefix(res, "ICY 200 OK\r\n"+
+		"Content-Type: audio/mpeg\r\n") || !strings.HasSuffix(res, "0123456789abc") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// The upstream content type only applies while the URL item is current
+
+	if ctype := pl.ContentType(); ctype != "audio/mpeg" {
+		t.Error("Unexpected content type:", ctype)
+		return
+	}
+
+	pl.current = 1
+
+	if ctype := pl.ContentType(); ctype != "audio/ogg" {
+		t.Error("Unexpected content type:", ctype)
+		return
+	}
+}
+
+func TestPlaylistAliases(t *testing.T) {
+
+	ioutil.WriteFile(pdir+"/aliastest.mp3", []byte("1234567"), 0644)
+	ioutil.WriteFile(pdir+"/aliastest.json", []byte(`{
+	"/live" : {
+		"aliases" : [ "/stream", "/listen.mp3" ],
+		"items" : [
+			{ "artist" : "artist1", "title" : "test1", "path" : "`+pdir+`/aliastest.mp3" }
+		]
+	}
+}`), 0644)
+
+	plf, err := NewFilePlaylistFactory(pdir+"/aliastest.json", "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := fmt.Sprint(plf.Paths()); res != "[/listen.mp3 /live /stream]" {
+		t.Error("Unexpected paths:", res)
+		return
+	}
+
+	drh := dudeldu.NewDefaultRequestHandler(plf, false, false, "")
+
+	for _, path := range []string{"/live", "/stream", "/listen.mp3"} {
+		testConn := &testutil.ErrorTestingConnection{}
+		drh.ServeRequest(testConn, &dudeldu.RequestInfo{Path: path})
+
+		if res := testConn.Out.String(); !strings.HasPrefix(res, "ICY 200 OK\r\n") ||
+			!strings.HasSuffix(res, "1234567") {
+			t.Error("Unexpected response:", path, res)
+			return
+		}
+	}
+
+	if pl := plf.Playlist("/stream", false); pl == nil || pl.Name() != "/live" {
+		t.Error("Unexpected playlist:", pl)
+		return
+	}
+
+	// Aliases share the playlist name of the path they refer to
+
+	if name := plf.PlaylistName("/stream"); name != "/live" {
+		t.Error("Unexpected playlist name:", name)
+		return
+	}
+
+	if name := plf.PlaylistName("/listen.mp3" + SingleTrackSuffix); name != "/live" {
+		t.Error("Unexpected playlist name:", name)
+		return
+	}
+
+	if name := plf.PlaylistName("/unknown"); name != "" {
+		t.Error("Unexpected playlist name:", name)
+		return
+	}
+
+	if pl := plf.Playlist("/unknown", false); pl != nil {
+		t.Error("Unexpected playlist:", pl)
+		return
+	}
+
+	// Aliases must not clash with other web paths
+
+	ioutil.WriteFile(pdir+"/aliastest2.json", []byte(`{
+	"/live" : {
+		"aliases" : [ "/other" ],
+		"items" : []
+	},
+	"/other" : []
+}`), 0644)
+
+	if _, err := NewFilePlaylistFactory(pdir+"/aliastest2.json", ""); err == nil ||
+		err.Error() != "Alias /other of /live is already defined" {
+		t.Error("Unexpected error:", err)
+		return
+	}
+}
+
+func TestPlaylistMaxListeners(t *testing.T) {
+
+	ioutil.WriteFile(pdir+"/maxlistenerstest.mp3", []byte("1234567"), 0644)
+	ioutil.WriteFile(pdir+"/maxlistenerstest.json", []byte(`{
+	"/busy" : {
+		"maxlisteners" : 1,
+		"aliases" : [ "/busy.mp3" ],
+		"items" : [
+			{ "artist" : "artist1", "title" : "test1", "path" : "`+pdir+`/maxlistenerstest.mp3" }
+		]
+	},
+	"/free" : [
+		{ "artist" : "artist1", "title" : "test1", "path" : "`+pdir+`/maxlistenerstest.mp3" }
+	]
+}`), 0644)
+
+	plf, err := NewFilePlaylistFactory(pdir+"/maxlistenerstest.json", "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := plf.Playlist("/busy", false).(*FilePlaylist).MaxListeners(); res != 1 {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	drh := dudeldu.NewDefaultRequestHandler(plf, false, false, "")
+
+	request := func(path string) string {
+		testConn := &testutil.ErrorTestingConnection{}
+		drh.ServeRequest(testConn, &dudeldu.RequestInfo{Path: path})
+		return testConn.Out.String()
+	}
+
+	// Keep a listener on the limited path
+
+	c1, c2 := net.Pipe()
+	done := make(chan bool)
+
+	go func() {
+		drh.ServeRequest(c1, &dudeldu.RequestInfo{Path: "/busy"})
+		close(done)
+	}()
+
+	if _, err := io.ReadFull(c2, make([]byte, 10)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := request("/busy"); res != "ICY 503 Server Full\r\n\r\n" {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// Aliases and single track requests of the playlist share the limit
+
+	for _, path := range []string{"/busy.mp3", "/busy" + SingleTrackSuffix} {
+		if res := request(path); res != "ICY 503 Server Full\r\n\r\n" {
+			t.Error("Unexpected response:", path, res)
+			return
+		}
+	}
+
+	// Other paths are not affected
+
+	if res := request("/free"); !strings.HasPrefix(res, "ICY 200 OK") || !strings.HasSuffix(res, "1234567") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// The path accepts listeners again once the listener has gone
+
+	c2.Close()
+	<-done
+
+	if res := request("/busy"); !strings.HasPrefix(res, "ICY 200 OK") || !strings.HasSuffix(res, "1234567") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+}
@@ -0,0 +1,145 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package playlist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+/*
+maxOggCommentSize is the maximum size of a comment header which is read (comment
+headers may contain large embedded pictures).
+*/
+const maxOggCommentSize = 1 << 20
+
+/*
+readOggComments reads the comments of an Ogg Vorbis or Opus stream. The comments
+are stored in the second packet of the stream. All returned keys are lower case.
+*/
+func readOggComments(r io.Reader) (map[string]string, error) {
+	var packet []byte
+
+	packets := 0
+	header := make([]byte, 27)
+
+	for packets < 2 {
+
+		// Read the header and the segment table of the next page
+
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+
+		if string(header[:4]) != "OggS" {
+			return nil, fmt.Errorf("Invalid Ogg page")
+		}
+
+		segments := make([]byte, header[26])
+
+		if _, err := io.ReadFull(r, segments); err != nil {
+			return nil, err
+		}
+
+		// Collect the segments of the second packet - a packet ends with a
+		// segment which is shorter than 255 bytes
+
+		for _, l := range segments {
+			segment := make([]byte, l)
+
+			if _, err := io.ReadFull(r, segment); err != nil {
+				return nil, err
+			}
+
+			if packets == 1 {
+				if packet = append(packet, segment...); len(packet) > maxOggCommentSize {
+					return nil, fmt.Errorf("Ogg comment header is too large")
+				}
+			}
+
+			if l < 255 {
+				if packets++; packets == 2 {
+					break
+				}
+			}
+		}
+	}
+
+	return parseVorbisComment(packet)
+}
+
+/*
+parseVorbisComment parses a Vorbis comment packet. Vorbis and Opus streams use
+the same comment format with different packet prefixes.
+*/
+func parseVorbisComment(packet []byte) (map[string]string, error) {
+
+	if bytes.HasPrefix(packet, []byte("\x03vorbis")) {
+		packet = packet[7:]
+	} else if bytes.HasPrefix(packet, []byte("OpusTags")) {
+		packet = packet[8:]
+	} else {
+		return nil, fmt.Errorf("No comment header found")
+	}
+
+	// All values are prefixed with their length
+
+	nextValue := func() ([]byte, bool) {
+		if len(packet) < 4 {
+			return nil, false
+		}
+
+		l := binary.LittleEndian.Uint32(packet)
+		packet = packet[4:]
+
+		if uint64(l) > uint64(len(packet)) {
+			return nil, false
+		}
+
+		value := packet[:l]
+		packet = packet[l:]
+
+		return value, true
+	}
+
+	// Skip the vendor string
+
+	if _, ok := nextValue(); !ok || len(packet) < 4 {
+		return nil, fmt.Errorf("Invalid comment header")
+	}
+
+	count := binary.LittleEndian.Uint32(packet)
+	packet = packet[4:]
+
+	res := make(map[string]string)
+
+	for i := uint32(0); i < count; i++ {
+		comment, ok := nextValue()
+		if !ok {
+			return nil, fmt.Errorf("Invalid comment header")
+		}
+
+		// Keep the first value of every field
+
+		if kv := strings.SplitN(string(comment), "=", 2); len(kv) == 2 {
+			key := strings.ToLower(kv[0])
+
+			if _, ok := res[key]; !ok {
+				res[key] = kv[1]
+			}
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,178 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package playlist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+/*
+oggStream creates Ogg pages which contain the given packets. Each page contains
+at most maxSegments segments.
+*/
+func oggStream(maxSegments int, packets ...[]byte) []byte {
+	var lacing, data, res []byte
+
+	for _, packet := range packets {
+		l := len(packet)
+
+		for ; l >= 255; l -= 255 {
+			lacing = append(lacing, 255)
+		}
+
+		lacing = append(lacing, byte(l))
+		data = append(data, packet...)
+	}
+
+	for len(lacing) > 0 {
+		n := len(lacing)
+		if n > maxSegments {
+			n = maxSegments
+		}
+
+		size := 0
+		for _, l := range lacing[:n] {
+			size += int(l)
+		}
+
+		header := make([]byte, 27)
+		copy(header, "OggS")
+		header[26] = byte(n)
+
+		res = append(res, header...)
+		res = append(res, lacing[:n]...)
+		res = append(res, data[:size]...)
+
+		lacing, data = lacing[n:], data[size:]
+	}
+
+	return res
+}
+
+/*
+vorbisComment creates a Vorbis comment packet with a given prefix.
+*/
+func vorbisComment(prefix string, comments ...string) []byte {
+	var buf bytes.Buffer
+
+	writeValue := func(v string) {
+		binary.Write(&buf, binary.LittleEndian, uint32(len(v)))
+		buf.WriteString(v)
+	}
+
+	buf.WriteString(prefix)
+	writeValue("test vendor")
+	binary.Write(&buf, binary.LittleEndian, uint32(len(comments)))
+
+	for _, c := range comments {
+		writeValue(c)
+	}
+
+	return buf.Bytes()
+}
+
+func TestReadOggComments(t *testing.T) {
+
+	ogg := oggStream(255, []byte("\x01vorbis123"),
+		vorbisComment("\x03vorbis", "ARTIST=artist1", "title=test1", "Artist=artist2", "invalid"))
+
+	if res, err := readOggComments(bytes.NewReader(ogg)); err != nil ||
+		len(res) != 2 || res["artist"] != "artist1" || res["title"] != "test1" {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
+
+	// Opus comments with a header which spans several segments and pages
+
+	ogg = oggStream(2, []byte("OpusHead123"), vorbisComment("OpusTags", "TITLE="+strings.Repeat("x", 600)))
+
+	if res, err := readOggComments(bytes.NewReader(ogg)); err != nil || res["title"] != strings.Repeat("x", 600) {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
+
+	// Malformed data
+
+	for _, data := range [][]byte{
+		nil,
+		[]byte("xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"),
+		oggStream(255, []byte("\x01vorbis123")),
+		append(oggStream(255, []byte("\x01vorbis123")), oggStream(255, []byte("\x03vorbis"))...),
+		append(oggStream(255, []byte("\x01vorbis123")), oggStream(255, []byte("\x05vorbis"))...),
+		append(oggStream(255, []byte("\x01vorbis123")), oggStream(255, vorbisComment("\x03vorbis", "ARTIST=artist1")[:30])...),
+	} {
+		if res, err := readOggComments(bytes.NewReader(data)); err == nil {
+			t.Error("Unexpected result:", res)
+			return
+		}
+	}
+}
+
+func TestOggCommentPlaylist(t *testing.T) {
+
+	ogg := oggStream(255, []byte("\x01vorbis123"),
+		vorbisComment("\x03vorbis", "ARTIST=oggartist", "TITLE=oggtitle"), []byte("audio"))
+
+	for name, data := range map[string][]byte{
+		"oggtest.ogg":      ogg,
+		"oggtest.opus":     []byte("invalid"),
+		"oggtest.mp3":      ogg,
+		"oggtitletest.ogg": ogg,
+	} {
+		if err := ioutil.WriteFile(pdir+"/"+name, data, 0644); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	oldFrameSize := FrameSize
+	FrameSize = 1
+	defer func() {
+		FrameSize = oldFrameSize
+	}()
+
+	plf := newFilePlaylistFactory(map[string][]map[string]string{
+		"/ogg": {
+			{"path": "oggtest.ogg"},
+			{"path": "oggtest.opus"},
+			{"path": "oggtest.mp3"},
+			{"title": "mytitle", "path": "oggtitletest.ogg"},
+		},
+	}, pdir+"/")
+
+	pl := plf.Playlist("/ogg", false)
+
+	var res []string
+
+	for !pl.Finished() {
+		if frame, _ := pl.Frame(); frame != nil {
+			res = append(res, pl.Artist()+"/"+pl.Title())
+			pl.ReleaseFrame(frame)
+		}
+	}
+
+	// The whole file is streamed - comments are only read for artist and title
+
+	if len(res) != 3*len(ogg)+len("invalid") {
+		t.Error("Unexpected number of frames:", len(res))
+		return
+	}
+
+	if res[0] != "oggartist/oggtitle" || res[len(ogg)] != "/" ||
+		res[len(ogg)+len("invalid")] != "/" || res[len(res)-1] != "oggartist/mytitle" {
+		t.Error("Unexpected result:", res[0], res[len(ogg)], res[len(ogg)+len("invalid")], res[len(res)-1])
+		return
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package playlist
+
+import (
+	"io"
+	"sync"
+
+	"devt.de/krotik/dudeldu"
+)
+
+/*
+ReaderPlaylist is a playlist which streams the data of an arbitrary reader
+(e.g. the output of an encoder process).
+*/
+type ReaderPlaylist struct {
+	name        string     // Name of the playlist
+	contentType string     // Content type of the data
+	artist      string     // Artist which is send as meta data
+	title       string     // Title which is send as meta data
+	reader      io.Reader  // Reader which provides the data
+	finished    bool       // Flag if the reader has no more data
+	framePool   *sync.Pool // Pool for byte arrays
+}
+
+/*
+NewReaderPlaylist creates a new playlist which streams the data of a given reader.
+*/
+func NewReaderPlaylist(name, contentType, artist, title string, r io.Reader) *ReaderPlaylist {
+	return &ReaderPlaylist{
+		name:        name,
+		contentType: contentType,
+		artist:      artist,
+		title:       title,
+		reader:      r,
+		framePool:   &sync.Pool{New: func() interface{} { return make([]byte, FrameSize, FrameSize) }},
+	}
+}
+
+/*
+Name is the name of the playlist.
+*/
+func (rp *ReaderPlaylist) Name() string {
+	return rp.name
+}
+
+/*
+ContentType returns the content type of this playlist.
+*/
+func (rp *ReaderPlaylist) ContentType() string {
+	return rp.contentType
+}
+
+/*
+Artist returns the artist which is currently playing.
+*/
+func (rp *ReaderPlaylist) Artist() string {
+	return rp.artist
+}
+
+/*
+Title returns the title which is currently playing.
+*/
+func (rp *ReaderPlaylist) Title() string {
+	return rp.title
+}
+
+/*
+Frame returns the current audio frame which is playing.
+*/
+func (rp *ReaderPlaylist) Frame() ([]byte, error) {
+
+	if rp.finished {
+		return nil, dudeldu.ErrPlaylistEnd
+	}
+
+	frame := rp.framePool.Get().([]byte)
+
+	n, err := io.ReadFull(rp.reader, frame)
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = dudeldu.ErrPlaylistEnd
+		rp.finished = true
+	}
+
+	if n == 0 {
+		rp.framePool.Put(frame)
+		return nil, err
+	}
+
+	return frame[:n], err
+}
+
+/*
+ReleaseFrame releases a frame which has been written to the client.
+*/
+func (rp *ReaderPlaylist) ReleaseFrame(frame []byte) {
+	if len(frame) == FrameSize {
+		rp.framePool.Put(frame)
+	}
+}
+
+/*
+Finished returns if the playlist has finished playing.
+*/
+func (rp *ReaderPlaylist) Finished() bool {
+	return rp.finished
+}
+
+/*
+Reset returns ErrPlaylistEnd since a reader cannot be played again.
+*/
+func (rp *ReaderPlaylist) Reset() error {
+	return dudeldu.ErrPlaylistEnd
+}
+
+/*
+Close closes the reader if it is an io.Closer. A reader cannot be played
+again - Close returns ErrPlaylistEnd if closing was successful.
+*/
+func (rp *ReaderPlaylist) Close() error {
+	rp.finished = true
+
+	if c, ok := rp.reader.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+
+	return dudeldu.ErrPlaylistEnd
+}
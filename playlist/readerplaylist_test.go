@@ -0,0 +1,113 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package playlist
+
+import (
+	"bytes"
+	"testing"
+
+	"devt.de/krotik/dudeldu"
+)
+
+func TestReaderPlaylist(t *testing.T) {
+
+	oldFrameSize := FrameSize
+	FrameSize = 3
+	defer func() {
+		FrameSize = oldFrameSize
+	}()
+
+	pl := NewReaderPlaylist("/reader", "audio/mpeg", "artist1", "title1",
+		bytes.NewReader([]byte("12345678")))
+
+	var _ dudeldu.Playlist = pl
+
+	if pl.Name() != "/reader" || pl.ContentType() != "audio/mpeg" ||
+		pl.Artist() != "artist1" || pl.Title() != "title1" {
+		t.Error("Unexpected playlist:", pl)
+		return
+	}
+
+	for _, expected := range []string{"123", "456"} {
+		frame, err := pl.Frame()
+
+		if err != nil || string(frame) != expected || pl.Finished() {
+			t.Error("Unexpected frame:", string(frame), err)
+			return
+		}
+
+		pl.ReleaseFrame(frame)
+	}
+
+	// The last frame is only partially filled
+
+	if frame, err := pl.Frame(); err != dudeldu.ErrPlaylistEnd || string(frame) != "78" || !pl.Finished() {
+		t.Error("Unexpected frame:", string(frame), err)
+		return
+	}
+
+	if frame, err := pl.Frame(); err != dudeldu.ErrPlaylistEnd || frame != nil {
+		t.Error("Unexpected frame:", string(frame), err)
+		return
+	}
+
+	// Reader which ends on a frame boundary
+
+	pl = NewReaderPlaylist("/reader", "audio/mpeg", "artist1", "title1",
+		bytes.NewReader([]byte("123")))
+
+	if frame, err := pl.Frame(); err != nil || string(frame) != "123" {
+		t.Error("Unexpected frame:", string(frame), err)
+		return
+	}
+
+	if frame, err := pl.Frame(); err != dudeldu.ErrPlaylistEnd || frame != nil || !pl.Finished() {
+		t.Error("Unexpected frame:", string(frame), err)
+		return
+	}
+
+	// Closing the playlist closes the reader
+
+	rc := &testReadCloser{Reader: bytes.NewReader([]byte("123"))}
+	pl = NewReaderPlaylist("/reader", "audio/mpeg", "artist1", "title1", rc)
+
+	// A reader cannot be reset
+
+	if err := pl.Reset(); err != dudeldu.ErrPlaylistEnd || rc.closed {
+		t.Error("Unexpected result:", err, rc.closed)
+		return
+	}
+
+	if err := pl.Close(); err != dudeldu.ErrPlaylistEnd || !rc.closed || !pl.Finished() {
+		t.Error("Unexpected result:", err, rc.closed)
+		return
+	}
+
+	// Readers without a close method
+
+	pl = NewReaderPlaylist("/reader", "audio/mpeg", "artist1", "title1",
+		bytes.NewReader(nil))
+
+	if err := pl.Close(); err != dudeldu.ErrPlaylistEnd {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
+
+type testReadCloser struct {
+	*bytes.Reader
+	closed bool
+}
+
+func (rc *testReadCloser) Close() error {
+	rc.closed = true
+	return nil
+}
@@ -0,0 +1,95 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package dudeldu
+
+import (
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+/*
+preRollPlaylist is the playlist which is shown to clients while the pre-roll
+is streamed.
+*/
+type preRollPlaylist struct {
+	Playlist        // Playlist which is streamed after the pre-roll
+	title    string // Title which is shown during the pre-roll
+}
+
+/*
+Artist returns an empty string - the pre-roll has no artist.
+*/
+func (pl *preRollPlaylist) Artist() string {
+	return ""
+}
+
+/*
+Title returns the title which is shown during the pre-roll.
+*/
+func (pl *preRollPlaylist) Title() string {
+	return pl.title
+}
+
+/*
+writePreRoll streams the pre-roll file to a client. Returns the number of
+written bytes since the last meta data block and an error if the client did
+not accept the data. A pre-roll file which cannot be read is skipped.
+*/
+func (drh *DefaultRequestHandler) writePreRoll(c net.Conn, pl Playlist, writtenBytes uint64,
+	metaDataSupport bool, metaDataInterval uint64, lastMetaData *time.Time, logger DebugLogger) (uint64, error) {
+
+	f, err := os.Open(drh.PreRoll)
+	if err != nil {
+		logger.PrintDebug("Skipping pre-roll: ", err)
+		return writtenBytes, nil
+	}
+	defer f.Close()
+
+	title := drh.PreRollTitle
+	if title == "" {
+		title = displayName(pl)
+	}
+
+	prl := &preRollPlaylist{pl, title}
+
+	// WebSocket clients get the meta data as a text message
+
+	if wsc, ok := c.(*webSocketConn); ok {
+		if err = wsc.WriteMetaData(prl); err != nil {
+			return writtenBytes, err
+		}
+	}
+
+	frame := make([]byte, FrameSize)
+
+	for {
+		n, rerr := io.ReadFull(f, frame)
+
+		if n > 0 {
+			writtenBytes, err = drh.writeFrameData(c, prl, frame[:n], writtenBytes,
+				metaDataSupport, metaDataInterval, lastMetaData)
+
+			if err != nil {
+				return writtenBytes, err
+			}
+		}
+
+		if rerr != nil {
+			if rerr != io.EOF && rerr != io.ErrUnexpectedEOF {
+				logger.PrintDebug("Could not read pre-roll: ", rerr)
+			}
+
+			return writtenBytes, nil
+		}
+	}
+}
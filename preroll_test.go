@@ -0,0 +1,87 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package dudeldu
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"devt.de/krotik/common/testutil"
+)
+
+func TestPreRoll(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "dudeldu")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "ident.mp3"), []byte("ident"), 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	tpl := &testPlaylist{[][]byte{[]byte("123"), []byte("4567")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+	drh.PreRoll = filepath.Join(dir, "ident.mp3")
+
+	request := func(info *RequestInfo) string {
+		tpl.fp = 0
+		testConn := &testutil.ErrorTestingConnection{}
+		drh.defaultServeRequest(testConn, info)
+		return testConn.Out.String()
+	}
+
+	header := "ICY 200 OK\r\n" +
+		"Content-Type: Test/Content\r\n" +
+		"icy-name: TestPlaylist\r\n" +
+		"\r\n"
+
+	if res := request(&RequestInfo{Path: "/testpath"}); res != header+"ident1234567" {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// The meta data shows the pre-roll title during the pre-roll
+
+	drh.PreRollTitle = "Station Ident"
+
+	res := request(&RequestInfo{Path: "/testpath", MetaDataSupport: true, MetaDataInterval: 4})
+
+	preRollMetaData := string(drh.streamMetaData(&preRollPlaylist{tpl, "Station Ident"}))
+	trackMetaData := string(drh.streamMetaData(tpl))
+
+	if expected := header[:len(header)-2] + "icy-metadata: 1\r\nicy-metaint: 4\r\n\r\n" +
+		"iden" + preRollMetaData + "t123" + trackMetaData + "4567" + trackMetaData; res != expected {
+		t.Errorf("Unexpected response: %q", res)
+		return
+	}
+
+	// Streams which continue at an offset do not get the pre-roll
+
+	if res := request(&RequestInfo{Path: "/testpath", Offset: 2}); res != header+"34567" {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// A missing pre-roll is skipped
+
+	drh.PreRoll = filepath.Join(dir, "missing.mp3")
+
+	if res := request(&RequestInfo{Path: "/testpath"}); res != header+"1234567" {
+		t.Error("Unexpected response:", res)
+		return
+	}
+}
@@ -11,7 +11,10 @@
 package dudeldu
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"math"
@@ -19,6 +22,9 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
 
 	"devt.de/krotik/common/datautil"
 )
@@ -33,6 +39,36 @@ MetaDataInterval is the data interval in which meta data is send
 */
 var MetaDataInterval uint64 = 65536
 
+/*
+MinClientMetaDataInterval is the smallest meta data interval a client can request
+*/
+var MinClientMetaDataInterval uint64 = 1024
+
+/*
+MaxClientMetaDataInterval is the largest meta data interval a client can request
+*/
+var MaxClientMetaDataInterval uint64 = 262144
+
+/*
+PostEndKeepAliveInterval is the time between two keepalive bytes which are
+send to clients while a connection is held after the end of a playlist
+*/
+var PostEndKeepAliveInterval = 10 * time.Second
+
+/*
+PostEndBehavior defines what happens to a connection after the playlist has ended
+*/
+type PostEndBehavior string
+
+/*
+Possible behaviors after the end of a playlist
+*/
+const (
+	PostEndClose   PostEndBehavior = "close"   // Close the connection (default)
+	PostEndSilence PostEndBehavior = "silence" // Send zero-filled frames until the client disconnects
+	PostEndHold    PostEndBehavior = "hold"    // Send a keepalive byte every PostEndKeepAliveInterval until the client disconnects
+)
+
 /*
 peerNoAuthTimeout is the time in seconds a peer can open new connections without
 sending new authentication information.
@@ -40,12 +76,33 @@ sending new authentication information.
 const peerNoAuthTimeout = 10
 
 /*
-MaxMetaDataSize is the maximum size for meta data (everything over is truncated)
+MaxMetaDataSize is the default maximum size for meta data (everything over is truncated)
 
 Must be a multiple of 16 which fits into one byte. Maximum: 16 * 255 = 4080
 */
 var MaxMetaDataSize = 4080
 
+/*
+maxICYMetaDataSize is the largest meta data size which can be expressed by the
+length byte of an ICY meta data block.
+*/
+const maxICYMetaDataSize = 16 * 255
+
+/*
+DefaultFrameWriteTimeout is the default time a client has to accept a single frame
+*/
+var DefaultFrameWriteTimeout = 30 * time.Second
+
+/*
+DefaultRealm is the default realm which is shown to clients which need to authenticate
+*/
+const DefaultRealm = "DudelDu Streaming Server"
+
+/*
+DefaultStreamTitleTemplate is the default template for the StreamTitle meta data
+*/
+const DefaultStreamTitleTemplate = "{{.Title}} - {{.Artist}}"
+
 /*
 requestPathPattern is the pattern which is used to extract the requested path
 (i case-insensitive / m multi-line mode: ^ and $ match begin/end line)
@@ -58,19 +115,150 @@ requestOffsetPattern is the pattern which is used to extract the requested offse
 */
 var requestOffsetPattern = regexp.MustCompile("(?im)^Range: bytes=([0-9]+)-.*$")
 
+/*
+requestSuffixRangePattern is the pattern which is used to extract a requested number
+of bytes from the end of the stream
+(i case-insensitive / m multi-line mode: ^ and $ match begin/end line)
+*/
+var requestSuffixRangePattern = regexp.MustCompile("(?im)^Range: bytes=-([0-9]+)\\s*$")
+
+/*
+requestFrameOffsetPattern is the pattern which is used to extract a requested number
+of frames which should be skipped
+(i case-insensitive / m multi-line mode: ^ and $ match begin/end line)
+*/
+var requestFrameOffsetPattern = regexp.MustCompile("(?im)^X-Frame-Offset:\\s*([0-9]+)\\s*$")
+
+/*
+requestMetaIntPattern is the pattern which is used to extract a requested meta data interval
+(i case-insensitive / m multi-line mode: ^ and $ match begin/end line)
+*/
+var requestMetaIntPattern = regexp.MustCompile("(?im)^Icy-MetaInt:\\s*([0-9]+)\\s*$")
+
+/*
+requestHTTPPattern is the pattern which is used to detect a HTTP request line and
+to extract the HTTP version
+(i case-insensitive / m multi-line mode: ^ and $ match begin/end line)
+*/
+var requestHTTPPattern = regexp.MustCompile("(?im)^get\\s+\\S+\\s+(HTTP/1\\.[01])\\s*$")
+
+/*
+requestAcceptPattern is the pattern which is used to detect an Accept header
+(i case-insensitive / m multi-line mode: ^ and $ match begin/end line)
+*/
+var requestAcceptPattern = regexp.MustCompile("(?im)^Accept:\\s*\\S+")
+
+/*
+RequestInfo data structure which holds the information of a decoded client request
+*/
+type RequestInfo struct {
+	Path             string   // Requested path
+	MetaDataSupport  bool     // Flag if the client supports meta data
+	Offset           int      // Requested byte offset
+	Auth             string   // Authentication which was send by the client (may be empty)
+	RemoteAddr       net.Addr // Address of the client
+	Headers          string   // Raw request headers
+	HTTPClient       bool     // Flag if the client is a plain HTTP client (e.g. a browser)
+	MetaDataInterval uint64   // Meta data interval requested by the client (0 for the default interval)
+	SuffixLength     int      // Number of bytes requested from the end of the stream (0 if not requested)
+	FrameOffset      int      // Number of whole frames which should be skipped before the byte offset is applied
+	ID               string   // ID of the request which is included in all log lines (may be empty)
+}
+
+/*
+LegacyServeRequest adapts a ServeRequest function which uses positional
+arguments to the current ServeRequest signature.
+*/
+func LegacyServeRequest(serveRequest func(c net.Conn, path string,
+	metaDataSupport bool, offset int, auth string)) func(c net.Conn, info *RequestInfo) {
+
+	return func(c net.Conn, info *RequestInfo) {
+		serveRequest(c, info.Path, info.MetaDataSupport, info.Offset, info.Auth)
+	}
+}
+
 /*
 DefaultRequestHandler data structure
 */
 type DefaultRequestHandler struct {
-	PlaylistFactory PlaylistFactory // Factory for playlists
-	ServeRequest    func(c net.Conn, path string,
-		metaDataSupport bool, offset int, auth string) // Function to serve requests
-	loop      bool               // Flag if the playlist should be looped
-	LoopTimes int                // Number of loops -1 loops forever
-	shuffle   bool               // Flag if the playlist should be shuffled
-	auth      string             // Required (basic) authentication string - may be empty
-	authPeers *datautil.MapCache // Peers which have been authenticated
-	logger    DebugLogger        // Logger for debug output
+	PlaylistFactory      PlaylistFactory                     // Factory for playlists (use SetPlaylistFactory while serving)
+	ServeRequest         func(c net.Conn, info *RequestInfo) // Function to serve requests
+	loop                 bool                                // Flag if the playlist should be looped
+	LoopTimes            int                                 // Number of loops -1 loops forever
+	WebSocket            bool                                // Flag if clients may request streams via a WebSocket upgrade
+	HTTPCompatMode       bool                                // Flag if plain HTTP clients get a HTTP instead of an ICY status line
+	ChunkedHTTP          bool                                // Flag if plain HTTP clients get the stream with chunked transfer encoding
+	ClientMetaInt        bool                                // Flag if clients may request a meta data interval via an Icy-MetaInt header
+	FrameWriteTimeout    time.Duration                       // Time a client has to accept a frame (0 waits forever)
+	DetectDisconnect     bool                                // Flag if clients which close the connection are detected by a background read
+	MaxMetaDataSize      int                                 // Maximum size for meta data (everything over is truncated)
+	MaxTitleLength       int                                 // Maximum number of characters of the stream title (longer titles end with an ellipsis - 0 is unlimited)
+	HealthPath           string                              // Path which answers health checks (empty disables health checks)
+	MaxStreamDuration    time.Duration                       // Maximum time a client can stream before the connection is closed (0 is unlimited)
+	MaxBytesPerSecond    uint64                              // Maximum number of bytes per second which are send to a client (0 is unlimited)
+	PostEndBehavior      PostEndBehavior                     // What happens to a connection after a (non-looping) playlist has ended (empty closes the connection)
+	PreRoll              string                              // Optional audio file which is streamed at the start of every connection before the playlist
+	PreRollTitle         string                              // Title which is shown while the pre-roll is streamed (empty shows the playlist name)
+	AccessLog            io.Writer                           // Optional writer which receives a line for every completed request
+	StatusLine           string                              // Status line which is send to ICY clients
+	IcyNotice1           string                              // Optional first notice which is send to clients
+	IcyNotice2           string                              // Optional second notice which is send to clients
+	Public               bool                                // Flag if the stream may be listed in public directories
+	SendInitialMetadata  bool                                // Flag if a meta data block is send right after the headers (before the first interval)
+	MinMetadataGap       time.Duration                       // Minimum time between two meta data blocks which carry a title (0 sends a title with every block)
+	Realm                string                              // Realm which is shown to clients which need to authenticate
+	StreamTitleTemplate  string                              // Template for the StreamTitle meta data (fields: Title, Artist, Album, Name)
+	MetadataEncoder      MetadataEncoder                     // Encoder for the meta data blocks in the stream (nil uses the ICY format)
+	shuffle              bool                                // Flag if the playlist should be shuffled
+	auth                 string                              // Required (basic) authentication string - may be empty
+	fileAuth             map[string]bool                     // Authentication strings which were loaded from a file
+	authLock             sync.RWMutex                        // Lock for the authentication strings
+	BearerTokenValidator func(token string) bool             // Optional validator for bearer tokens (nil disables bearer authentication)
+	DisableAuthReplay    bool                                // Flag if every connection must carry its own authentication
+	authPeers            *datautil.MapCache                  // Peers which have been authenticated
+	MaxAuthFailures      int                                 // Number of failed authentications within AuthFailureWindow after which a client is banned (0 disables bans)
+	AuthFailureWindow    time.Duration                       // Time window in which failed authentications are counted
+	AuthBanTime          time.Duration                       // Time a client is refused after too many failed authentications
+	authFailures         *datautil.MapCache                  // Failed authentications of clients
+	authFailuresLock     sync.Mutex                          // Lock for failed authentications
+	ResumeStreams        bool                                // Flag if reconnecting clients resume at the position where their last stream stopped
+	resumePositions      *datautil.MapCache                  // Last stream positions of clients
+	logger               DebugLogger                         // Logger for debug output
+	now                  func() time.Time                    // Function which returns the current time (can be replaced for unit tests)
+	sleep                func(time.Duration)                 // Function which pauses the current goroutine (can be replaced for unit tests)
+
+	// Optional callbacks which are called inline (they should not block) when a
+	// client starts and stops streaming
+
+	OnListenerConnect    func(path string, clientIP string)
+	OnListenerDisconnect func(path string, clientIP string, written uint64)
+
+	subscribers     []chan<- *TrackEvent // Subscribers for track events
+	subscribersLock sync.RWMutex         // Lock for subscribers
+
+	skips     map[string]uint64 // Skip requests per playlist name
+	skipsLock sync.RWMutex      // Lock for skip requests
+
+	playlistNames     map[string]string // Playlist names of streamed paths
+	playlistNamesLock sync.RWMutex      // Lock for playlist names
+
+	streamTitleTmpl     *template.Template // Parsed StreamTitleTemplate
+	streamTitleTmplSrc  string             // Source of the parsed StreamTitleTemplate
+	streamTitleTmplLock sync.Mutex         // Lock for the parsed template
+
+	nowPlaying     map[string]*nowPlaying // Current tracks of all streamed playlists
+	nowPlayingLock sync.RWMutex           // Lock for current tracks
+
+	listeners     map[string]int // Number of listeners of all streamed playlists
+	listenersLock sync.Mutex     // Lock for listener counts
+
+	connections     map[string]*ConnSnapshot // Active streaming connections
+	connectionsLock sync.RWMutex             // Lock for active streaming connections
+
+	factoryLock sync.RWMutex // Lock for the playlist factory
+
+	stats     ConnectionStats // Number of closed streaming connections by reason
+	statsLock sync.RWMutex    // Lock for connection stats
 }
 
 /*
@@ -80,25 +268,213 @@ func NewDefaultRequestHandler(pf PlaylistFactory, loop bool,
 	shuffle bool, auth string) *DefaultRequestHandler {
 
 	drh := &DefaultRequestHandler{
-		PlaylistFactory: pf,
-		loop:            loop,
-		LoopTimes:       -1,
-		shuffle:         shuffle,
-		auth:            auth,
-		authPeers:       datautil.NewMapCache(0, peerNoAuthTimeout),
-		logger:          nil,
+		PlaylistFactory:     pf,
+		loop:                loop,
+		LoopTimes:           -1,
+		shuffle:             shuffle,
+		auth:                auth,
+		authPeers:           datautil.NewMapCache(0, peerNoAuthTimeout),
+		AuthFailureWindow:   time.Minute,
+		AuthBanTime:         10 * time.Minute,
+		authFailures:        datautil.NewMapCache(maxAuthFailureEntries, 0),
+		resumePositions:     datautil.NewMapCache(0, peerNoAuthTimeout),
+		logger:              &nullLogger{},
+		now:                 time.Now,
+		sleep:               time.Sleep,
+		FrameWriteTimeout:   DefaultFrameWriteTimeout,
+		MaxMetaDataSize:     MaxMetaDataSize,
+		HealthPath:          "/healthz",
+		StatusLine:          "ICY 200 OK",
+		Realm:               DefaultRealm,
+		StreamTitleTemplate: DefaultStreamTitleTemplate,
+		skips:               make(map[string]uint64),
+		playlistNames:       make(map[string]string),
+		nowPlaying:          make(map[string]*nowPlaying),
+		listeners:           make(map[string]int),
+		connections:         make(map[string]*ConnSnapshot),
 	}
 	drh.ServeRequest = drh.defaultServeRequest
+	drh.MetadataEncoder = &icyMetadataEncoder{drh}
 	return drh
 }
 
 /*
-SetDebugLogger sets the debug logger for this request handler.
+SetDebugLogger sets the debug logger for this request handler. A nil value
+discards all debug output.
 */
 func (drh *DefaultRequestHandler) SetDebugLogger(logger DebugLogger) {
+	if logger == nil {
+		logger = &nullLogger{}
+	}
 	drh.logger = logger
 }
 
+/*
+SetPlaylistFactory replaces the playlist factory of this request handler. New
+connections use the new factory while existing connections continue to stream
+their current playlist.
+*/
+func (drh *DefaultRequestHandler) SetPlaylistFactory(pf PlaylistFactory) {
+	drh.factoryLock.Lock()
+	defer drh.factoryLock.Unlock()
+
+	drh.PlaylistFactory = pf
+}
+
+/*
+playlistFactory returns the current playlist factory of this request handler.
+*/
+func (drh *DefaultRequestHandler) playlistFactory() PlaylistFactory {
+	drh.factoryLock.RLock()
+	defer drh.factoryLock.RUnlock()
+
+	return drh.PlaylistFactory
+}
+
+/*
+playlistName returns the name of the playlist which is served for a given path.
+Skips and current tracks are kept by playlist name so all paths which serve the
+same playlist (e.g. aliases) share them. If the factory cannot resolve the name
+then the name of the playlist which was last streamed for the path is used.
+*/
+func (drh *DefaultRequestHandler) playlistName(path string) string {
+	if ipf, ok := drh.playlistFactory().(PlaylistInfoFactory); ok {
+		if name := ipf.PlaylistName(path); name != "" {
+			return name
+		}
+	}
+
+	drh.playlistNamesLock.RLock()
+	defer drh.playlistNamesLock.RUnlock()
+
+	if name, ok := drh.playlistNames[path]; ok {
+		return name
+	}
+
+	return path
+}
+
+/*
+knownPath returns if a given path is served by the playlist factory. Paths of
+factories which cannot tell (neither PlaylistInfoFactory nor
+ListablePlaylistFactory) are known once they have been streamed.
+*/
+func (drh *DefaultRequestHandler) knownPath(path string) bool {
+	pf := drh.playlistFactory()
+
+	if ipf, ok := pf.(PlaylistInfoFactory); ok {
+		return ipf.PlaylistName(path) != ""
+	}
+
+	if lpf, ok := pf.(ListablePlaylistFactory); ok {
+		for _, p := range lpf.Paths() {
+			if p == path {
+				return true
+			}
+		}
+		return false
+	}
+
+	drh.playlistNamesLock.RLock()
+	defer drh.playlistNamesLock.RUnlock()
+
+	_, ok := drh.playlistNames[path]
+
+	return ok
+}
+
+/*
+streamPlaylistName records and returns the name of a playlist which is streamed
+for a given path.
+*/
+func (drh *DefaultRequestHandler) streamPlaylistName(path string, pl Playlist) string {
+	name := pl.Name()
+
+	drh.playlistNamesLock.Lock()
+	defer drh.playlistNamesLock.Unlock()
+
+	drh.playlistNames[path] = name
+
+	return name
+}
+
+/*
+Paths returns all paths which can be served by the current playlist factory.
+Returns nil if the factory cannot list its paths.
+*/
+func (drh *DefaultRequestHandler) Paths() []string {
+	if lpf, ok := drh.playlistFactory().(ListablePlaylistFactory); ok {
+		return lpf.Paths()
+	}
+
+	return nil
+}
+
+/*
+newRequestID creates a new short unique request ID (can be replaced for unit tests).
+*/
+var newRequestID = func() string {
+	id := make([]byte, 4)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+/*
+requestLogger returns a logger which includes a given request ID in all log lines.
+*/
+func (drh *DefaultRequestHandler) requestLogger(id string) DebugLogger {
+	if id == "" {
+		return drh.logger
+	}
+	return &requestLogger{drh.logger, requestID(id)}
+}
+
+/*
+requestID is the ID of a request which is printed as a log line prefix.
+*/
+type requestID string
+
+/*
+String returns the log line prefix of this request ID.
+*/
+func (rid requestID) String() string {
+	return fmt.Sprintf("[%v] ", string(rid))
+}
+
+/*
+requestLogger is a DebugLogger which prefixes all log lines with a request ID.
+*/
+type requestLogger struct {
+	DebugLogger           // Underlying logger
+	id          requestID // Request ID
+}
+
+/*
+PrintDebug prints debug output prefixed with the request ID.
+*/
+func (rl *requestLogger) PrintDebug(v ...interface{}) {
+	rl.DebugLogger.PrintDebug(append([]interface{}{rl.id}, v...)...)
+}
+
+/*
+nullLogger is a DebugLogger which discards all output.
+*/
+type nullLogger struct {
+}
+
+/*
+IsDebugOutputEnabled returns false.
+*/
+func (nl *nullLogger) IsDebugOutputEnabled() bool {
+	return false
+}
+
+/*
+PrintDebug does nothing.
+*/
+func (nl *nullLogger) PrintDebug(v ...interface{}) {
+}
+
 /*
 HandleRequest handles requests from streaming clients. It tries to extract
 the path and if meta data is supported. Once a request has been successfully
@@ -107,7 +483,12 @@ finishes.
 */
 func (drh *DefaultRequestHandler) HandleRequest(c net.Conn, nerr net.Error) {
 
-	drh.logger.PrintDebug("Handling request from: ", c.RemoteAddr())
+	// Give the request an ID which is included in all log lines
+
+	id := newRequestID()
+	logger := drh.requestLogger(id)
+
+	logger.PrintDebug("Handling request from: ", c.RemoteAddr())
 
 	defer func() {
 		c.Close()
@@ -116,13 +497,13 @@ func (drh *DefaultRequestHandler) HandleRequest(c net.Conn, nerr net.Error) {
 	// Check if there was an error
 
 	if nerr != nil {
-		drh.logger.PrintDebug(nerr)
+		logger.PrintDebug(nerr)
 		return
 	}
 
 	buf, err := drh.decodeRequestHeader(c)
 	if err != nil {
-		drh.logger.PrintDebug(err)
+		logger.PrintDebug(err)
 		return
 	}
 
@@ -137,18 +518,98 @@ func (drh *DefaultRequestHandler) HandleRequest(c net.Conn, nerr net.Error) {
 		clientString, _, _ = net.SplitHostPort(c.RemoteAddr().String())
 	}
 
-	drh.logger.PrintDebug("Client:", c.RemoteAddr(), " Request:", bufStr)
+	// Count the send bytes if completed requests should be logged
+
+	accessPath, accessUser := "-", "-"
+
+	if drh.AccessLog != nil {
+		start := drh.now()
+		cc := &countingConn{Conn: c}
+		c = cc
+
+		defer func() {
+			drh.writeAccessLog(clientString, accessUser, accessPath, start, cc.written)
+		}()
+	}
+
+	logger.PrintDebug("Client:", c.RemoteAddr(), " Request:", bufStr)
 
-	if i := strings.Index(bufStr, "\r\n\r\n"); i >= 0 {
+	// Normalize line endings so clients can also use bare LF
+
+	bufStr = strings.Replace(bufStr, "\r\n", "\n", -1)
+
+	if i := strings.Index(bufStr, "\n\n"); i >= 0 {
 		var auth string
 		var ok bool
 
 		bufStr = strings.TrimSpace(bufStr[:i])
 
-		// Check authentication
+		if res := requestPathPattern.FindStringSubmatch(bufStr); len(res) > 1 {
+			accessPath = res[1]
+		}
+
+		// Answer health checks without authentication or playlist lookup
+
+		if drh.HealthPath != "" {
+
+			if res := requestPathPattern.FindStringSubmatch(bufStr); len(res) > 1 && res[1] == drh.HealthPath {
+				drh.writeHealthResponse(c)
+				return
+			}
+		}
+
+		// Refuse clients which failed to authenticate too often
+
+		if drh.authBanned(clientString) {
+			logger.PrintDebug("Refusing banned client: ", clientString)
+			drh.writeTooManyRequests(c, requestHTTPVersion(bufStr))
+			return
+		}
+
+		// Check authentication - only requests which carry authentication
+		// count as failed attempts
+
+		hasAuthHeader := requestAuthPattern.MatchString(bufStr) || requestBearerPattern.MatchString(bufStr)
+
+		if auth, bufStr, ok = drh.checkAuth(bufStr, clientString, logger); !ok {
+			if hasAuthHeader {
+				drh.recordAuthFailure(clientString, logger)
+			}
+
+			drh.writeUnauthorized(c, requestHTTPVersion(bufStr))
+			return
+
+		} else if hasAuthHeader {
+			drh.resetAuthFailures(clientString)
+		}
+
+		if auth != "" {
+			accessUser = strings.SplitN(auth, ":", 2)[0]
+		}
+
+		// Check if information about the current track was requested - paths
+		// which only end like a request for information may be streams
+
+		if strings.HasSuffix(accessPath, MetaDataPathSuffix) &&
+			drh.knownPath(strings.TrimSuffix(accessPath, MetaDataPathSuffix)) {
+
+			drh.writeMetaDataJSON(c, strings.TrimSuffix(accessPath, MetaDataPathSuffix), requestHTTPVersion(bufStr))
+			return
+		}
+
+		// Check if a list of all streams was requested
+
+		if accessPath == PlaylistsM3UPath {
+			drh.writePlaylistsM3U(c, bufStr)
+			return
+		}
+
+		// Check if the cover of the current track was requested
+
+		if strings.HasSuffix(accessPath, CoverPathSuffix) &&
+			drh.knownPath(strings.TrimSuffix(accessPath, CoverPathSuffix)) {
 
-		if auth, bufStr, ok = drh.checkAuth(bufStr, clientString); !ok {
-			drh.writeUnauthorized(c)
+			drh.writeCover(c, strings.TrimSuffix(accessPath, CoverPathSuffix), bufStr)
 			return
 		}
 
@@ -172,6 +633,60 @@ func (drh *DefaultRequestHandler) HandleRequest(c net.Conn, nerr net.Error) {
 			}
 		}
 
+		// Extract a suffix range
+
+		suffixLength := 0
+		res = requestSuffixRangePattern.FindStringSubmatch(bufStr)
+
+		if len(res) > 1 {
+
+			if l, err := strconv.Atoi(res[1]); err == nil {
+				suffixLength = l
+			}
+		}
+
+		// Extract a frame offset
+
+		frameOffset := 0
+		res = requestFrameOffsetPattern.FindStringSubmatch(bufStr)
+
+		if len(res) > 1 {
+
+			if o, err := strconv.Atoi(res[1]); err == nil {
+				frameOffset = o
+			}
+		}
+
+		// Extract a requested meta data interval
+
+		var metaDataInterval uint64
+
+		if drh.ClientMetaInt {
+
+			if res = requestMetaIntPattern.FindStringSubmatch(bufStr); len(res) > 1 {
+
+				if i, err := strconv.ParseUint(res[1], 10, 64); err == nil {
+					metaDataInterval = i
+
+					if metaDataInterval < MinClientMetaDataInterval {
+						metaDataInterval = MinClientMetaDataInterval
+					} else if metaDataInterval > MaxClientMetaDataInterval {
+						metaDataInterval = MaxClientMetaDataInterval
+					}
+				}
+			}
+		}
+
+		// Check if the client wants to receive the stream via a WebSocket
+
+		if drh.WebSocket && requestUpgradePattern.MatchString(bufStr) {
+
+			if key := requestWebSocketKeyPattern.FindStringSubmatch(bufStr); len(key) > 1 {
+				c = &webSocketConn{c, key[1]}
+				metaDataSupport = false
+			}
+		}
+
 		// Extract the path
 
 		res = requestPathPattern.FindStringSubmatch(bufStr)
@@ -180,13 +695,26 @@ func (drh *DefaultRequestHandler) HandleRequest(c net.Conn, nerr net.Error) {
 
 			// Now serve the request
 
-			drh.ServeRequest(c, res[1], metaDataSupport, offset, auth)
+			drh.ServeRequest(c, &RequestInfo{
+				Path:            res[1],
+				MetaDataSupport: metaDataSupport,
+				Offset:          offset,
+				Auth:            auth,
+				RemoteAddr:      c.RemoteAddr(),
+				Headers:         bufStr,
+				HTTPClient: !metaDataSupport && requestHTTPPattern.MatchString(bufStr) &&
+					requestAcceptPattern.MatchString(bufStr),
+				MetaDataInterval: metaDataInterval,
+				SuffixLength:     suffixLength,
+				FrameOffset:      frameOffset,
+				ID:               id,
+			})
 
 			return
 		}
 	}
 
-	drh.logger.PrintDebug("Invalid request: ", bufStr)
+	logger.PrintDebug("Invalid request: ", bufStr)
 }
 
 /*
@@ -213,7 +741,8 @@ func (drh *DefaultRequestHandler) decodeRequestHeader(c net.Conn) (*bytes.Buffer
 
 		buf.Write(rbuf[:n])
 
-		if strings.Contains(string(rbuf), "\r\n\r\n") {
+		if bufStr := buf.String(); strings.Contains(bufStr, "\r\n\r\n") ||
+			strings.Contains(bufStr, "\n\n") {
 			break
 		}
 
@@ -226,88 +755,497 @@ func (drh *DefaultRequestHandler) decodeRequestHeader(c net.Conn) (*bytes.Buffer
 /*
 defaultServeRequest is called once a request was successfully decoded.
 */
-func (drh *DefaultRequestHandler) defaultServeRequest(c net.Conn, path string, metaDataSupport bool, offset int, auth string) {
+func (drh *DefaultRequestHandler) defaultServeRequest(c net.Conn, info *RequestInfo) {
 	var writtenBytes uint64
 	var currentPlaying string
+	var lastMetaData time.Time
 	var err error
 
-	drh.logger.PrintDebug("Serve request path:", path, " Metadata support:", metaDataSupport, " Offset:", offset)
+	path, metaDataSupport, offset := info.Path, info.MetaDataSupport, info.Offset
+	logger := drh.requestLogger(info.ID)
 
-	pl := drh.PlaylistFactory.Playlist(path, drh.shuffle)
-	if pl == nil {
+	metaDataInterval := MetaDataInterval
+	if info.MetaDataInterval > 0 {
+		metaDataInterval = info.MetaDataInterval
+	}
 
-		// Stream was not found - no error checking here (don't care)
+	// A meta data interval of 0 would send nothing but meta data
 
-		drh.writeStreamNotFoundResponse(c)
-		return
+	if metaDataSupport && metaDataInterval == 0 {
+		logger.PrintDebug("Warning: Meta data interval is 0 - sending no meta data")
+		metaDataSupport = false
 	}
 
-	err = drh.writeStreamStartResponse(c, pl.Name(), pl.ContentType(), metaDataSupport)
+	logger.PrintDebug("Serve request path:", path, " Metadata support:", metaDataSupport, " Offset:", offset)
 
-	frameOffset := offset
+	wsc, isWebSocket := c.(*webSocketConn)
 
-	for {
-		for !pl.Finished() {
+	// Check that the handler can actually serve playlists
 
-			if drh.logger.IsDebugOutputEnabled() {
-				playingString := fmt.Sprintf("%v - %v", pl.Title(), pl.Artist())
+	pf := drh.playlistFactory()
 
-				if playingString != currentPlaying {
-					currentPlaying = playingString
-					drh.logger.PrintDebug("Written bytes: ", writtenBytes)
-					drh.logger.PrintDebug("Sending: ", currentPlaying)
-				}
-			}
+	if pf == nil {
 
-			// Check if there were any errors
+		if isWebSocket {
+			c = wsc.Conn
+		}
 
-			if err != nil {
-				drh.logger.PrintDebug(err)
-				return
-			}
+		logger.PrintDebug("Error: No playlist factory configured - cannot serve path: ", path)
+		drh.writeInternalServerError(c)
+		return
+	}
 
-			frameOffset, writtenBytes, err = drh.writeFrame(c, pl, frameOffset,
-				writtenBytes, metaDataSupport)
-		}
+	pl := pf.Playlist(path, drh.shuffle)
+	if pl == nil {
 
-		// Handle looping - do not loop if close returns an error
+		// Stream was not found - no error checking here (don't care)
 
-		if pl.Close() != nil || !drh.loop {
-			break
-		} else if drh.LoopTimes != -1 {
-			drh.LoopTimes--
-			if drh.LoopTimes == 0 {
-				break
-			}
+		if isWebSocket {
+			c = wsc.Conn
 		}
-	}
 
-	drh.logger.PrintDebug("Serve request path:", path, " complete")
-}
+		drh.writeStreamNotFoundResponse(c, requestHTTPVersion(info.Headers))
+		return
+	}
 
-/*
-prepareFrame prepares a frame before it can be written to a client.
-*/
-func (drh *DefaultRequestHandler) prepareFrame(c net.Conn, pl Playlist, frameOffset int,
-	writtenBytes uint64, metaDataSupport bool) ([]byte, int, error) {
+	// Release the resources of the playlist once the stream has finished
 
-	frame, err := pl.Frame()
+	defer pl.Close()
 
-	// Handle offsets
+	// Translate a suffix range into an absolute offset - this requires a known size
 
-	if frameOffset > 0 && err == nil {
+	if info.SuffixLength > 0 {
+		var size int64 = -1
 
-		for frameOffset > len(frame) && err == nil {
-			frameOffset -= len(frame)
-			frame, err = pl.Frame()
+		if spl, ok := pl.(SizedPlaylist); ok {
+			size = spl.Size()
 		}
 
-		if err == nil {
-			frame = frame[frameOffset:]
-			frameOffset = 0
+		if size < 0 {
 
-			if len(frame) == 0 {
-				frame, err = pl.Frame()
+			if isWebSocket {
+				c = wsc.Conn
+			}
+
+			logger.PrintDebug("Cannot satisfy suffix range of ", info.SuffixLength, " bytes for playlist of unknown size")
+			drh.writeRangeNotSatisfiableResponse(c)
+			return
+		}
+
+		offset = 0
+		if int64(info.SuffixLength) < size {
+			offset = int(size - int64(info.SuffixLength))
+		}
+	}
+
+	// Resume the stream of a reconnecting client at its last position
+
+	resumeKey := ""
+
+	if drh.ResumeStreams && info.RemoteAddr != nil {
+		resumeKey = clientIP(info.RemoteAddr) + " " + path
+
+		if offset == 0 && info.SuffixLength == 0 && info.FrameOffset == 0 {
+
+			if pos, ok := drh.resumePositions.Get(resumeKey); ok {
+				offset = pos.(int)
+
+				if spl, ok := pl.(SizedPlaylist); ok {
+					if size := spl.Size(); size >= 0 && int64(offset) >= size {
+						offset = 0
+					}
+				}
+
+				logger.PrintDebug("Resuming stream at offset: ", offset)
+			}
+		}
+	}
+
+	// Check if the requested offset can be satisfied
+
+	if spl, ok := pl.(SizedPlaylist); ok && offset > 0 {
+
+		if size := spl.Size(); size >= 0 && int64(offset) >= size {
+
+			if isWebSocket {
+				c = wsc.Conn
+			}
+
+			logger.PrintDebug("Requested offset ", offset, " exceeds playlist size ", size)
+			drh.writeRangeNotSatisfiableResponse(c)
+			return
+		}
+	}
+
+	// Skip whole frames - the byte offset is applied afterwards
+
+	position := offset
+
+	for i := 0; i < info.FrameOffset && !pl.Finished(); i++ {
+		if frame, _ := pl.Frame(); frame != nil {
+			position += len(frame)
+			pl.ReleaseFrame(frame)
+		}
+	}
+
+	// Jump directly to the byte offset if the playlist supports it - other
+	// playlists discard the data before the offset
+
+	if spl, ok := pl.(SeekablePlaylist); ok && offset > 0 && info.FrameOffset == 0 {
+		if serr := spl.SeekTo(int64(offset)); serr == nil {
+			offset = 0
+		} else {
+			logger.PrintDebug("Could not seek to offset ", offset, ": ", serr)
+		}
+	}
+
+	// Remember the position in the playlist if the stream is interrupted
+	// (a negative position is unknown or the playlist has ended)
+
+	if resumeKey != "" {
+		defer func() {
+			if position >= 0 {
+				drh.resumePositions.Put(resumeKey, position)
+			} else {
+				drh.resumePositions.Remove(resumeKey)
+			}
+		}()
+	}
+
+	// Refuse the client if the playlist has already reached its maximum number of listeners
+
+	maxListeners := 0
+	if lpl, ok := pl.(ListenerLimitPlaylist); ok {
+		maxListeners = lpl.MaxListeners()
+	}
+
+	if !drh.startListener(pl.Name(), maxListeners) {
+
+		if isWebSocket {
+			c = wsc.Conn
+		}
+
+		logger.PrintDebug("Maximum number of listeners (", maxListeners, ") reached for playlist: ", pl.Name())
+		drh.writeServerFullResponse(c, isWebSocket || (drh.HTTPCompatMode && info.HTTPClient))
+		return
+	}
+	defer drh.stopListener(pl.Name())
+
+	// Limit the data rate of the connection
+
+	if drh.MaxBytesPerSecond > 0 {
+		if isWebSocket {
+			wsc.Conn = newThrottledConn(wsc.Conn, drh.MaxBytesPerSecond, drh.now, drh.sleep)
+		} else {
+			c = newThrottledConn(c, drh.MaxBytesPerSecond, drh.now, drh.sleep)
+		}
+	}
+
+	// Count the send bytes for the disconnect callback
+
+	var counter *countingConn
+
+	if drh.OnListenerDisconnect != nil {
+		if isWebSocket {
+			counter = &countingConn{Conn: wsc.Conn}
+			wsc.Conn = counter
+		} else {
+			counter = &countingConn{Conn: c}
+			c = counter
+		}
+	}
+
+	if isWebSocket {
+		err = wsc.handshake()
+	} else {
+
+		// Coalesce small writes - the buffer is flushed after the headers and
+		// after each frame
+
+		bc := &bufferedConn{c, bufio.NewWriterSize(c, FrameSize)}
+		c = bc
+
+		chunked := drh.ChunkedHTTP && info.HTTPClient
+
+		err = drh.writeStreamStartResponse(c, displayName(pl), pl.ContentType(), metaDataSupport,
+			metaDataInterval, (drh.HTTPCompatMode && info.HTTPClient) || chunked)
+
+		// Send every flushed frame as a HTTP chunk after the headers
+
+		if chunked && err == nil {
+			cc := &chunkedConn{bc.Conn}
+			bc.Conn = cc
+			bc.w.Reset(cc)
+
+			defer func() {
+				if err == nil {
+					cc.Conn.Write([]byte("0\r\n\r\n"))
+				}
+			}()
+		}
+
+		// Send the current title right away - the meta data interval starts
+		// after this block
+
+		if err == nil && metaDataSupport && drh.SendInitialMetadata {
+			drh.writeStreamMetaData(c, pl)
+			lastMetaData = drh.now()
+			err = drh.flushClient(c)
+		}
+	}
+
+	// The current track and skips are shared by all paths of the playlist
+
+	name := drh.streamPlaylistName(path, pl)
+
+	drh.startNowPlaying(name)
+	defer drh.stopNowPlaying(name)
+
+	connID := drh.startConnection(info.ID, path, clientIP(info.RemoteAddr))
+	defer drh.stopConnection(connID)
+
+	if drh.OnListenerConnect != nil {
+		drh.OnListenerConnect(path, clientIP(info.RemoteAddr))
+	}
+
+	if counter != nil {
+		defer func() {
+			drh.OnListenerDisconnect(path, clientIP(info.RemoteAddr), counter.written)
+		}()
+	}
+
+	// Watch for clients which close the connection - WebSocket clients are
+	// not watched as they may send control frames
+
+	var disconnected <-chan struct{}
+
+	if drh.DetectDisconnect && !isWebSocket && err == nil {
+		disconnected = watchDisconnect(c)
+	}
+
+	// Playlists may override the looping of the handler - the number of
+	// loops is counted per connection
+
+	handlerLoopTimes := drh.LoopTimes
+	loop, loopTimes := drh.loop, &handlerLoopTimes
+
+	if lpl, ok := pl.(LoopingPlaylist); ok {
+		if plLoop, plLoopTimes := lpl.Loop(); plLoopTimes != 0 {
+			loop, loopTimes = plLoop, &plLoopTimes
+		}
+	}
+
+	// Stream the pre-roll - streams which continue at an offset start
+	// directly with the playlist
+
+	if drh.PreRoll != "" && err == nil && position == 0 && info.FrameOffset == 0 {
+		writtenBytes, err = drh.writePreRoll(c, pl, writtenBytes, metaDataSupport,
+			metaDataInterval, &lastMetaData, logger)
+	}
+
+	frameOffset := offset
+	skipped := drh.skipCounter(name)
+	deadline := drh.now().Add(drh.MaxStreamDuration)
+
+	for {
+		for !pl.Finished() {
+
+			playingString := fmt.Sprintf("%v - %v", pl.Title(), pl.Artist())
+
+			if playingString != currentPlaying {
+				currentPlaying = playingString
+				logger.PrintDebug("Written bytes: ", writtenBytes)
+				logger.PrintDebug("Sending: ", currentPlaying)
+
+				drh.notifyTrackChange(path, pl)
+				drh.updateNowPlaying(name, pl)
+
+				if isWebSocket && err == nil {
+
+					// WebSocket clients get the meta data as a text message
+
+					err = wsc.WriteMetaData(pl)
+				}
+			}
+
+			// Check if there were any errors
+
+			if err != nil {
+				logger.PrintDebug(err)
+				drh.countConnection(&drh.stats.WriteFailures)
+				return
+			}
+
+			// Check if the client has closed the connection
+
+			select {
+			case <-disconnected:
+				logger.PrintDebug("Client disconnected from path:", path)
+				drh.countConnection(&drh.stats.Disconnected)
+				return
+			default:
+			}
+
+			// Check if the client has been streaming for too long
+
+			if drh.MaxStreamDuration > 0 && drh.now().After(deadline) {
+				logger.PrintDebug("Maximum stream duration reached for path:", path)
+				drh.countConnection(&drh.stats.Completed)
+				return
+			}
+
+			// Check if the current track should be skipped
+
+			if skip := drh.skipCounter(name); skip != skipped {
+				skipped = skip
+
+				if spl, ok := pl.(SkippablePlaylist); ok {
+					logger.PrintDebug("Skipping: ", currentPlaying)
+					spl.Skip()
+					position = -1
+					continue
+				}
+			}
+
+			var n int
+
+			frameOffset, writtenBytes, n, err = drh.writeFrame(c, pl, frameOffset,
+				writtenBytes, metaDataSupport, metaDataInterval, &lastMetaData, logger)
+
+			drh.updateConnection(connID, currentPlaying, n)
+
+			if position >= 0 {
+				position += n
+			}
+		}
+
+		// Handle looping - do not loop if the playlist cannot be played again
+
+		if !loop {
+			break
+		} else if *loopTimes != -1 {
+			*loopTimes--
+			if *loopTimes == 0 {
+				break
+			}
+		}
+
+		if resetPlaylist(pl) != nil {
+			break
+		}
+
+		position = 0
+	}
+
+	position = -1
+
+	// Keep the connection open after the end of the playlist if requested
+
+	if err == nil && (drh.PostEndBehavior == PostEndSilence || drh.PostEndBehavior == PostEndHold) {
+		var data []byte
+
+		logger.PrintDebug("Playlist ended - ", drh.PostEndBehavior, " until client disconnects from path:", path)
+
+		if drh.PostEndBehavior == PostEndSilence {
+			data = make([]byte, FrameSize)
+		} else {
+			data = []byte{0}
+		}
+
+		for err == nil {
+
+			select {
+			case <-disconnected:
+				logger.PrintDebug("Client disconnected from path:", path)
+				drh.countConnection(&drh.stats.Disconnected)
+				return
+			default:
+			}
+
+			if drh.MaxStreamDuration > 0 && drh.now().After(deadline) {
+				logger.PrintDebug("Maximum stream duration reached for path:", path)
+				drh.countConnection(&drh.stats.Completed)
+				return
+			}
+
+			if drh.PostEndBehavior == PostEndHold {
+				drh.sleep(PostEndKeepAliveInterval)
+			}
+
+			writtenBytes, err = drh.writeFrameData(c, pl, data, writtenBytes,
+				metaDataSupport, metaDataInterval, &lastMetaData)
+		}
+
+		logger.PrintDebug(err)
+	}
+
+	// The last frame of a playlist may also fail
+
+	if err != nil {
+		drh.countConnection(&drh.stats.WriteFailures)
+	} else {
+		drh.countConnection(&drh.stats.PlaylistEnd)
+	}
+
+	logger.PrintDebug("Serve request path:", path, " complete")
+}
+
+/*
+resetPlaylist rewinds a playlist so it can be played again. Playlists which
+cannot be reset are rewound by closing them.
+*/
+func resetPlaylist(pl Playlist) error {
+	if rpl, ok := pl.(ResettablePlaylist); ok {
+		return rpl.Reset()
+	}
+
+	return pl.Close()
+}
+
+/*
+watchDisconnect reads and discards all data which is send by a client. The
+returned channel is closed once the connection has been closed.
+*/
+func watchDisconnect(c net.Conn) <-chan struct{} {
+	done := make(chan struct{})
+
+	go func() {
+		buf := make([]byte, 512)
+
+		for {
+			if _, err := c.Read(buf); err != nil {
+				close(done)
+				return
+			}
+		}
+	}()
+
+	return done
+}
+
+/*
+prepareFrame prepares a frame before it can be written to a client.
+*/
+func (drh *DefaultRequestHandler) prepareFrame(c net.Conn, pl Playlist, frameOffset int,
+	writtenBytes uint64, metaDataSupport bool, logger DebugLogger) ([]byte, int, error) {
+
+	frame, err := pl.Frame()
+
+	// Handle offsets
+
+	if frameOffset > 0 && err == nil {
+
+		for frameOffset > len(frame) && err == nil {
+			frameOffset -= len(frame)
+			frame, err = pl.Frame()
+		}
+
+		if err == nil {
+			frame = frame[frameOffset:]
+			frameOffset = 0
+
+			if len(frame) == 0 {
+				frame, err = pl.Frame()
 			}
 		}
 	}
@@ -315,13 +1253,19 @@ func (drh *DefaultRequestHandler) prepareFrame(c net.Conn, pl Playlist, frameOff
 	if frame == nil {
 
 		if !pl.Finished() {
-			drh.logger.PrintDebug(fmt.Sprintf("Empty frame for: %v - %v (Error: %v)", pl.Title(), pl.Artist(), err))
+			logger.PrintDebug(fmt.Sprintf("Empty frame for: %v - %v (Error: %v)", pl.Title(), pl.Artist(), err))
+		}
+
+		// The end of the playlist is not an error - the playlist may be looped
+
+		if err == ErrPlaylistEnd {
+			err = nil
 		}
 
 	} else if err != nil {
 
 		if err != ErrPlaylistEnd {
-			drh.logger.PrintDebug(fmt.Sprintf("Error while retrieving playlist data: %v", err))
+			logger.PrintDebug(fmt.Sprintf("Error while retrieving playlist data: %v", err))
 		}
 
 		err = nil
@@ -331,130 +1275,613 @@ func (drh *DefaultRequestHandler) prepareFrame(c net.Conn, pl Playlist, frameOff
 }
 
 /*
-writeFrame writes a frame to a client.
+writeFrame writes a frame to a client. Returns the new frame offset, the number
+of written bytes since the last meta data block, the number of written audio
+bytes of this frame and an error if the frame could not be written. The time
+of the last meta data block with a title is kept in lastMetaData (may be nil).
 */
 func (drh *DefaultRequestHandler) writeFrame(c net.Conn, pl Playlist, frameOffset int,
-	writtenBytes uint64, metaDataSupport bool) (int, uint64, error) {
+	writtenBytes uint64, metaDataSupport bool, metaDataInterval uint64,
+	lastMetaData *time.Time, logger DebugLogger) (int, uint64, int, error) {
 
-	frame, frameOffset, err := drh.prepareFrame(c, pl, frameOffset, writtenBytes, metaDataSupport)
+	frame, frameOffset, err := drh.prepareFrame(c, pl, frameOffset, writtenBytes, metaDataSupport, logger)
 	if frame == nil {
-		return frameOffset, writtenBytes, err
+		return frameOffset, writtenBytes, 0, err
 	}
 
-	// Check if meta data should be send
+	writtenBytes, err = drh.writeFrameData(c, pl, frame, writtenBytes, metaDataSupport,
+		metaDataInterval, lastMetaData)
 
-	if metaDataSupport && writtenBytes+uint64(len(frame)) >= MetaDataInterval {
+	frameLength := len(frame)
 
-		// Write rest data before sending meta data
+	pl.ReleaseFrame(frame)
 
-		if preMetaDataLength := MetaDataInterval - writtenBytes; preMetaDataLength > 0 {
-			if err == nil {
+	if err != nil {
+		frameLength = 0
+	}
 
-				_, err = c.Write(frame[:preMetaDataLength])
+	return frameOffset, writtenBytes, frameLength, err
+}
 
-				frame = frame[preMetaDataLength:]
-				writtenBytes += preMetaDataLength
-			}
-		}
+/*
+writeFrameData writes the data of a frame and all due meta data blocks to a
+client. Returns the number of written bytes since the last meta data block and
+an error if the data could not be written.
+*/
+func (drh *DefaultRequestHandler) writeFrameData(c net.Conn, pl Playlist, frame []byte,
+	writtenBytes uint64, metaDataSupport bool, metaDataInterval uint64,
+	lastMetaData *time.Time) (uint64, error) {
+	var err error
 
-		if err == nil {
+	data := frame
+	out := frame
+	metaDataSupport = metaDataSupport && metaDataInterval > 0
+	coalesce := metaDataSupport && writtenBytes+uint64(len(data)) >= metaDataInterval
 
-			// Write meta data - no error checking (next write should fail)
+	// Check if meta data should be send - a frame may contain several
+	// meta data interval boundaries. The data before and after each meta
+	// data block is combined with the block so the client gets a single write.
 
-			drh.writeStreamMetaData(c, pl)
+	if coalesce {
+		out = make([]byte, 0, len(frame)+drh.metaDataSize()+1)
+	}
 
-			// Write rest of the frame
+	for metaDataSupport && writtenBytes+uint64(len(data)) >= metaDataInterval {
 
-			c.Write(frame)
-			writtenBytes += uint64(len(frame))
+		// The written bytes may already exceed the interval (e.g. if the
+		// interval was lowered) - the meta data is then sent immediately
+
+		var preMetaDataLength uint64
+
+		if writtenBytes < metaDataInterval {
+			preMetaDataLength = metaDataInterval - writtenBytes
 		}
 
-		writtenBytes -= MetaDataInterval
+		out = append(out, data[:preMetaDataLength]...)
+		data = data[preMetaDataLength:]
 
-	} else {
+		if drh.MinMetadataGap > 0 && lastMetaData != nil && !lastMetaData.IsZero() &&
+			drh.now().Sub(*lastMetaData) < drh.MinMetadataGap {
 
-		// Just write the frame to the client
+			// Send an empty block - clients keep the previous title
 
-		if err == nil {
+			out = append(out, 0)
 
-			clientWritten, _ := c.Write(frame)
+		} else {
 
-			// Abort if the client does not accept more data
+			out = append(out, drh.streamMetaData(pl)...)
 
-			if clientWritten == 0 && len(frame) > 0 {
-				return frameOffset, writtenBytes,
-					fmt.Errorf("Could not write to client - closing connection")
+			if lastMetaData != nil {
+				*lastMetaData = drh.now()
 			}
 		}
 
-		pl.ReleaseFrame(frame)
+		writtenBytes = 0
+	}
+
+	if coalesce {
+		out = append(out, data...)
+	}
+
+	// Write the frame to the client
+
+	if err == nil && len(out) > 0 {
+
+		clientWritten, _ := drh.writeClient(c, out)
+
+		// Abort if the client does not accept more data
+
+		if clientWritten == 0 {
+			err = fmt.Errorf("Could not write to client - closing connection")
+		} else {
+			writtenBytes += uint64(len(data))
+		}
+	}
+
+	if err == nil {
+		err = drh.flushClient(c)
+	}
+
+	return writtenBytes, err
+}
 
-		writtenBytes += uint64(len(frame))
+/*
+displayName returns the name of a playlist which is shown to clients.
+*/
+func displayName(pl Playlist) string {
+	if dpl, ok := pl.(DisplayNamePlaylist); ok {
+		if name := dpl.DisplayName(); name != "" {
+			return name
+		}
 	}
 
-	return frameOffset, writtenBytes, err
+	return pl.Name()
 }
 
 /*
 writeStreamMetaData writes meta data information into the stream.
 */
 func (drh *DefaultRequestHandler) writeStreamMetaData(c net.Conn, playlist Playlist) {
-	streamTitle := fmt.Sprintf("StreamTitle='%v - %v';", playlist.Title(), playlist.Artist())
+	drh.writeClient(c, drh.streamMetaData(playlist))
+}
+
+/*
+MetadataEncoder encodes information about the current track into a meta data
+block which is sent to clients after every meta data interval.
+*/
+type MetadataEncoder interface {
+
+	/*
+		Encode returns the meta data block for the current track of a playlist.
+		The meta data in the block should not exceed maxSize bytes.
+	*/
+	Encode(pl Playlist, maxSize int) []byte
+}
+
+/*
+icyMetadataEncoder encodes meta data blocks in the ICY format.
+*/
+type icyMetadataEncoder struct {
+	drh *DefaultRequestHandler // Request handler which formats the stream title
+}
+
+/*
+Encode returns an ICY meta data block for the current track of a playlist.
+*/
+func (ime *icyMetadataEncoder) Encode(pl Playlist, maxSize int) []byte {
+	return ime.drh.icyMetaData(pl, maxSize)
+}
+
+/*
+streamMetaData returns a meta data block with information about the current track.
+*/
+func (drh *DefaultRequestHandler) streamMetaData(playlist Playlist) []byte {
+	if drh.MetadataEncoder != nil {
+		return drh.MetadataEncoder.Encode(playlist, drh.metaDataSize())
+	}
+
+	return drh.icyMetaData(playlist, drh.metaDataSize())
+}
+
+/*
+metaDataSize returns the maximum size for meta data. Unset sizes use the default
+MaxMetaDataSize. The size is limited to what an ICY meta data block can hold.
+*/
+func (drh *DefaultRequestHandler) metaDataSize() int {
+	size := drh.MaxMetaDataSize
+
+	if size <= 0 {
+		size = MaxMetaDataSize
+	}
+
+	// Truncated titles need room for the closing quote and semicolon
+
+	if size < 2 {
+		size = 2
+	} else if size > maxICYMetaDataSize {
+		size = maxICYMetaDataSize
+	}
+
+	return size
+}
+
+/*
+icyMetaData returns an ICY meta data block with information about the current
+track. The stream title is truncated to maxSize bytes.
+*/
+func (drh *DefaultRequestHandler) icyMetaData(playlist Playlist, maxSize int) []byte {
+	streamTitle := fmt.Sprintf("StreamTitle='%v';", drh.streamTitle(playlist))
+
+	// Add a stream URL if the playlist provides one
+
+	if upl, ok := playlist.(StreamURLPlaylist); ok {
+		if url := upl.StreamURL(); url != "" {
+			streamTitle += fmt.Sprintf("StreamUrl='%v';", url)
+		}
+	}
 
 	// Truncate stream title if necessary
 
-	if len(streamTitle) > MaxMetaDataSize {
-		streamTitle = streamTitle[:MaxMetaDataSize-2] + "';"
+	if len(streamTitle) > maxSize {
+		streamTitle = streamTitle[:maxSize-2] + "';"
 	}
 
 	// Calculate the meta data frame size as a multiple of 16
 
 	metaDataFrameSize := byte(math.Ceil(float64(len(streamTitle)) / 16.0))
 
-	// Write meta data to the client
+	metaDataLen := 16*int(metaDataFrameSize) + 1
 
-	metaData := make([]byte, 16.0*metaDataFrameSize+1, 16.0*metaDataFrameSize+1)
+	metaData := make([]byte, metaDataLen, metaDataLen)
 	metaData[0] = metaDataFrameSize
 
 	copy(metaData[1:], streamTitle)
 
-	c.Write(metaData)
+	return metaData
+}
+
+/*
+streamTitle builds the stream title of the current track with the StreamTitleTemplate.
+The default format is used if no template is set or the template cannot be executed.
+The title is shortened to MaxTitleLength characters.
+*/
+func (drh *DefaultRequestHandler) streamTitle(playlist Playlist) string {
+	var title []rune
+
+	if prl, ok := playlist.(*preRollPlaylist); ok {
+		title = []rune(prl.title)
+	} else {
+		title = []rune(drh.formatStreamTitle(playlist))
+	}
+
+	if drh.MaxTitleLength > 0 && len(title) > drh.MaxTitleLength {
+		return string(title[:drh.MaxTitleLength-1]) + "…"
+	}
+
+	return string(title)
+}
+
+/*
+formatStreamTitle formats the stream title of the current track.
+*/
+func (drh *DefaultRequestHandler) formatStreamTitle(playlist Playlist) string {
+	var buf bytes.Buffer
+
+	data := struct {
+		Title  string
+		Artist string
+		Album  string
+		Name   string
+	}{playlist.Title(), playlist.Artist(), "", playlist.Name()}
+
+	if apl, ok := playlist.(AlbumPlaylist); ok {
+		data.Album = apl.Album()
+	}
+
+	if drh.StreamTitleTemplate != "" {
+		if tmpl, err := drh.parsedStreamTitleTemplate(); err == nil {
+			if err = tmpl.Execute(&buf, data); err == nil {
+				return buf.String()
+			}
+		}
+	}
+
+	return fmt.Sprintf("%v - %v", data.Title, data.Artist)
+}
+
+/*
+parsedStreamTitleTemplate returns the parsed StreamTitleTemplate. The template
+is only parsed again if it was changed.
+*/
+func (drh *DefaultRequestHandler) parsedStreamTitleTemplate() (*template.Template, error) {
+	drh.streamTitleTmplLock.Lock()
+	defer drh.streamTitleTmplLock.Unlock()
+
+	if drh.streamTitleTmpl == nil || drh.streamTitleTmplSrc != drh.StreamTitleTemplate {
+		tmpl, err := template.New("streamtitle").Parse(drh.StreamTitleTemplate)
+		if err != nil {
+			return nil, err
+		}
+
+		drh.streamTitleTmpl = tmpl
+		drh.streamTitleTmplSrc = drh.StreamTitleTemplate
+	}
+
+	return drh.streamTitleTmpl, nil
+}
+
+/*
+writeClient writes stream data to a client. The write fails if the client does
+not accept the data within FrameWriteTimeout.
+*/
+func (drh *DefaultRequestHandler) writeClient(c net.Conn, data []byte) (int, error) {
+
+	if drh.FrameWriteTimeout > 0 {
+		c.SetWriteDeadline(time.Now().Add(drh.FrameWriteTimeout))
+	}
+
+	n, err := c.Write(data)
+
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return 0, fmt.Errorf("Could not write to client - closing connection")
+	}
+
+	return n, err
+}
+
+/*
+flushClient sends all buffered data to a client. The flush fails if the client
+does not accept the data within FrameWriteTimeout.
+*/
+func (drh *DefaultRequestHandler) flushClient(c net.Conn) error {
+	bc, ok := c.(*bufferedConn)
+	if !ok {
+		return nil
+	}
+
+	if drh.FrameWriteTimeout > 0 {
+		c.SetWriteDeadline(time.Now().Add(drh.FrameWriteTimeout))
+	}
+
+	err := bc.w.Flush()
+
+	if nerr, ok := err.(net.Error); (ok && nerr.Timeout()) || err == io.ErrShortWrite {
+		err = fmt.Errorf("Could not write to client - closing connection")
+	}
+
+	return err
+}
+
+/*
+writeAccessLog writes a line for a completed request to the access log. The line
+contains the client address, the authenticated user, the time of the request,
+the requested path, the number of send bytes and the duration of the request.
+*/
+func (drh *DefaultRequestHandler) writeAccessLog(client, user, path string, start time.Time, written uint64) {
+	fmt.Fprintf(drh.AccessLog, "%v - %v [%v] \"GET %v\" %v %v\n", client, user,
+		start.Format("02/Jan/2006:15:04:05 -0700"), path, written, drh.now().Sub(start).Round(time.Millisecond))
+}
+
+/*
+clientIP returns the IP of a client address (an empty string if the address is
+not known).
+*/
+func clientIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+
+	return addr.String()
 }
 
 /*
-writeStreamStartResponse writes the start response to the client.
+countingConn is a connection which counts all written bytes.
+*/
+type countingConn struct {
+	net.Conn        // Underlying client connection
+	written  uint64 // Number of written bytes
+}
+
+/*
+Write writes data and counts the written bytes.
+*/
+func (cc *countingConn) Write(b []byte) (int, error) {
+	n, err := cc.Conn.Write(b)
+	cc.written += uint64(n)
+	return n, err
+}
+
+/*
+throttledConn is a connection which never sends more than a maximum number of
+bytes per second. Writes are delayed until the average data rate since the
+first write drops below the maximum.
+*/
+type throttledConn struct {
+	net.Conn                     // Underlying client connection
+	maxRate  uint64              // Maximum number of bytes per second
+	start    time.Time           // Time of the first write
+	written  uint64              // Number of bytes written since the first write
+	now      func() time.Time    // Function which returns the current time
+	sleep    func(time.Duration) // Function which pauses the current goroutine
+}
+
+/*
+newThrottledConn creates a new throttled connection.
+*/
+func newThrottledConn(c net.Conn, maxRate uint64, now func() time.Time,
+	sleep func(time.Duration)) *throttledConn {
+
+	return &throttledConn{Conn: c, maxRate: maxRate, now: now, sleep: sleep}
+}
+
+/*
+Write writes data and waits until the data rate is below the maximum.
+*/
+func (tc *throttledConn) Write(b []byte) (int, error) {
+
+	if tc.start.IsZero() {
+		tc.start = tc.now()
+	}
+
+	n, err := tc.Conn.Write(b)
+	tc.written += uint64(n)
+
+	// Wait until the written data is allowed by the maximum rate
+
+	expected := time.Duration(float64(tc.written) / float64(tc.maxRate) * float64(time.Second))
+
+	if wait := expected - tc.now().Sub(tc.start); wait > 0 {
+		tc.sleep(wait)
+	}
+
+	return n, err
+}
+
+/*
+bufferedConn is a connection which buffers all written data until it is flushed.
+*/
+type bufferedConn struct {
+	net.Conn               // Underlying client connection
+	w        *bufio.Writer // Buffer for written data
+}
+
+/*
+Write writes data into the buffer.
+*/
+func (bc *bufferedConn) Write(b []byte) (int, error) {
+	return bc.w.Write(b)
+}
+
+/*
+chunkedConn is a connection which sends every write as a HTTP chunk.
+*/
+type chunkedConn struct {
+	net.Conn // Underlying client connection
+}
+
+/*
+Write writes data as a single chunk.
+*/
+func (cc *chunkedConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	chunk := make([]byte, 0, len(b)+12)
+	chunk = append(chunk, fmt.Sprintf("%x\r\n", len(b))...)
+	chunk = append(chunk, b...)
+	chunk = append(chunk, "\r\n"...)
+
+	if _, err := cc.Conn.Write(chunk); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+/*
+writeStreamStartResponse writes the start response to the client. HTTP clients
+get a HTTP status line, all other clients an ICY status line.
 */
 func (drh *DefaultRequestHandler) writeStreamStartResponse(c net.Conn,
-	name, contentType string, metaDataSupport bool) error {
+	name, contentType string, metaDataSupport bool, metaDataInterval uint64, httpClient bool) error {
+
+	if httpClient {
+		c.Write([]byte("HTTP/1.1 200 OK\r\n"))
+	} else if drh.StatusLine != "" {
+		c.Write([]byte(drh.StatusLine + "\r\n"))
+	} else {
+		c.Write([]byte("ICY 200 OK\r\n"))
+	}
 
-	c.Write([]byte("ICY 200 OK\r\n"))
 	c.Write([]byte(fmt.Sprintf("Content-Type: %v\r\n", contentType)))
+
+	// Intermediaries must not compress the audio data of HTTP responses
+	// (the Accept-Encoding header of a client is ignored)
+
+	if httpClient {
+		c.Write([]byte("Content-Encoding: identity\r\n"))
+	}
+
 	c.Write([]byte(fmt.Sprintf("icy-name: %v\r\n", name)))
 
+	if httpClient && drh.ChunkedHTTP {
+		c.Write([]byte("Transfer-Encoding: chunked\r\n"))
+	}
+
+	if drh.IcyNotice1 != "" {
+		c.Write([]byte(fmt.Sprintf("icy-notice1: %v\r\n", drh.IcyNotice1)))
+	}
+
+	if drh.IcyNotice2 != "" {
+		c.Write([]byte(fmt.Sprintf("icy-notice2: %v\r\n", drh.IcyNotice2)))
+	}
+
+	if drh.Public {
+		c.Write([]byte("icy-pub: 1\r\n"))
+	}
+
 	if metaDataSupport {
 		c.Write([]byte("icy-metadata: 1\r\n"))
-		c.Write([]byte(fmt.Sprintf("icy-metaint: %v\r\n", MetaDataInterval)))
+		c.Write([]byte(fmt.Sprintf("icy-metaint: %v\r\n", metaDataInterval)))
 	}
 
 	_, err := c.Write([]byte("\r\n"))
 
+	if err == nil {
+		err = drh.flushClient(c)
+	}
+
+	return err
+}
+
+/*
+writeHealthResponse writes the health check response to the client.
+*/
+func (drh *DefaultRequestHandler) writeHealthResponse(c net.Conn) error {
+	_, err := c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+
+	return err
+}
+
+/*
+requestHTTPVersion returns the HTTP version of a request. Requests without a
+version (e.g. from ICY clients) are answered with HTTP/1.1.
+*/
+func requestHTTPVersion(headers string) string {
+	if res := requestHTTPPattern.FindStringSubmatch(headers); len(res) > 1 {
+		return strings.ToUpper(res[1])
+	}
+
+	return "HTTP/1.1"
+}
+
+/*
+writeStreamNotFoundResponse writes the not found response to the client. The
+response uses the HTTP version of the request.
+*/
+func (drh *DefaultRequestHandler) writeStreamNotFoundResponse(c net.Conn, version string) error {
+	_, err := c.Write([]byte(version + " 404 Not found\r\nConnection: close\r\n\r\n"))
+
+	return err
+}
+
+/*
+writeRangeNotSatisfiableResponse writes the range not satisfiable response to the client.
+*/
+func (drh *DefaultRequestHandler) writeRangeNotSatisfiableResponse(c net.Conn) error {
+	_, err := c.Write([]byte("HTTP/1.1 416 Range Not Satisfiable\r\n\r\n"))
+
+	return err
+}
+
+/*
+writeServerFullResponse writes the response for clients which are refused
+because the requested path has too many listeners.
+*/
+func (drh *DefaultRequestHandler) writeServerFullResponse(c net.Conn, httpStatus bool) error {
+	status := "ICY 503 Server Full"
+
+	if httpStatus {
+		status = "HTTP/1.1 503 Service Unavailable"
+	}
+
+	_, err := c.Write([]byte(status + "\r\n\r\n"))
+
 	return err
 }
 
 /*
-writeStreamNotFoundResponse writes the not found response to the client.
+writeTooManyRequests writes the response for clients which are temporarily refused.
 */
-func (drh *DefaultRequestHandler) writeStreamNotFoundResponse(c net.Conn) error {
-	_, err := c.Write([]byte("HTTP/1.1 404 Not found\r\n\r\n"))
+func (drh *DefaultRequestHandler) writeTooManyRequests(c net.Conn, version string) error {
+	_, err := c.Write([]byte(fmt.Sprintf("%v 429 Too Many Requests\r\nConnection: close\r\n\r\n", version)))
 
 	return err
 }
 
 /*
-writeUnauthorized writes the Unauthorized response to the client.
+writeInternalServerError writes the internal server error response to the client.
 */
-func (drh *DefaultRequestHandler) writeUnauthorized(c net.Conn) error {
-	_, err := c.Write([]byte("HTTP/1.1 401 Authorization Required\r\nWWW-Authenticate: Basic realm=\"DudelDu Streaming Server\"\r\n\r\n"))
+func (drh *DefaultRequestHandler) writeInternalServerError(c net.Conn) error {
+	_, err := c.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n\r\n"))
+
+	return err
+}
+
+/*
+writeUnauthorized writes the Unauthorized response to the client. The response
+uses the HTTP version of the request.
+*/
+func (drh *DefaultRequestHandler) writeUnauthorized(c net.Conn, version string) error {
+	realm := strings.Replace(drh.Realm, `"`, `\"`, -1)
+
+	_, err := c.Write([]byte(fmt.Sprintf("%v 401 Authorization Required\r\nWWW-Authenticate: Basic realm=\"%v\"\r\n"+
+		"Connection: close\r\n\r\n", version, realm)))
 
 	return err
 }
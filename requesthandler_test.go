@@ -14,10 +14,13 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"regexp"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"devt.de/krotik/common/testutil"
 )
@@ -99,6 +102,27 @@ func (tp *testPlaylistFactory) Playlist(path string, shuffle bool) Playlist {
 	return nil
 }
 
+func (tp *testPlaylistFactory) DisplayName(path string) string {
+	if pl := tp.Playlist(path, false); pl != nil {
+		return displayName(pl)
+	}
+	return ""
+}
+
+func (tp *testPlaylistFactory) PlaylistName(path string) string {
+	if pl := tp.Playlist(path, false); pl != nil {
+		return pl.Name()
+	}
+	return ""
+}
+
+func (tp *testPlaylistFactory) Cover(path string) string {
+	if cpl, ok := tp.Playlist(path, false).(CoverPlaylist); ok {
+		return cpl.Cover()
+	}
+	return ""
+}
+
 var testTitle = "Test Title"
 
 /*
@@ -148,6 +172,125 @@ func (tp *testPlaylist) Close() error {
 	return nil
 }
 
+/*
+testSizedPlaylist is a playlist for testing which knows its size
+*/
+type testSizedPlaylist struct {
+	testPlaylist
+	size int64
+}
+
+func (tp *testSizedPlaylist) Size() int64 {
+	return tp.size
+}
+
+/*
+testURLPlaylist is a playlist for testing which provides a stream URL
+*/
+type testURLPlaylist struct {
+	testPlaylist
+	url string
+}
+
+func (tp *testURLPlaylist) StreamURL() string {
+	return tp.url
+}
+
+func TestRangeNotSatisfiable(t *testing.T) {
+
+	tpl := &testSizedPlaylist{testPlaylist{[][]byte{[]byte("123"), []byte("4567")}, nil, 0}, 7}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+	drh.SetDebugLogger(&TestDebugLogger{false, nil})
+
+	testConn := &testutil.ErrorTestingConnection{}
+
+	drh.defaultServeRequest(testConn, &RequestInfo{Path: "/testpath", Offset: 7})
+
+	if testConn.Out.String() != "HTTP/1.1 416 Range Not Satisfiable\r\n\r\n" {
+		t.Error("Unexpected response:", testConn.Out.String())
+		return
+	}
+
+	testConn = &testutil.ErrorTestingConnection{}
+
+	drh.defaultServeRequest(testConn, &RequestInfo{Path: "/testpath", Offset: 6})
+
+	if testConn.Out.String() != "ICY 200 OK\r\n"+
+		"Content-Type: Test/Content\r\n"+
+		"icy-name: TestPlaylist\r\n"+
+		"\r\n"+
+		"7" {
+		t.Error("Unexpected response:", testConn.Out.String())
+		return
+	}
+}
+
+func TestErrorResponseHTTPVersion(t *testing.T) {
+
+	tpl := &testPlaylist{[][]byte{[]byte("123")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+
+	request := func(req string) string {
+		testConn := &testutil.ErrorTestingConnection{}
+		testConn.In.WriteString(req)
+		drh.HandleRequest(testConn, nil)
+		return testConn.Out.String()
+	}
+
+	for _, version := range []string{"HTTP/1.0", "HTTP/1.1"} {
+
+		if res := request("GET /unknown " + version + "\r\n\r\n"); res != version+" 404 Not found\r\n"+
+			"Connection: close\r\n\r\n" {
+			t.Error("Unexpected response:", res)
+			return
+		}
+	}
+
+	// ICY clients which send no version get a HTTP/1.1 response
+
+	if res := request("GET /unknown\r\n\r\n"); res != "HTTP/1.1 404 Not found\r\nConnection: close\r\n\r\n" {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	drh = NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "web:web")
+	drh.DisableAuthReplay = true
+
+	for _, version := range []string{"HTTP/1.0", "HTTP/1.1"} {
+
+		if res := request("GET /testpath " + version + "\r\n\r\n"); res != version+" 401 Authorization Required\r\n"+
+			"WWW-Authenticate: Basic realm=\"DudelDu Streaming Server\"\r\n"+
+			"Connection: close\r\n\r\n" {
+			t.Error("Unexpected response:", res)
+			return
+		}
+	}
+}
+
+func TestNilPlaylistFactory(t *testing.T) {
+	var out bytes.Buffer
+
+	drh := NewDefaultRequestHandler(nil, false, false, "")
+	drh.SetDebugLogger(&TestDebugLogger{true, func(v ...interface{}) {
+		out.WriteString(fmt.Sprint(v...))
+		out.WriteString("\n")
+	}})
+
+	testConn := &testutil.ErrorTestingConnection{}
+
+	drh.defaultServeRequest(testConn, &RequestInfo{Path: "/testpath"})
+
+	if testConn.Out.String() != "HTTP/1.1 500 Internal Server Error\r\n\r\n" {
+		t.Error("Unexpected response:", testConn.Out.String())
+		return
+	}
+
+	if !strings.Contains(out.String(), "No playlist factory configured - cannot serve path: /testpath") {
+		t.Error("Unexpected log output:", out.String())
+		return
+	}
+}
+
 func TestRequestServing(t *testing.T) {
 
 	// Collect the print output
@@ -165,9 +308,9 @@ func TestRequestServing(t *testing.T) {
 
 	// Test a path not found
 
-	drh.defaultServeRequest(testConn, "tester", false, 0, "")
+	drh.defaultServeRequest(testConn, &RequestInfo{Path: "tester", MetaDataSupport: false, Offset: 0, Auth: ""})
 
-	if testConn.Out.String() != "HTTP/1.1 404 Not found\r\n\r\n" {
+	if testConn.Out.String() != "HTTP/1.1 404 Not found\r\nConnection: close\r\n\r\n" {
 		t.Error("Unexpected response:", testConn.Out.String())
 		return
 	}
@@ -184,7 +327,7 @@ func TestRequestServing(t *testing.T) {
 
 	out.Reset()
 
-	drh.defaultServeRequest(testConn, "/testpath", false, 0, "")
+	drh.defaultServeRequest(testConn, &RequestInfo{Path: "/testpath", MetaDataSupport: false, Offset: 0, Auth: ""})
 
 	if testConn.Out.String() != "ICY 200 OK\r\n"+
 		"Content-Type: Test/Content\r\n"+
@@ -220,7 +363,7 @@ func TestRequestServing(t *testing.T) {
 
 	testConn = &testutil.ErrorTestingConnection{}
 
-	drh.defaultServeRequest(testConn, "/testpath", true, 0, "")
+	drh.defaultServeRequest(testConn, &RequestInfo{Path: "/testpath", MetaDataSupport: true, Offset: 0, Auth: ""})
 
 	// Meta data is 3*16=48 bytes - text is 39 bytes, padding is 9 bytes
 
@@ -230,9 +373,9 @@ func TestRequestServing(t *testing.T) {
 		"icy-metadata: 1\r\n" +
 		"icy-metaint: 5\r\n" +
 		"\r\n" +
-		`12345` + string(0x03) + `StreamTitle='Test Title - Test Artist';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
-		`67012` + string(0x03) + `StreamTitle='Test Title - Test Artist';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
-		`34567` + string(0x03) + `StreamTitle='Test Title - Test Artist';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
+		`12345` + string(rune(0x03)) + `StreamTitle='Test Title - Test Artist';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
+		`67012` + string(rune(0x03)) + `StreamTitle='Test Title - Test Artist';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
+		`34567` + string(rune(0x03)) + `StreamTitle='Test Title - Test Artist';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
 		`89`) {
 
 		t.Error("Unexpected response:", testConn.Out.String())
@@ -247,7 +390,7 @@ func TestRequestServing(t *testing.T) {
 	testConn.OutErr = 5
 	out.Reset()
 
-	drh.defaultServeRequest(testConn, "/testpath", true, 0, "")
+	drh.defaultServeRequest(testConn, &RequestInfo{Path: "/testpath", MetaDataSupport: true, Offset: 0, Auth: ""})
 
 	if out.String() != "Serve request path:/testpath Metadata support:true Offset:0\n"+
 		"Written bytes: 0\n"+
@@ -275,7 +418,7 @@ func TestRequestServing(t *testing.T) {
 
 	testConn = &testutil.ErrorTestingConnection{}
 
-	drh.defaultServeRequest(testConn, "/testpath", true, 0, "")
+	drh.defaultServeRequest(testConn, &RequestInfo{Path: "/testpath", MetaDataSupport: true, Offset: 0, Auth: ""})
 
 	// Meta data is 3*16=48 bytes - text is 40 bytes, padding is 8 bytes
 
@@ -285,9 +428,9 @@ func TestRequestServing(t *testing.T) {
 		"icy-metadata: 1\r\n" +
 		"icy-metaint: 5\r\n" +
 		"\r\n" +
-		`12345` + string(0x03) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
-		`67012` + string(0x03) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
-		`34567` + string(0x03) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
+		`12345` + string(rune(0x03)) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
+		`67012` + string(rune(0x03)) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
+		`34567` + string(rune(0x03)) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
 		`89`) {
 
 		t.Error("Unexpected response:", testConn.Out.String())
@@ -302,7 +445,7 @@ func TestRequestServing(t *testing.T) {
 
 	testConn = &testutil.ErrorTestingConnection{}
 
-	drh.defaultServeRequest(testConn, "/testpath", true, 7, "")
+	drh.defaultServeRequest(testConn, &RequestInfo{Path: "/testpath", MetaDataSupport: true, Offset: 7, Auth: ""})
 
 	// Meta data is 3*16=48 bytes - text is 40 bytes, padding is 8 bytes
 
@@ -312,8 +455,8 @@ func TestRequestServing(t *testing.T) {
 		"icy-metadata: 1\r\n" +
 		"icy-metaint: 5\r\n" +
 		"\r\n" +
-		`01234` + string(0x03) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
-		`56789`) {
+		`01234` + string(rune(0x03)) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
+		`56789` + string(rune(0x03)) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0})) {
 
 		t.Error("Unexpected response:", testConn.Out.String())
 		return
@@ -325,7 +468,7 @@ func TestRequestServing(t *testing.T) {
 
 	testConn = &testutil.ErrorTestingConnection{}
 
-	drh.defaultServeRequest(testConn, "/testpath", true, 2, "")
+	drh.defaultServeRequest(testConn, &RequestInfo{Path: "/testpath", MetaDataSupport: true, Offset: 2, Auth: ""})
 
 	// Meta data is 3*16=48 bytes - text is 40 bytes, padding is 8 bytes
 
@@ -335,9 +478,9 @@ func TestRequestServing(t *testing.T) {
 		"icy-metadata: 1\r\n" +
 		"icy-metaint: 5\r\n" +
 		"\r\n" +
-		`34567` + string(0x03) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
-		`01234` + string(0x03) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
-		`56789`) {
+		`34567` + string(rune(0x03)) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
+		`01234` + string(rune(0x03)) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
+		`56789` + string(rune(0x03)) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0})) {
 
 		t.Error("Unexpected response:", testConn.Out.String())
 		return
@@ -352,7 +495,7 @@ func TestRequestServing(t *testing.T) {
 	testConn = &testutil.ErrorTestingConnection{}
 	drh.LoopTimes = 3
 
-	drh.defaultServeRequest(testConn, "/testpath", true, 4, "")
+	drh.defaultServeRequest(testConn, &RequestInfo{Path: "/testpath", MetaDataSupport: true, Offset: 4, Auth: ""})
 
 	// Meta data is 3*16=48 bytes - text is 40 bytes, padding is 8 bytes
 
@@ -362,21 +505,28 @@ func TestRequestServing(t *testing.T) {
 		"icy-metadata: 1\r\n" +
 		"icy-metaint: 5\r\n" +
 		"\r\n" +
-		`56701` + string(0x03) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
-		`23456` + string(0x03) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
-		`78912` + string(0x03) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
-		`34567` + string(0x03) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
-		`01234` + string(0x03) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
-		`56789` + string(0x03) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
-		`12345` + string(0x03) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
-		`67012` + string(0x03) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
-		`34567` + string(0x03) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
+		`56701` + string(rune(0x03)) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
+		`23456` + string(rune(0x03)) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
+		`78912` + string(rune(0x03)) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
+		`34567` + string(rune(0x03)) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
+		`01234` + string(rune(0x03)) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
+		`56789` + string(rune(0x03)) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
+		`12345` + string(rune(0x03)) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
+		`67012` + string(rune(0x03)) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
+		`34567` + string(rune(0x03)) + `StreamTitle='A very long title name wh';` + string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) +
 		`89`) {
 
 		t.Error("Unexpected response:", testConn.Out.String())
 		return
 	}
 
+	// The loop counter of the handler is shared by all connections
+
+	if drh.LoopTimes != 3 {
+		t.Error("Unexpected loop times:", drh.LoopTimes)
+		return
+	}
+
 	// Test client close connection
 
 	tpl.fp = 0
@@ -387,7 +537,7 @@ func TestRequestServing(t *testing.T) {
 	testConn.OutClose = true
 	out.Reset()
 
-	drh.defaultServeRequest(testConn, "/testpath", true, 0, "")
+	drh.defaultServeRequest(testConn, &RequestInfo{Path: "/testpath", MetaDataSupport: true, Offset: 0, Auth: ""})
 
 	if out.String() != "Serve request path:/testpath Metadata support:true Offset:0\n"+
 		"Written bytes: 0\n"+
@@ -410,6 +560,14 @@ func TestRequestHandling(t *testing.T) {
 		out.WriteString("\n")
 	}}
 
+	oldNewRequestID := newRequestID
+	newRequestID = func() string {
+		return "test"
+	}
+	defer func() {
+		newRequestID = oldNewRequestID
+	}()
+
 	drh := NewDefaultRequestHandler(nil, false, false, "")
 	drh.SetDebugLogger(debugLogger)
 
@@ -419,8 +577,8 @@ func TestRequestHandling(t *testing.T) {
 
 	drh.HandleRequest(testConn, &testNetError{})
 
-	if out.String() != "Handling request from: <nil>\n"+
-		"TestNetError\n" {
+	if out.String() != "[test] Handling request from: <nil>\n"+
+		"[test] TestNetError\n" {
 		t.Error("Unexpected output:", out.String())
 		return
 	}
@@ -437,8 +595,8 @@ func TestRequestHandling(t *testing.T) {
 
 	drh.HandleRequest(testConn, nil)
 
-	if out.String() != "Handling request from: <nil>\n"+
-		"Test reading error\n" {
+	if out.String() != "[test] Handling request from: <nil>\n"+
+		"[test] Test reading error\n" {
 		t.Error("Unexpected output:", out.String())
 		return
 	}
@@ -452,8 +610,8 @@ func TestRequestHandling(t *testing.T) {
 
 	drh.HandleRequest(testConn, nil)
 
-	if out.String() != "Handling request from: <nil>\n"+
-		"Illegal request: Request is too long\n" {
+	if out.String() != "[test] Handling request from: <nil>\n"+
+		"[test] Illegal request: Request is too long\n" {
 		t.Error("Unexpected output:", out.String())
 		return
 	}
@@ -465,9 +623,9 @@ func TestRequestHandling(t *testing.T) {
 
 	drh.HandleRequest(testConn, nil)
 
-	if out.String() != "Handling request from: <nil>\n"+
-		"Client:<nil> Request:123\r\n\r\n\n"+
-		"Invalid request: 123\n" {
+	if out.String() != "[test] Handling request from: <nil>\n"+
+		"[test] Client:<nil> Request:123\r\n\r\n\n"+
+		"[test] Invalid request: 123\n" {
 		t.Error("Unexpected output:", out.String())
 		return
 	}
@@ -562,13 +720,13 @@ func TestRequestHandler(t *testing.T) {
 	rauth := ""
 	errorChan := make(chan error)
 
-	drh.ServeRequest = func(c net.Conn, path string, metaDataSupport bool, offset int, auth string) {
+	drh.ServeRequest = LegacyServeRequest(func(c net.Conn, path string, metaDataSupport bool, offset int, auth string) {
 		rpath = path
 		rmetaDataSupport = metaDataSupport
 		roffset = offset
 		rauth = auth
 		errorChan <- nil
-	}
+	})
 	defer func() {
 		drh.ServeRequest = drh.defaultServeRequest
 	}()
@@ -646,6 +804,257 @@ func TestRequestHandler(t *testing.T) {
 	wg.Wait()
 }
 
+func TestRequestHandlingWithoutLogger(t *testing.T) {
+
+	tpl := &testPlaylist{[][]byte{[]byte("123")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+
+	testConn := &testutil.ErrorTestingConnection{}
+	testConn.In.WriteString("GET /testpath HTTP/1.1\r\n\r\n")
+
+	drh.HandleRequest(testConn, nil)
+
+	if testConn.Out.String() != "ICY 200 OK\r\n"+
+		"Content-Type: Test/Content\r\n"+
+		"icy-name: TestPlaylist\r\n"+
+		"\r\n"+
+		"123" {
+		t.Error("Unexpected response:", testConn.Out.String())
+		return
+	}
+
+	// Setting a nil logger must not break the handler
+
+	drh.SetDebugLogger(nil)
+
+	testConn = &testutil.ErrorTestingConnection{}
+
+	drh.HandleRequest(testConn, &testNetError{})
+}
+
+func TestBareLFRequest(t *testing.T) {
+	served := make(chan *RequestInfo, 1)
+
+	drh := NewDefaultRequestHandler(nil, false, false, "")
+	drh.ServeRequest = func(c net.Conn, info *RequestInfo) {
+		served <- info
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	go drh.HandleRequest(server, nil)
+
+	// The client keeps the connection open after sending the request
+
+	client.Write([]byte("GET /testpath HTTP/1.1\nHost: localhost:9091\nIcy-MetaData: 1\n\n"))
+
+	select {
+	case info := <-served:
+		if info.Path != "/testpath" || !info.MetaDataSupport ||
+			info.Headers != "GET /testpath HTTP/1.1\nHost: localhost:9091\nIcy-MetaData: 1" {
+			t.Error("Unexpected request info:", info)
+			return
+		}
+	case <-time.After(time.Second):
+		t.Error("Request with bare LF line endings was not served")
+		return
+	}
+}
+
+func TestHTTPCompatMode(t *testing.T) {
+
+	tpl := &testPlaylist{[][]byte{[]byte("123")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+
+	request := strings.Replace(testRequest3, "/bach/cello_suite1", "/testpath", 1)
+
+	// ICY status line is send if the mode is not enabled
+
+	testConn := &testutil.ErrorTestingConnection{}
+	testConn.In.WriteString(request)
+
+	drh.HandleRequest(testConn, nil)
+
+	if !strings.HasPrefix(testConn.Out.String(), "ICY 200 OK\r\n") {
+		t.Error("Unexpected response:", testConn.Out.String())
+		return
+	}
+
+	drh.HTTPCompatMode = true
+
+	tpl.fp = 0
+	testConn = &testutil.ErrorTestingConnection{}
+	testConn.In.WriteString(request)
+
+	drh.HandleRequest(testConn, nil)
+
+	if testConn.Out.String() != "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: Test/Content\r\n"+
+		"Content-Encoding: identity\r\n"+
+		"icy-name: TestPlaylist\r\n"+
+		"\r\n"+
+		"123" {
+		t.Error("Unexpected response:", testConn.Out.String())
+		return
+	}
+
+	// ICY clients still get the ICY status line (without a content encoding)
+
+	tpl.fp = 0
+	testConn = &testutil.ErrorTestingConnection{}
+	testConn.In.WriteString(strings.Replace(testRequest, "/mylist", "/testpath", 1))
+
+	drh.HandleRequest(testConn, nil)
+
+	if !strings.HasPrefix(testConn.Out.String(), "ICY 200 OK\r\n") ||
+		strings.Contains(testConn.Out.String(), "Content-Encoding") {
+		t.Error("Unexpected response:", testConn.Out.String())
+		return
+	}
+}
+
+func TestChunkedHTTP(t *testing.T) {
+
+	tpl := &testPlaylist{[][]byte{[]byte("123"), []byte("4567890abcdefghijk")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+	drh.ChunkedHTTP = true
+
+	request := func(req string) string {
+		tpl.fp = 0
+		testConn := &testutil.ErrorTestingConnection{}
+		testConn.In.WriteString(strings.Replace(req, "/bach/cello_suite1", "/testpath", 1))
+		drh.HandleRequest(testConn, nil)
+		return testConn.Out.String()
+	}
+
+	if res := request(testRequest3); res != "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: Test/Content\r\n"+
+		"Content-Encoding: identity\r\n"+
+		"icy-name: TestPlaylist\r\n"+
+		"Transfer-Encoding: chunked\r\n"+
+		"\r\n"+
+		"3\r\n123\r\n"+
+		"12\r\n4567890abcdefghijk\r\n"+
+		"0\r\n\r\n" {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// ICY clients still get the plain stream
+
+	if res := request(strings.Replace(testRequest, "/mylist", "/testpath", 1)); !strings.HasPrefix(res, "ICY 200 OK\r\n") ||
+		strings.Contains(res, "chunked") || !strings.HasSuffix(res, "4567890abcdefghijk") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+}
+
+func TestClientMetaDataInterval(t *testing.T) {
+
+	oldMin, oldMax := MinClientMetaDataInterval, MaxClientMetaDataInterval
+	MinClientMetaDataInterval, MaxClientMetaDataInterval = 3, 100
+	defer func() {
+		MinClientMetaDataInterval, MaxClientMetaDataInterval = oldMin, oldMax
+	}()
+
+	tpl := &testPlaylist{[][]byte{[]byte("123"), []byte("4567"), []byte("89")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+	drh.ClientMetaInt = true
+
+	metaData := string(rune(0x03)) + `StreamTitle='Test Title - Test Artist';` +
+		string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0})
+
+	testConn := &testutil.ErrorTestingConnection{}
+	testConn.In.WriteString("GET /testpath HTTP/1.1\r\nIcy-MetaData: 1\r\nIcy-MetaInt: 4\r\n\r\n")
+
+	drh.HandleRequest(testConn, nil)
+
+	if testConn.Out.String() != "ICY 200 OK\r\n"+
+		"Content-Type: Test/Content\r\n"+
+		"icy-name: TestPlaylist\r\n"+
+		"icy-metadata: 1\r\n"+
+		"icy-metaint: 4\r\n"+
+		"\r\n"+
+		"1234"+metaData+"5678"+metaData+"9" {
+		t.Error("Unexpected response:", testConn.Out.String())
+		return
+	}
+
+	// Requested intervals are clamped
+
+	tpl.fp = 0
+	testConn = &testutil.ErrorTestingConnection{}
+	testConn.In.WriteString("GET /testpath HTTP/1.1\r\nIcy-MetaData: 1\r\nIcy-MetaInt: 1\r\n\r\n")
+
+	drh.HandleRequest(testConn, nil)
+
+	if !strings.Contains(testConn.Out.String(), "icy-metaint: 3\r\n") {
+		t.Error("Unexpected response:", testConn.Out.String())
+		return
+	}
+
+	// Clients without a hint get the default interval
+
+	tpl.fp = 0
+	testConn = &testutil.ErrorTestingConnection{}
+	testConn.In.WriteString("GET /testpath HTTP/1.1\r\nIcy-MetaData: 1\r\n\r\n")
+
+	drh.HandleRequest(testConn, nil)
+
+	if !strings.Contains(testConn.Out.String(), fmt.Sprintf("icy-metaint: %v\r\n", MetaDataInterval)) {
+		t.Error("Unexpected response:", testConn.Out.String())
+		return
+	}
+
+	// Hints are ignored if the option is not enabled
+
+	drh.ClientMetaInt = false
+
+	tpl.fp = 0
+	testConn = &testutil.ErrorTestingConnection{}
+	testConn.In.WriteString("GET /testpath HTTP/1.1\r\nIcy-MetaData: 1\r\nIcy-MetaInt: 4\r\n\r\n")
+
+	drh.HandleRequest(testConn, nil)
+
+	if !strings.Contains(testConn.Out.String(), fmt.Sprintf("icy-metaint: %v\r\n", MetaDataInterval)) {
+		t.Error("Unexpected response:", testConn.Out.String())
+		return
+	}
+}
+
+func TestRequestInfo(t *testing.T) {
+	var info *RequestInfo
+
+	drh := NewDefaultRequestHandler(nil, false, false, "web:web")
+	drh.SetDebugLogger(&TestDebugLogger{false, nil})
+	drh.ServeRequest = func(c net.Conn, i *RequestInfo) {
+		info = i
+	}
+
+	testConn := &testutil.ErrorTestingConnection{}
+	testConn.In.WriteString(testRequest3)
+
+	drh.HandleRequest(testConn, nil)
+
+	if info == nil {
+		t.Error("Request was not served")
+		return
+	}
+
+	if info.Path != "/bach/cello_suite1" || info.MetaDataSupport || info.Offset != 0 ||
+		info.Auth != "web:web" || info.RemoteAddr != testConn.RemoteAddr() || !info.HTTPClient {
+		t.Error("Unexpected request info:", info)
+		return
+	}
+
+	if !strings.HasPrefix(info.Headers, "GET /bach/cello_suite1 HTTP/1.1\nHost: localhost:9091\n") ||
+		!strings.HasSuffix(info.Headers, "Cache-Control: max-age=0") {
+		t.Error("Unexpected request headers:", info.Headers)
+		return
+	}
+}
+
 func writeSocket(req []byte) error {
 	conn, err := net.Dial("tcp", testport)
 	if err != nil {
@@ -657,3 +1066,1301 @@ func writeSocket(req []byte) error {
 
 	return nil
 }
+
+func TestLargeFrameMetaData(t *testing.T) {
+
+	// Frames are larger than the meta data interval
+
+	tpl := &testPlaylist{[][]byte{[]byte("123456789"), []byte("0123456789AB")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+
+	metaData := string(rune(0x03)) + `StreamTitle='Test Title - Test Artist';` +
+		string([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0})
+
+	testConn := &testutil.ErrorTestingConnection{}
+
+	drh.defaultServeRequest(testConn, &RequestInfo{Path: "/testpath", MetaDataSupport: true, MetaDataInterval: 4})
+
+	if testConn.Out.String() != "ICY 200 OK\r\n"+
+		"Content-Type: Test/Content\r\n"+
+		"icy-name: TestPlaylist\r\n"+
+		"icy-metadata: 1\r\n"+
+		"icy-metaint: 4\r\n"+
+		"\r\n"+
+		"1234"+metaData+"5678"+metaData+"9012"+metaData+
+		"3456"+metaData+"789A"+metaData+"B" {
+		t.Error("Unexpected response:", testConn.Out.String())
+		return
+	}
+}
+
+func TestFrameWriteTimeout(t *testing.T) {
+
+	tpl := &testPlaylist{[][]byte{[]byte("123"), []byte("4567")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+
+	if drh.FrameWriteTimeout != DefaultFrameWriteTimeout {
+		t.Error("Unexpected default timeout:", drh.FrameWriteTimeout)
+		return
+	}
+
+	drh.FrameWriteTimeout = 50 * time.Millisecond
+
+	// Nobody reads from the other end of the pipe - writes block
+
+	c, _ := net.Pipe()
+	defer c.Close()
+
+	start := time.Now()
+
+	_, _, _, err := drh.writeFrame(c, tpl, 0, 0, false, MetaDataInterval, nil, drh.logger)
+
+	if err == nil || err.Error() != "Could not write to client - closing connection" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if d := time.Since(start); d > time.Second {
+		t.Error("Write took too long:", d)
+		return
+	}
+
+	// The same happens if meta data is written
+
+	tpl.fp = 0
+
+	_, _, _, err = drh.writeFrame(c, tpl, 0, 1, true, 2, nil, drh.logger)
+
+	if err == nil || err.Error() != "Could not write to client - closing connection" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
+
+func TestHandlerMaxMetaDataSize(t *testing.T) {
+
+	tpl := &testPlaylist{[][]byte{[]byte("123")}, nil, 0}
+
+	drh1 := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+	drh2 := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+
+	if drh1.MaxMetaDataSize != MaxMetaDataSize {
+		t.Error("Unexpected default value:", drh1.MaxMetaDataSize)
+		return
+	}
+
+	drh1.MaxMetaDataSize = 16
+	drh2.MaxMetaDataSize = 32
+
+	testConn1 := &testutil.ErrorTestingConnection{}
+	testConn2 := &testutil.ErrorTestingConnection{}
+
+	drh1.writeStreamMetaData(testConn1, tpl)
+	drh2.writeStreamMetaData(testConn2, tpl)
+
+	if res := testConn1.Out.String(); res != string(rune(0x01))+"StreamTitle='T';" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if res := testConn2.Out.String(); res != string(rune(0x02))+"StreamTitle='Test Title - Test';" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+}
+
+func TestSendInitialMetadata(t *testing.T) {
+
+	oldMetaDataInterval := MetaDataInterval
+	MetaDataInterval = 5
+	defer func() {
+		MetaDataInterval = oldMetaDataInterval
+	}()
+
+	tpl := &testPlaylist{[][]byte{[]byte("1234"), []byte("5678")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+	drh.MaxMetaDataSize = 16
+
+	request := func() string {
+		tpl.fp = 0
+		testConn := &testutil.ErrorTestingConnection{}
+		drh.ServeRequest(testConn, &RequestInfo{Path: "/testpath", MetaDataSupport: true})
+		return strings.SplitN(testConn.Out.String(), "\r\n\r\n", 2)[1]
+	}
+
+	metaData := string(rune(0x01)) + "StreamTitle='T';"
+
+	if res := request(); res != "12345"+metaData+"678" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	drh.SendInitialMetadata = true
+
+	if res := request(); res != metaData+"12345"+metaData+"678" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+}
+
+/*
+testRapidPlaylist is a playlist for testing which changes the track with every
+frame - every frame takes one second
+*/
+type testRapidPlaylist struct {
+	testPlaylist
+	now time.Time
+}
+
+func (tp *testRapidPlaylist) Title() string {
+	return fmt.Sprint("Track ", tp.fp)
+}
+
+func (tp *testRapidPlaylist) Frame() ([]byte, error) {
+	tp.now = tp.now.Add(time.Second)
+	return tp.testPlaylist.Frame()
+}
+
+func TestMinMetadataGap(t *testing.T) {
+
+	tpl := &testRapidPlaylist{testPlaylist{[][]byte{[]byte("ab"), []byte("ab"),
+		[]byte("ab"), []byte("ab"), []byte("ab"), []byte("ab")}, nil, 0}, time.Time{}}
+
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+	drh.StreamTitleTemplate = "{{.Title}}"
+	drh.now = func() time.Time {
+		return tpl.now
+	}
+
+	request := func() string {
+		tpl.fp = 0
+		tpl.now = time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+		testConn := &testutil.ErrorTestingConnection{}
+		drh.ServeRequest(testConn, &RequestInfo{Path: "/testpath", MetaDataSupport: true, MetaDataInterval: 2})
+		return strings.SplitN(testConn.Out.String(), "\r\n\r\n", 2)[1]
+	}
+
+	metaData := func(title string) string {
+		streamTitle := "StreamTitle='" + title + "';"
+		blocks := (len(streamTitle) + 15) / 16
+		return string(rune(blocks)) + streamTitle + strings.Repeat("\x00", blocks*16-len(streamTitle))
+	}
+
+	// Every block carries the current title by default
+
+	var expected string
+	for i := 1; i <= 6; i++ {
+		expected += "ab" + metaData(fmt.Sprint("Track ", i))
+	}
+
+	if res := request(); res != expected {
+		t.Errorf("Unexpected result: %q", res)
+		return
+	}
+
+	// Only one title is send every 3 seconds
+
+	drh.MinMetadataGap = 3 * time.Second
+
+	expected = "ab" + metaData("Track 1") + "ab\x00ab\x00" +
+		"ab" + metaData("Track 4") + "ab\x00ab\x00"
+
+	if res := request(); res != expected {
+		t.Errorf("Unexpected result: %q", res)
+		return
+	}
+}
+
+/*
+testAlbumPlaylist is a playlist for testing which knows the album of a track
+*/
+type testAlbumPlaylist struct {
+	testPlaylist
+}
+
+func (tp *testAlbumPlaylist) Album() string {
+	return "Test Album"
+}
+
+func TestStreamTitleTemplate(t *testing.T) {
+
+	tpl := &testAlbumPlaylist{testPlaylist{[][]byte{[]byte("123")}, nil, 0}}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+
+	metaData := func() string {
+		testConn := &testutil.ErrorTestingConnection{}
+		drh.writeStreamMetaData(testConn, tpl)
+		return strings.TrimRight(testConn.Out.String()[1:], "\x00")
+	}
+
+	if res := metaData(); res != "StreamTitle='Test Title - Test Artist';" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	drh.StreamTitleTemplate = "{{.Artist}}: {{.Title}}"
+
+	if res := metaData(); res != "StreamTitle='Test Artist: Test Title';" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	drh.StreamTitleTemplate = "{{.Name}} {{.Album}}"
+
+	if res := metaData(); res != "StreamTitle='TestPlaylist Test Album';" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Invalid templates use the default format
+
+	for _, tmpl := range []string{"{{.Title", "{{.Foo}}", ""} {
+		drh.StreamTitleTemplate = tmpl
+
+		if res := metaData(); res != "StreamTitle='Test Title - Test Artist';" {
+			t.Error("Unexpected result:", tmpl, res)
+			return
+		}
+	}
+}
+
+func TestMaxMetaDataSizeBounds(t *testing.T) {
+
+	tpl := &testPlaylist{[][]byte{[]byte("123")}, nil, 0}
+	drh := &DefaultRequestHandler{}
+
+	// Unset sizes use the default
+
+	if res := drh.streamMetaData(tpl); string(res) != string(NewDefaultRequestHandler(nil,
+		false, false, "").streamMetaData(tpl)) {
+		t.Errorf("Unexpected meta data: %q", res)
+		return
+	}
+
+	// Tiny sizes keep the closing characters of the title
+
+	drh.MaxMetaDataSize = 1
+
+	if res := drh.streamMetaData(tpl); string(res) != "\x01';"+strings.Repeat("\x00", 14) {
+		t.Errorf("Unexpected meta data: %q", res)
+		return
+	}
+
+	// Oversized limits are capped to what the length byte can express
+
+	oldTitle := testTitle
+	testTitle = strings.Repeat("x", 5000)
+	defer func() {
+		testTitle = oldTitle
+	}()
+
+	drh.MaxMetaDataSize = 10000
+
+	if res := drh.streamMetaData(tpl); len(res) != 4081 || res[0] != 255 || !strings.HasSuffix(string(res), "x';") {
+		t.Error("Unexpected meta data:", len(res), res[0])
+		return
+	}
+}
+
+func TestMaxTitleLength(t *testing.T) {
+
+	tpl := &testAlbumPlaylist{testPlaylist{[][]byte{[]byte("123")}, nil, 0}}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+	drh.MaxTitleLength = 10
+
+	metaData := func() string {
+		testConn := &testutil.ErrorTestingConnection{}
+		drh.writeStreamMetaData(testConn, tpl)
+		return strings.TrimRight(testConn.Out.String()[1:], "\x00")
+	}
+
+	if res := metaData(); res != "StreamTitle='Test Titl…';" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Titles which fit are not changed
+
+	drh.MaxTitleLength = 24
+
+	if res := metaData(); res != "StreamTitle='Test Title - Test Artist';" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// The meta data size limit still applies
+
+	drh.MaxTitleLength = 10
+	drh.MaxMetaDataSize = 20
+
+	if res := metaData(); res != "StreamTitle='Test ';" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+}
+
+func TestStreamURLMetaData(t *testing.T) {
+
+	tpl := &testURLPlaylist{testPlaylist{[][]byte{[]byte("123")}, nil, 0}, "http://example.com/cover.jpg"}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+
+	testConn := &testutil.ErrorTestingConnection{}
+
+	drh.writeStreamMetaData(testConn, tpl)
+
+	// Text is 80 bytes which fits exactly into 5 blocks
+
+	if res := testConn.Out.String(); res != string(rune(0x05))+
+		"StreamTitle='Test Title - Test Artist';StreamUrl='http://example.com/cover.jpg';" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// The URL is subject to truncation
+
+	drh.MaxMetaDataSize = 64
+	testConn = &testutil.ErrorTestingConnection{}
+
+	drh.writeStreamMetaData(testConn, tpl)
+
+	if res := testConn.Out.String(); res != string(rune(0x04))+
+		"StreamTitle='Test Title - Test Artist';StreamUrl='http://examp';" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Empty URLs are not send
+
+	tpl.url = ""
+	testConn = &testutil.ErrorTestingConnection{}
+
+	drh.writeStreamMetaData(testConn, tpl)
+
+	if res := testConn.Out.String(); !strings.HasPrefix(res, string(rune(0x03))+
+		"StreamTitle='Test Title - Test Artist';\x00") {
+		t.Error("Unexpected result:", res)
+		return
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+
+	// Health checks work without playlists and authentication
+
+	drh := NewDefaultRequestHandler(nil, false, false, "web:web")
+
+	testConn := &testutil.ErrorTestingConnection{}
+	testConn.In.WriteString("GET /healthz HTTP/1.1\r\n\r\n")
+
+	drh.HandleRequest(testConn, nil)
+
+	if res := testConn.Out.String(); res != "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok" {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// Other paths still require authentication
+
+	testConn = &testutil.ErrorTestingConnection{}
+	testConn.In.WriteString("GET /healthz2 HTTP/1.1\r\n\r\n")
+
+	drh.HandleRequest(testConn, nil)
+
+	if res := testConn.Out.String(); !strings.HasPrefix(res, "HTTP/1.1 401") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// Health checks can be moved and disabled
+
+	drh.HealthPath = "/alive"
+
+	testConn = &testutil.ErrorTestingConnection{}
+	testConn.In.WriteString("GET /alive HTTP/1.1\r\n\r\n")
+
+	drh.HandleRequest(testConn, nil)
+
+	if res := testConn.Out.String(); !strings.HasSuffix(res, "\r\n\r\nok") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	drh.HealthPath = ""
+
+	testConn = &testutil.ErrorTestingConnection{}
+	testConn.In.WriteString("GET /alive HTTP/1.1\r\n\r\n")
+
+	drh.HandleRequest(testConn, nil)
+
+	if res := testConn.Out.String(); !strings.HasPrefix(res, "HTTP/1.1 401") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+}
+
+/*
+testCountingConn counts the write calls on a connection
+*/
+type testCountingConn struct {
+	*testutil.ErrorTestingConnection
+	writes int
+}
+
+func (tc *testCountingConn) Write(b []byte) (int, error) {
+	tc.writes++
+	return tc.ErrorTestingConnection.Write(b)
+}
+
+func TestBufferedWrites(t *testing.T) {
+
+	tpl := &testPlaylist{[][]byte{[]byte("123"), []byte("4567"), []byte("0123456789")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+
+	// Produce the unbuffered output
+
+	unbufConn := &testCountingConn{&testutil.ErrorTestingConnection{}, 0}
+
+	drh.writeStreamStartResponse(unbufConn, tpl.Name(), tpl.ContentType(), true, 5, false)
+
+	var frameOffset int
+	var writtenBytes uint64
+
+	for !tpl.Finished() {
+		frameOffset, writtenBytes, _, _ = drh.writeFrame(unbufConn, tpl, frameOffset, writtenBytes, true, 5, nil, drh.logger)
+	}
+
+	// Produce the buffered output
+
+	tpl.fp = 0
+	bufConn := &testCountingConn{&testutil.ErrorTestingConnection{}, 0}
+
+	drh.defaultServeRequest(bufConn, &RequestInfo{Path: "/testpath", MetaDataSupport: true, MetaDataInterval: 5})
+
+	if bufConn.Out.String() != unbufConn.Out.String() {
+		t.Error("Unexpected output:", bufConn.Out.String(), "expected:", unbufConn.Out.String())
+		return
+	}
+
+	// Headers and each frame are send with a single write
+
+	if bufConn.writes != 4 || unbufConn.writes <= bufConn.writes {
+		t.Error("Unexpected number of writes:", bufConn.writes, unbufConn.writes)
+		return
+	}
+}
+
+func TestZeroMetaDataInterval(t *testing.T) {
+	var out bytes.Buffer
+
+	oldMetaDataInterval := MetaDataInterval
+	MetaDataInterval = 0
+	defer func() {
+		MetaDataInterval = oldMetaDataInterval
+	}()
+
+	tpl := &testPlaylist{[][]byte{[]byte("123"), []byte("4567")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+	drh.SetDebugLogger(&TestDebugLogger{true, func(v ...interface{}) {
+		out.WriteString(fmt.Sprint(v...))
+		out.WriteString("\n")
+	}})
+
+	testConn := &testutil.ErrorTestingConnection{}
+
+	drh.defaultServeRequest(testConn, &RequestInfo{Path: "/testpath", MetaDataSupport: true})
+
+	// Meta data is neither advertised nor send
+
+	if res := testConn.Out.String(); res != "ICY 200 OK\r\n"+
+		"Content-Type: Test/Content\r\n"+
+		"icy-name: TestPlaylist\r\n"+
+		"\r\n"+
+		"1234567" {
+		t.Errorf("Unexpected response: %q", res)
+		return
+	}
+
+	if !strings.Contains(out.String(), "Warning: Meta data interval is 0 - sending no meta data") {
+		t.Error("Unexpected output:", out.String())
+		return
+	}
+
+	// Frames are also written without meta data if the interval is 0
+
+	testConn = &testutil.ErrorTestingConnection{}
+	tpl.fp = 0
+
+	if _, _, n, err := drh.writeFrame(testConn, tpl, 0, 0, true, 0, nil, drh.logger); err != nil || n != 3 || testConn.Out.String() != "123" {
+		t.Error("Unexpected result:", n, err, testConn.Out.String())
+		return
+	}
+}
+
+func TestCoalescedMetaDataWrite(t *testing.T) {
+
+	tpl := &testPlaylist{[][]byte{[]byte("0123456789")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+
+	testConn := &testCountingConn{&testutil.ErrorTestingConnection{}, 0}
+
+	_, writtenBytes, _, err := drh.writeFrame(testConn, tpl, 0, 1, true, 4, nil, drh.logger)
+
+	if err != nil || writtenBytes != 3 {
+		t.Error("Unexpected result:", writtenBytes, err)
+		return
+	}
+
+	// Frame data and both meta data blocks are send with a single write
+
+	if testConn.writes != 1 {
+		t.Error("Unexpected number of writes:", testConn.writes)
+		return
+	}
+
+	metaData := string(drh.streamMetaData(tpl))
+
+	if res := testConn.Out.String(); res != "012"+metaData+"3456"+metaData+"789" {
+		t.Errorf("Unexpected output: %q", res)
+		return
+	}
+}
+
+func TestLargeFrameMetaDataWrite(t *testing.T) {
+
+	tpl := &testPlaylist{[][]byte{[]byte("0123456789abcdefghijklmno")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+
+	metaData := string(drh.streamMetaData(tpl))
+
+	// A frame which spans several meta data intervals gets a meta data
+	// block after every interval
+
+	testConn := &testutil.ErrorTestingConnection{}
+
+	writtenBytes, err := drh.writeFrameData(testConn, tpl, []byte("0123456789abcdefghijklmno"),
+		1, true, 4, nil)
+
+	if err != nil || writtenBytes != 2 {
+		t.Error("Unexpected result:", writtenBytes, err)
+		return
+	}
+
+	if res := testConn.Out.String(); res != "012"+metaData+"3456"+metaData+"789a"+metaData+
+		"bcde"+metaData+"fghi"+metaData+"jklm"+metaData+"no" {
+		t.Errorf("Unexpected output: %q", res)
+		return
+	}
+
+	// The accounting continues with the next frame
+
+	testConn = &testutil.ErrorTestingConnection{}
+
+	writtenBytes, err = drh.writeFrameData(testConn, tpl, []byte("0123456789"), writtenBytes, true, 4, nil)
+
+	if err != nil || writtenBytes != 0 {
+		t.Error("Unexpected result:", writtenBytes, err)
+		return
+	}
+
+	if res := testConn.Out.String(); res != "01"+metaData+"2345"+metaData+"6789"+metaData {
+		t.Errorf("Unexpected output: %q", res)
+		return
+	}
+
+	// Written bytes which already exceed the interval lead to an immediate
+	// meta data block
+
+	testConn = &testutil.ErrorTestingConnection{}
+
+	writtenBytes, err = drh.writeFrameData(testConn, tpl, []byte("0123456789"), 10, true, 4, nil)
+
+	if err != nil || writtenBytes != 2 {
+		t.Error("Unexpected result:", writtenBytes, err)
+		return
+	}
+
+	if res := testConn.Out.String(); res != metaData+"0123"+metaData+"4567"+metaData+"89" {
+		t.Errorf("Unexpected output: %q", res)
+		return
+	}
+}
+
+/*
+testMetadataEncoder encodes the title of the current track as a length
+prefixed string.
+*/
+type testMetadataEncoder struct {
+	maxSize int
+}
+
+func (tme *testMetadataEncoder) Encode(pl Playlist, maxSize int) []byte {
+	tme.maxSize = maxSize
+	return append([]byte{byte(len(pl.Title()))}, pl.Title()...)
+}
+
+func TestMetadataEncoder(t *testing.T) {
+
+	tpl := &testPlaylist{[][]byte{[]byte("0123456789")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+
+	// The ICY format is used by default
+
+	if _, ok := drh.MetadataEncoder.(*icyMetadataEncoder); !ok {
+		t.Error("Unexpected default encoder:", drh.MetadataEncoder)
+		return
+	}
+
+	tme := &testMetadataEncoder{}
+	drh.MetadataEncoder = tme
+
+	testConn := &testutil.ErrorTestingConnection{}
+
+	writtenBytes, err := drh.writeFrameData(testConn, tpl, []byte("0123456789"), 0, true, 4, nil)
+
+	if err != nil || writtenBytes != 2 {
+		t.Error("Unexpected result:", writtenBytes, err)
+		return
+	}
+
+	// The bytes of the encoder are sent at every interval
+
+	if res := testConn.Out.String(); res != "0123\x0aTest Title4567\x0aTest Title89" {
+		t.Errorf("Unexpected output: %q", res)
+		return
+	}
+
+	if tme.maxSize != MaxMetaDataSize {
+		t.Error("Unexpected maximum size:", tme.maxSize)
+		return
+	}
+}
+
+func TestDisableAuthReplay(t *testing.T) {
+
+	tpl := &testPlaylist{[][]byte{[]byte("123")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "web:web")
+
+	request := func(req string) string {
+		tpl.fp = 0
+		testConn := &testutil.ErrorTestingConnection{}
+		testConn.In.WriteString(req)
+		drh.HandleRequest(testConn, nil)
+		return testConn.Out.String()
+	}
+
+	// Both clients share the same address
+
+	authRequest := "GET /testpath HTTP/1.1\r\nAuthorization: Basic d2ViOndlYg==\r\n\r\n"
+	noAuthRequest := "GET /testpath HTTP/1.1\r\n\r\n"
+
+	if res := request(authRequest); !strings.HasPrefix(res, "ICY 200 OK") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	if res := request(noAuthRequest); !strings.HasPrefix(res, "ICY 200 OK") {
+		t.Error("Second client should be let through by default:", res)
+		return
+	}
+
+	drh = NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "web:web")
+	drh.DisableAuthReplay = true
+
+	if res := request(authRequest); !strings.HasPrefix(res, "ICY 200 OK") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	if res := request(noAuthRequest); !strings.HasPrefix(res, "HTTP/1.1 401") {
+		t.Error("Second client should be denied:", res)
+		return
+	}
+}
+
+func TestSuffixRange(t *testing.T) {
+
+	tpl := &testSizedPlaylist{testPlaylist{[][]byte{[]byte("123"), []byte("4567")}, nil, 0}, 7}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+
+	request := func(rangeHeader string) string {
+		tpl.fp = 0
+		testConn := &testutil.ErrorTestingConnection{}
+		testConn.In.WriteString("GET /testpath HTTP/1.1\r\nRange: " + rangeHeader + "\r\n\r\n")
+		drh.HandleRequest(testConn, nil)
+		return testConn.Out.String()
+	}
+
+	header := "ICY 200 OK\r\n" +
+		"Content-Type: Test/Content\r\n" +
+		"icy-name: TestPlaylist\r\n" +
+		"\r\n"
+
+	if res := request("bytes=-3"); res != header+"567" {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// Suffixes longer than the playlist return everything
+
+	if res := request("bytes=-500"); res != header+"1234567" {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// Other range forms still work
+
+	if res := request("bytes=2-"); res != header+"34567" {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	if res := request("bytes=2-4"); res != header+"34567" {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// Suffix ranges cannot be satisfied if the size is unknown
+
+	tpl.size = -1
+
+	if res := request("bytes=-500"); res != "HTTP/1.1 416 Range Not Satisfiable\r\n\r\n" {
+		t.Error("Unexpected response:", res)
+		return
+	}
+}
+
+func TestFrameOffset(t *testing.T) {
+
+	tpl := &testPlaylist{[][]byte{[]byte("123"), []byte("456"), []byte("789")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+
+	request := func(headers string) string {
+		tpl.fp = 0
+		testConn := &testutil.ErrorTestingConnection{}
+		testConn.In.WriteString("GET /testpath HTTP/1.1\r\n" + headers + "\r\n")
+		drh.HandleRequest(testConn, nil)
+		return testConn.Out.String()
+	}
+
+	header := "ICY 200 OK\r\n" +
+		"Content-Type: Test/Content\r\n" +
+		"icy-name: TestPlaylist\r\n" +
+		"\r\n"
+
+	if res := request("X-Frame-Offset: 1\r\n"); res != header+"456789" {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// The byte offset is applied after the frame offset
+
+	if res := request("Range: bytes=2-\r\nX-Frame-Offset: 1\r\n"); res != header+"6789" {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// Skipping more frames than available gives an empty stream
+
+	if res := request("X-Frame-Offset: 5\r\n"); res != header {
+		t.Error("Unexpected response:", res)
+		return
+	}
+}
+
+func TestSetPlaylistFactory(t *testing.T) {
+
+	tpl1 := &testSkipPlaylist{Tracks: [][][]byte{{[]byte("a1"), []byte("a2")}}}
+	tpl2 := &testSkipPlaylist{Tracks: [][][]byte{{[]byte("b1")}}}
+
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl1}, false, false, "")
+
+	request := func() string {
+		testConn := &testutil.ErrorTestingConnection{}
+		drh.ServeRequest(testConn, &RequestInfo{Path: "/testpath"})
+		return testConn.Out.String()
+	}
+
+	// Swap the factory while a connection is streaming
+
+	tpl1.OnFrame = func() {
+		tpl1.OnFrame = nil
+		drh.SetPlaylistFactory(&testPlaylistFactory{tpl2})
+	}
+
+	if res := request(); !strings.HasSuffix(res, "\r\n\r\na1a2") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+
+	// New connections use the new factory
+
+	if res := request(); !strings.HasSuffix(res, "\r\n\r\nb1") {
+		t.Error("Unexpected response:", res)
+		return
+	}
+}
+
+func TestListenerCallbacks(t *testing.T) {
+	var events []string
+
+	tpl := &testPlaylist{[][]byte{[]byte("123"), []byte("45")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+
+	drh.OnListenerConnect = func(path string, clientIP string) {
+		events = append(events, fmt.Sprint("connect ", path, " ", clientIP))
+	}
+	drh.OnListenerDisconnect = func(path string, clientIP string, written uint64) {
+		events = append(events, fmt.Sprint("disconnect ", path, " ", clientIP, " ", written))
+	}
+
+	testConn := &testutil.ErrorTestingConnection{}
+
+	drh.ServeRequest(testConn, &RequestInfo{
+		Path:       "/testpath",
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234},
+	})
+
+	if res := strings.Join(events, "\n"); res != "connect /testpath 127.0.0.1\n"+
+		"disconnect /testpath 127.0.0.1 71" || testConn.Out.Len() != 71 {
+		t.Error("Unexpected events:", res, testConn.Out.Len())
+		return
+	}
+
+	// Unknown paths do not trigger callbacks
+
+	events = nil
+
+	drh.ServeRequest(&testutil.ErrorTestingConnection{}, &RequestInfo{Path: "/unknown"})
+
+	if len(events) != 0 {
+		t.Error("Unexpected events:", events)
+		return
+	}
+}
+
+func TestResumeStreams(t *testing.T) {
+	tpl := &testPlaylist{[][]byte{[]byte("123"), []byte("45"), []byte("678")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+	drh.ResumeStreams = true
+
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
+
+	request := func(outErr int, offset int) string {
+		tpl.fp = 0
+		testConn := &testutil.ErrorTestingConnection{OutErr: outErr}
+		drh.ServeRequest(testConn, &RequestInfo{Path: "/testpath", Offset: offset, RemoteAddr: addr})
+		return testConn.Out.String()[66:]
+	}
+
+	// The connection drops after the first frame
+
+	if res := request(69, 0); res != "123" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// A reconnecting client (different port) continues where it stopped
+
+	addr = &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 4321}
+
+	if res := request(0, 0); res != "45678" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// The position is forgotten once the playlist has ended
+
+	if res := request(71, 0); res != "12345" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// An explicit offset takes precedence
+
+	if res := request(0, 1); res != "2345678" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Other clients are not affected
+
+	request(69, 0)
+
+	addr = &net.TCPAddr{IP: net.ParseIP("127.0.0.2"), Port: 1234}
+
+	if res := request(0, 0); res != "12345678" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Positions are not remembered if the feature is disabled
+
+	drh.ResumeStreams = false
+
+	request(69, 0)
+
+	if res := request(0, 0); res != "12345678" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+}
+
+/*
+testDisconnectConn is a connection whose client closes the connection after a
+number of writes
+*/
+type testDisconnectConn struct {
+	testutil.ErrorTestingConnection
+	closeAfter int           // Number of writes after which the client closes the connection
+	writes     int           // Number of writes
+	closed     chan struct{} // Channel which is closed once the client closed the connection
+	closeOnce  sync.Once
+}
+
+func (c *testDisconnectConn) Read(b []byte) (int, error) {
+	<-c.closed
+	return 0, io.EOF
+}
+
+func (c *testDisconnectConn) Write(b []byte) (int, error) {
+	c.writes++
+
+	if c.writes == c.closeAfter {
+		c.closeOnce.Do(func() {
+			close(c.closed)
+		})
+
+		// Give the background reader time to notice
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return len(b), nil
+}
+
+func TestDetectDisconnect(t *testing.T) {
+	tpl := &testPlaylist{[][]byte{[]byte("123"), []byte("45")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, true, false, "")
+	drh.DetectDisconnect = true
+
+	// The playlist loops forever - only the disconnect stops the stream
+
+	testConn := &testDisconnectConn{closeAfter: 5, closed: make(chan struct{})}
+
+	done := make(chan bool)
+
+	go func() {
+		drh.ServeRequest(testConn, &RequestInfo{Path: "/testpath"})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("Server did not stop writing")
+		return
+	}
+
+	if testConn.writes != 5 {
+		t.Error("Unexpected number of writes:", testConn.writes)
+		return
+	}
+
+	if stats := drh.ConnectionStats(); stats != (ConnectionStats{0, 0, 0, 1}) {
+		t.Error("Unexpected stats:", stats)
+		return
+	}
+}
+
+func TestRequestIDs(t *testing.T) {
+	var out bytes.Buffer
+	var outLock sync.Mutex
+
+	debugLogger := &TestDebugLogger{true, func(v ...interface{}) {
+		outLock.Lock()
+		defer outLock.Unlock()
+		out.WriteString(fmt.Sprint(v...))
+		out.WriteString("\n")
+	}}
+
+	var wg sync.WaitGroup
+
+	ids := make(map[string]string)
+
+	for _, path := range []string{"/testpath1", "/testpath2"} {
+		path := path
+		tpl := &testPlaylist{[][]byte{[]byte("123"), []byte("4567")}, nil, 0}
+
+		drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+		drh.SetDebugLogger(debugLogger)
+		drh.ServeRequest = func(c net.Conn, info *RequestInfo) {
+			outLock.Lock()
+			ids[info.Path] = info.ID
+			outLock.Unlock()
+
+			drh.defaultServeRequest(c, &RequestInfo{Path: "/testpath", ID: info.ID})
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			testConn := &testutil.ErrorTestingConnection{}
+			testConn.In.WriteString("GET " + path + " HTTP/1.1\r\n\r\n")
+
+			drh.HandleRequest(testConn, nil)
+		}()
+	}
+
+	wg.Wait()
+
+	if len(ids["/testpath1"]) != 8 || len(ids["/testpath2"]) != 8 || ids["/testpath1"] == ids["/testpath2"] {
+		t.Error("Unexpected request IDs:", ids)
+		return
+	}
+
+	// Each line must carry the ID of its request
+
+	counts := make(map[string]int)
+
+	for _, line := range strings.Split(out.String(), "\n") {
+		var found bool
+
+		// Skip line breaks of the logged request headers
+
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		for path, id := range ids {
+			if strings.HasPrefix(line, "["+id+"] ") {
+				found = true
+				counts[path]++
+
+				if strings.Contains(line, "GET /testpath") && !strings.Contains(line, "GET "+path+" ") {
+					t.Error("Log line has wrong request ID:", line)
+					return
+				}
+			}
+		}
+
+		if !found {
+			t.Error("Log line without request ID:", line)
+			return
+		}
+	}
+
+	if counts["/testpath1"] != 6 || counts["/testpath2"] != 6 {
+		t.Error("Unexpected log lines:", out.String())
+		return
+	}
+}
+
+func TestMaxStreamDuration(t *testing.T) {
+
+	tpl := &testPlaylist{[][]byte{[]byte("123"), []byte("4567")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, true, false, "")
+	drh.MaxStreamDuration = 100 * time.Millisecond
+
+	c1, c2 := net.Pipe()
+
+	go drh.HandleRequest(c1, nil)
+
+	c2.Write([]byte("GET /testpath HTTP/1.1\r\n\r\n"))
+
+	// The playlist loops forever - the stream must still end
+
+	start := time.Now()
+
+	var buf bytes.Buffer
+	io.Copy(&buf, c2)
+
+	if d := time.Since(start); d < 100*time.Millisecond || d > 2*time.Second {
+		t.Error("Unexpected stream duration:", d)
+		return
+	}
+
+	if !strings.HasPrefix(buf.String(), "ICY 200 OK") || !strings.Contains(buf.String(), "12345671234567") {
+		t.Error("Unexpected response:", buf.Len())
+		return
+	}
+}
+
+func TestPostEndSilence(t *testing.T) {
+
+	tpl := &testPlaylist{[][]byte{[]byte("123"), []byte("4567")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+	drh.PostEndBehavior = PostEndSilence
+
+	c1, c2 := net.Pipe()
+
+	done := make(chan bool)
+
+	go func() {
+		drh.HandleRequest(c1, nil)
+		close(done)
+	}()
+
+	c2.Write([]byte("GET /testpath HTTP/1.1\r\n\r\n"))
+
+	// Read the headers, the playlist and a few frames after the playlist has ended
+
+	res := make([]byte, 66+7+3*FrameSize)
+
+	if _, err := io.ReadFull(c2, res); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if string(res[:66+7]) != "ICY 200 OK\r\n"+
+		"Content-Type: Test/Content\r\n"+
+		"icy-name: TestPlaylist\r\n"+
+		"\r\n"+
+		"1234567" {
+		t.Error("Unexpected response:", string(res[:66+7]))
+		return
+	}
+
+	if !bytes.Equal(res[66+7:], make([]byte, 3*FrameSize)) {
+		t.Error("Unexpected data after playlist end")
+		return
+	}
+
+	select {
+	case <-done:
+		t.Error("Connection was closed after playlist end")
+		return
+	default:
+	}
+
+	// The stream ends once the client disconnects
+
+	c2.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("Server did not stop writing")
+		return
+	}
+
+	if stats := drh.ConnectionStats(); stats != (ConnectionStats{1, 0, 0, 0}) {
+		t.Error("Unexpected stats:", stats)
+		return
+	}
+}
+
+func TestMaxBytesPerSecond(t *testing.T) {
+
+	frames := make([][]byte, 10)
+	for i := range frames {
+		frames[i] = bytes.Repeat([]byte("x"), 200)
+	}
+
+	tpl := &testPlaylist{frames, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+	drh.MaxBytesPerSecond = 5000
+
+	testConn := &testutil.ErrorTestingConnection{}
+
+	start := time.Now()
+
+	drh.defaultServeRequest(testConn, &RequestInfo{Path: "/testpath"})
+
+	// Headers and 2000 bytes of data at 5000 bytes per second
+
+	if d := time.Since(start); d < 400*time.Millisecond || d > 2*time.Second {
+		t.Error("Unexpected transfer time:", d)
+		return
+	}
+
+	if !strings.HasSuffix(testConn.Out.String(), string(bytes.Repeat([]byte("x"), 2000))) {
+		t.Error("Unexpected response:", testConn.Out.Len())
+		return
+	}
+
+	// No limit by default
+
+	tpl.fp = 0
+	drh.MaxBytesPerSecond = 0
+	testConn = &testutil.ErrorTestingConnection{}
+
+	start = time.Now()
+
+	drh.defaultServeRequest(testConn, &RequestInfo{Path: "/testpath"})
+
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Error("Unexpected transfer time:", d)
+		return
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var accessLog bytes.Buffer
+
+	tpl := &testPlaylist{[][]byte{[]byte("123"), []byte("4567")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "web:web")
+	drh.AccessLog = &accessLog
+
+	testConn := &testutil.ErrorTestingConnection{}
+	testConn.In.WriteString("GET /testpath HTTP/1.1\r\nAuthorization: Basic d2ViOndlYg==\r\n\r\n")
+
+	drh.HandleRequest(testConn, nil)
+
+	// Headers are 66 bytes and the data 7 bytes
+
+	if testConn.Out.Len() != 73 {
+		t.Error("Unexpected response:", testConn.Out.String())
+		return
+	}
+
+	if ok, _ := regexp.MatchString(`^- - web \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /testpath" 73 \d+m?s\n$`,
+		accessLog.String()); !ok {
+		t.Error("Unexpected access log:", accessLog.String())
+		return
+	}
+
+	// Unauthenticated requests are logged as well
+
+	accessLog.Reset()
+
+	testConn = &testutil.ErrorTestingConnection{}
+	testConn.In.WriteString("GET /testpath HTTP/1.1\r\n\r\n")
+
+	drh.DisableAuthReplay = true
+	drh.HandleRequest(testConn, nil)
+
+	if !strings.HasPrefix(accessLog.String(), "- - - [") ||
+		!strings.Contains(accessLog.String(), fmt.Sprintf(`"GET /testpath" %v `, testConn.Out.Len())) {
+		t.Error("Unexpected access log:", accessLog.String())
+		return
+	}
+}
+
+func TestIcyHeaders(t *testing.T) {
+
+	tpl := &testPlaylist{[][]byte{[]byte("123")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+
+	drh.StatusLine = "ICY 200 Ok"
+	drh.IcyNotice1 = "<BR>This stream requires a player"
+	drh.IcyNotice2 = "DudelDu<BR>"
+	drh.Public = true
+
+	testConn := &testutil.ErrorTestingConnection{}
+
+	drh.defaultServeRequest(testConn, &RequestInfo{Path: "/testpath"})
+
+	if res := testConn.Out.String(); res != "ICY 200 Ok\r\n"+
+		"Content-Type: Test/Content\r\n"+
+		"icy-name: TestPlaylist\r\n"+
+		"icy-notice1: <BR>This stream requires a player\r\n"+
+		"icy-notice2: DudelDu<BR>\r\n"+
+		"icy-pub: 1\r\n"+
+		"\r\n"+
+		"123" {
+		t.Error("Unexpected response:", res)
+		return
+	}
+}
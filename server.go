@@ -11,6 +11,7 @@
 package dudeldu
 
 import (
+	"fmt"
 	"log"
 	"net"
 	"os"
@@ -30,6 +31,12 @@ ConnectionHandler is a function to handle new connections
 */
 type ConnectionHandler func(net.Conn, net.Error)
 
+/*
+MaxAcceptBackoff is the maximum time the server waits before accepting new
+connections after an accept error
+*/
+var MaxAcceptBackoff = time.Second
+
 /*
 DebugLogger is the debug logging interface of the Server
 */
@@ -50,14 +57,33 @@ type DebugLogger interface {
 Server data structure
 */
 type Server struct {
-	Running     bool                   // Flag indicating if the server is running
-	Handler     ConnectionHandler      // Handler function for new  connections
-	DebugOutput bool                   // Enable additional debugging output
-	LogPrint    func(v ...interface{}) // Print logger method.
-	signalling  chan os.Signal         // Channel for receiving signals
-	tcpListener *net.TCPListener       // TCP listener which accepts connections
-	serving     bool                   // Internal flag indicating if the socket should be served
-	wgStatus    *sync.WaitGroup        // Optional wait group which should be notified once the server has started
+	Running               bool                   // Flag indicating if the server is running (use IsRunning while serving)
+	Handler               ConnectionHandler      // Handler function for new  connections
+	DebugOutput           bool                   // Enable additional debugging output
+	LogPrint              func(v ...interface{}) // Print logger method.
+	PollTimeout           time.Duration          // Time to wait for new connections before checking for a shutdown
+	AllowCIDRs            []string               // Networks which may connect (empty allows all networks)
+	DenyCIDRs             []string               // Networks which may not connect (takes precedence over AllowCIDRs)
+	OnError               func(error)            // Optional callback for accept errors and handler panics (called in its own goroutine)
+	SocketWriteBufferSize int                    // Size of the socket send buffer of accepted TCP connections (0 keeps the OS default)
+	allowNets             []*net.IPNet           // Parsed AllowCIDRs
+	denyNets              []*net.IPNet           // Parsed DenyCIDRs
+	signalling            chan os.Signal         // Channel for receiving signals
+	listener              net.Listener           // Listener which accepts connections
+	serving               bool                   // Internal flag indicating if the socket should be served
+	stateLock             sync.RWMutex           // Lock for the running and serving flags and the listener
+	wgStatus              *sync.WaitGroup        // Optional wait group which should be notified once the server has started
+	shuttingDown          bool                   // Internal flag indicating if a shutdown signal has been sent
+	run                   *serverRun             // Current run of the server
+	sleep                 func(time.Duration)    // Function which pauses the accept loop (can be replaced for unit tests)
+}
+
+/*
+serverRun holds the result of a single run of the server.
+*/
+type serverRun struct {
+	done chan struct{} // Channel which is closed once the server has stopped
+	err  error         // Result of the shutdown (only valid once done is closed)
 }
 
 /*
@@ -69,9 +95,51 @@ func NewServer(handler ConnectionHandler) *Server {
 		Handler:     handler,
 		DebugOutput: false,
 		LogPrint:    log.Print,
+		PollTimeout: time.Second,
+		sleep:       time.Sleep,
 	}
 }
 
+/*
+IsRunning returns if the server is running.
+*/
+func (ds *Server) IsRunning() bool {
+	ds.stateLock.RLock()
+	defer ds.stateLock.RUnlock()
+
+	return ds.Running
+}
+
+/*
+setRunning sets the running flag of the server.
+*/
+func (ds *Server) setRunning(running bool) {
+	ds.stateLock.Lock()
+	defer ds.stateLock.Unlock()
+
+	ds.Running = running
+}
+
+/*
+isServing returns if the socket should be served.
+*/
+func (ds *Server) isServing() bool {
+	ds.stateLock.RLock()
+	defer ds.stateLock.RUnlock()
+
+	return ds.serving
+}
+
+/*
+setServing sets the flag which indicates if the socket should be served.
+*/
+func (ds *Server) setServing(serving bool) {
+	ds.stateLock.Lock()
+	defer ds.stateLock.Unlock()
+
+	ds.serving = serving
+}
+
 /*
 IsDebugOutputEnabled returns true if debug output is enabled.
 */
@@ -111,19 +179,67 @@ func (ds *Server) Run(laddr string, wgStatus *sync.WaitGroup) error {
 		return err
 	}
 
-	ds.tcpListener = listener.(*net.TCPListener)
+	return ds.Serve(listener, wgStatus)
+}
+
+/*
+deadlineListener is a listener which supports accept timeouts.
+*/
+type deadlineListener interface {
+	net.Listener
+	SetDeadline(t time.Time) error
+}
+
+/*
+Serve runs the DudelDu Server on an existing listener. The server can be
+stopped via ^C (Control-C) and closes the listener on shutdown.
+
+wgStatus is an optional wait group which will be notified once the server is listening
+and once the server has shutdown.
+
+This function will not return unless the server is shutdown.
+*/
+func (ds *Server) Serve(listener net.Listener, wgStatus *sync.WaitGroup) error {
+	var err error
+
+	// Parse network restrictions
+
+	ds.allowNets, err = parseCIDRs(ds.AllowCIDRs)
+
+	if err == nil {
+		ds.denyNets, err = parseCIDRs(ds.DenyCIDRs)
+	}
+
+	if err != nil {
+		listener.Close()
+
+		if wgStatus != nil {
+			wgStatus.Done()
+		}
+
+		return err
+	}
+
+	ds.stateLock.Lock()
+	ds.listener = listener
 	ds.wgStatus = wgStatus
+	ds.shuttingDown = false
+	ds.run = &serverRun{done: make(chan struct{})}
+	run := ds.run
 
 	// Attach SIGINT handler - on unix and windows this is send
-	// when the user presses ^C (Control-C).
+	// when the user presses ^C (Control-C). The buffer holds a shutdown
+	// signal which is sent while the server is stopped by ^C.
 
-	ds.signalling = make(chan os.Signal)
+	ds.signalling = make(chan os.Signal, 1)
+	ds.stateLock.Unlock()
 	signal.Notify(ds.signalling, syscall.SIGINT)
 
 	// Put the serve call into a wait group so we can wait until shutdown
 	// completed
 
 	var wg sync.WaitGroup
+	var servErr, closeErr error
 	wg.Add(1)
 
 	// Kick off the serve thread
@@ -131,8 +247,8 @@ func (ds *Server) Run(laddr string, wgStatus *sync.WaitGroup) error {
 	go func() {
 		defer wg.Done()
 
-		ds.Running = true
-		ds.serv()
+		ds.setRunning(true)
+		servErr = ds.serv()
 	}()
 
 	for {
@@ -149,18 +265,41 @@ func (ds *Server) Run(laddr string, wgStatus *sync.WaitGroup) error {
 
 			// Shutdown the server
 
+			ds.stateLock.Lock()
 			ds.serving = false
+			ds.shuttingDown = true
+			ds.stateLock.Unlock()
+
+			// Listeners without accept timeouts must be closed to stop
+			// waiting for new connections
+
+			if _, ok := ds.listener.(deadlineListener); !ok {
+				closeErr = ds.listener.Close()
+			}
 
 			// Wait until the server has shut down
 
 			wg.Wait()
 
-			ds.Running = false
+			ds.setRunning(false)
 
 			break
 		}
 	}
 
+	if closeErr != nil {
+		servErr = closeErr
+	}
+
+	// Notify all callers which wait for the shutdown
+
+	ds.stateLock.Lock()
+	ds.shuttingDown = false
+	ds.stateLock.Unlock()
+
+	run.err = servErr
+	close(run.done)
+
 	if wgStatus != nil {
 		wgStatus.Done()
 	}
@@ -168,45 +307,240 @@ func (ds *Server) Run(laddr string, wgStatus *sync.WaitGroup) error {
 	return nil
 }
 
+/*
+Addr returns the address the server is listening on. Returns nil if the
+server has not been started.
+*/
+func (ds *Server) Addr() net.Addr {
+	ds.stateLock.RLock()
+	defer ds.stateLock.RUnlock()
+
+	if ds.listener == nil {
+		return nil
+	}
+
+	return ds.listener.Addr()
+}
+
+/*
+isAllowed checks if a remote address may connect to the server.
+*/
+func (ds *Server) isAllowed(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+
+	for _, n := range ds.denyNets {
+		if n.Contains(tcpAddr.IP) {
+			return false
+		}
+	}
+
+	for _, n := range ds.allowNets {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return len(ds.allowNets) == 0
+}
+
+/*
+parseCIDRs parses a list of networks in CIDR notation.
+*/
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var ret []*net.IPNet
+
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, n)
+	}
+
+	return ret, nil
+}
+
 /*
 Shutdown sends a shutdown signal.
 */
 func (ds *Server) Shutdown() {
-	if ds.serving {
+	ds.sendShutdown()
+}
+
+/*
+ShutdownAndWait sends a shutdown signal and waits until the server has stopped
+and the listener has been closed. Returns the error (if any) from closing the
+listener.
+*/
+func (ds *Server) ShutdownAndWait() error {
+	run := ds.sendShutdown()
+
+	if run == nil {
+		return nil
+	}
+
+	<-run.done
+
+	return run.err
+}
+
+/*
+sendShutdown sends the shutdown signal unless a shutdown is already in progress.
+Returns the current run of the server or nil if the server is not serving.
+*/
+func (ds *Server) sendShutdown() *serverRun {
+	ds.stateLock.Lock()
+
+	if !ds.serving && !ds.shuttingDown {
+		ds.stateLock.Unlock()
+		return nil
+	}
+
+	send := !ds.shuttingDown
+	ds.shuttingDown = true
+	run := ds.run
+
+	ds.stateLock.Unlock()
+
+	// The serve loop receives only a single signal
+
+	if send {
 		ds.signalling <- syscall.SIGINT
 	}
+
+	return run
+}
+
+/*
+handle calls the connection handler. A panic of the handler is recovered and
+closes the connection.
+*/
+func (ds *Server) handle(c net.Conn, netErr net.Error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			err := fmt.Errorf("Handler panic: %v", r)
+
+			if ds.IsDebugOutputEnabled() {
+				ds.PrintDebug(err)
+			}
+
+			if c != nil {
+				c.Close()
+			}
+
+			ds.reportError(err)
+		}
+	}()
+
+	ds.Handler(c, netErr)
+}
+
+/*
+reportError sends an error to the OnError callback (if set) without blocking
+the caller.
+*/
+func (ds *Server) reportError(err error) {
+	if ds.OnError != nil {
+		go ds.OnError(err)
+	}
 }
 
 /*
 serv waits for new connections and assigns a handler to them.
 */
-func (ds *Server) serv() {
+func (ds *Server) serv() error {
+	var backoff time.Duration
 
-	ds.serving = true
+	ds.setServing(true)
 
-	for ds.serving {
+	// Notify wgStatus if it was specified - the listener accepts
+	// connections from now on
 
-		// Wait up to a second for a new connection
+	if ds.wgStatus != nil {
+		ds.wgStatus.Done()
+		ds.wgStatus = nil
+	}
+
+	for ds.isServing() {
 
-		ds.tcpListener.SetDeadline(time.Now().Add(time.Second))
-		newConn, err := ds.tcpListener.Accept()
+		// Wait up to PollTimeout for a new connection - an unset timeout
+		// would make every accept time out immediately
 
-		// Notify wgStatus if it was specified
+		if dl, ok := ds.listener.(deadlineListener); ok {
+			pollTimeout := ds.PollTimeout
+			if pollTimeout <= 0 {
+				pollTimeout = time.Second
+			}
 
-		if ds.wgStatus != nil {
-			ds.wgStatus.Done()
-			ds.wgStatus = nil
+			dl.SetDeadline(time.Now().Add(pollTimeout))
 		}
 
+		newConn, err := ds.listener.Accept()
+
 		netErr, ok := err.(net.Error)
 
 		// Check if got an error and notify an error handler
 
-		if newConn != nil || (ok && !(netErr.Timeout() || netErr.Temporary())) {
+		if newConn != nil && !ds.isAllowed(newConn.RemoteAddr()) {
+
+			// Refuse connections from denied networks
 
-			go ds.Handler(newConn, netErr)
+			if ds.IsDebugOutputEnabled() {
+				ds.PrintDebug("Refused connection from: ", newConn.RemoteAddr())
+			}
+
+			newConn.Close()
+
+		} else if newConn != nil || (ds.isServing() && ok && !(netErr.Timeout() || netErr.Temporary())) {
+
+			// Use a larger send buffer to absorb bursts
+
+			if tcpConn, ok := newConn.(*net.TCPConn); ok && ds.SocketWriteBufferSize > 0 {
+				if err := tcpConn.SetWriteBuffer(ds.SocketWriteBufferSize); err != nil && ds.IsDebugOutputEnabled() {
+					ds.PrintDebug("Could not set socket write buffer: ", err)
+				}
+			}
+
+			go ds.handle(newConn, netErr)
+		}
+
+		// Wait with an increasing time after accept errors (e.g. too many
+		// open files) - timeouts are expected while waiting for connections
+
+		if err != nil && ds.isServing() && !(ok && netErr.Timeout()) {
+
+			if backoff *= 2; backoff == 0 {
+				backoff = 5 * time.Millisecond
+			}
+
+			if backoff > MaxAcceptBackoff {
+				backoff = MaxAcceptBackoff
+			}
+
+			if ds.IsDebugOutputEnabled() {
+				ds.PrintDebug("Accept error (retrying in ", backoff, "): ", err)
+			}
+
+			ds.reportError(err)
+
+			ds.sleep(backoff)
+
+		} else {
+
+			backoff = 0
 		}
 	}
 
-	ds.tcpListener.Close()
+	// Listeners without accept timeouts have already been closed
+
+	if _, ok := ds.listener.(deadlineListener); !ok {
+		return nil
+	}
+
+	return ds.listener.Close()
 }
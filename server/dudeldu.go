@@ -28,6 +28,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"devt.de/krotik/dudeldu"
 	"devt.de/krotik/dudeldu/playlist"
@@ -77,6 +78,17 @@ var print = consolelogger(func(a ...interface{}) {
 
 var lookupEnv func(string) (string, bool) = os.LookupEnv
 
+/*
+Exit function which is called with a non-zero code if a check found problems
+or an option is invalid (can be replaced for unit tests).
+*/
+var exit = os.Exit
+
+/*
+Interval in which an authentication file is checked for changes
+*/
+var authFileInterval = 5 * time.Second
+
 /*
 DudelDu server instance (used by unit tests)
 */
@@ -92,20 +104,26 @@ func main() {
 	print(fmt.Sprintf("DudelDu %v", dudeldu.ProductVersion))
 
 	auth := flag.String("auth", "", "Authentication as <user>:<pass>")
+	authFile := flag.String("authfile", "", "File with <user>:<pass> lines (changes are picked up while running)")
 	serverHost := flag.String("host", DefaultConfig[ServerHost].(string), "Server hostname to listen on")
 	serverPort := flag.String("port", DefaultConfig[ServerPort].(string), "Server port to listen on")
 	threadPoolSize := flag.Int("tps", DefaultConfig[ThreadPoolSize].(int), "Thread pool size")
 	frameQueueSize := flag.Int("fqs", DefaultConfig[FrameQueueSize].(int), "Frame queue size")
+	metaDataInterval := flag.Int("metaint", int(dudeldu.MetaDataInterval), "Interval in bytes in which meta data is sent (0 disables meta data)")
+	frameSize := flag.Int("framesize", playlist.FrameSize, "Size of the frames which are sent to clients")
 	pathPrefix := flag.String("pp", DefaultConfig[PathPrefix].(string), "Prefix all paths with a string")
 	enableDebug := flag.Bool("debug", false, "Enable extra debugging output")
+	logFormat := flag.String("logformat", "text", "Format of the debugging output: text or json")
 	loopPlaylist := flag.Bool("loop", false, "Loop playlists")
 	shufflePlaylist := flag.Bool("shuffle", false, "Shuffle playlists")
+	checkOnly := flag.Bool("check", false, "Validate the playlist and exit without serving it")
 	showHelp := flag.Bool("?", false, "Show this help message")
 
 	flag.Usage = func() {
 		print(fmt.Sprintf("Usage of %s [options] <playlist>", os.Args[0]))
 		flag.PrintDefaults()
 		print()
+		print(fmt.Sprint("Use - as playlist to read the playlist definition from stdin."))
 		print(fmt.Sprint("Authentication can also be defined via the environment variable: DUDELDU_AUTH=\"<user>:<pass>\""))
 	}
 
@@ -116,6 +134,33 @@ func main() {
 		return
 	}
 
+	if *logFormat != "text" && *logFormat != "json" {
+		print(fmt.Sprintf("Unknown log format: %v", *logFormat))
+		exit(1)
+		return
+	}
+
+	if *metaDataInterval < 0 {
+		print(fmt.Sprintf("Invalid meta data interval: %v", *metaDataInterval))
+		exit(1)
+		return
+	}
+
+	if *frameSize <= 0 {
+		print(fmt.Sprintf("Invalid frame size: %v", *frameSize))
+		exit(1)
+		return
+	}
+
+	dudeldu.MetaDataInterval = uint64(*metaDataInterval)
+	dudeldu.FrameSize = *frameSize
+	playlist.FrameSize = *frameSize
+
+	if *checkOnly {
+		checkPlaylist(flag.Arg(0), *pathPrefix)
+		return
+	}
+
 	// Check for auth environment variable
 
 	if envAuth, ok := lookupEnv("DUDELDU_AUTH"); ok && *auth == "" {
@@ -127,18 +172,30 @@ func main() {
 	print(fmt.Sprintf("Serving playlist %v on %v", flag.Arg(0), laddr))
 	print(fmt.Sprintf("Thread pool size: %v", *threadPoolSize))
 	print(fmt.Sprintf("Frame queue size: %v", *frameQueueSize))
+	print(fmt.Sprintf("Meta data interval: %v", dudeldu.MetaDataInterval))
+	print(fmt.Sprintf("Frame size: %v", playlist.FrameSize))
 	print(fmt.Sprintf("Loop playlist: %v", *loopPlaylist))
 	print(fmt.Sprintf("Shuffle playlist: %v", *shufflePlaylist))
 	print(fmt.Sprintf("Path prefix: %v", *pathPrefix))
 	if *auth != "" {
 		print(fmt.Sprintf("Required authentication: %v", *auth))
 	}
+	if *authFile != "" {
+		print(fmt.Sprintf("Authentication file: %v", *authFile))
+	}
 
 	// Create server and listen
 
-	plf, err = playlist.NewFilePlaylistFactory(flag.Arg(0), *pathPrefix)
+	fplf, err := playlist.NewFilePlaylistFactory(flag.Arg(0), *pathPrefix)
 
 	if err == nil {
+		plf = fplf
+
+		// Problems in the playlist definition are reported but do not prevent startup
+
+		if verr := fplf.Validate(); verr != nil {
+			print(fmt.Sprintf("Playlist problems: %v", verr))
+		}
 
 		rh := dudeldu.NewDefaultRequestHandler(plf, *loopPlaylist, *shufflePlaylist, *auth)
 		dds = dudeldu.NewServer(rh.HandleRequest)
@@ -146,12 +203,49 @@ func main() {
 
 		rh.SetDebugLogger(dds)
 
-		defer print("Shutting down")
+		if *logFormat == "json" {
+			logger := dudeldu.NewJSONLogger(os.Stderr, *enableDebug)
+			dds.LogPrint = logger.PrintDebug
+			rh.SetDebugLogger(logger)
+		}
+
+		if *authFile != "" {
+			var stopWatching func()
+
+			if stopWatching, err = rh.WatchAuthFile(*authFile, authFileInterval); err == nil {
+				defer stopWatching()
+			}
+		}
 
-		err = dds.Run(laddr, nil)
+		if err == nil {
+			defer print("Shutting down")
+
+			err = dds.Run(laddr, nil)
+		}
 	}
 
 	if err != nil {
 		fatal(err)
 	}
 }
+
+/*
+checkPlaylist loads and validates a playlist definition. Exits with a non-zero
+code if the playlist has problems.
+*/
+func checkPlaylist(path string, pathPrefix string) {
+
+	fplf, err := playlist.NewFilePlaylistFactory(path, pathPrefix)
+
+	if err == nil {
+		err = fplf.Validate()
+	}
+
+	if err != nil {
+		print(fmt.Sprintf("Playlist problems: %v", err))
+		exit(1)
+		return
+	}
+
+	print(fmt.Sprintf("Playlist %v is valid", path))
+}
@@ -15,7 +15,9 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"strings"
 	"testing"
 
 	"devt.de/krotik/common/fileutil"
@@ -97,8 +99,12 @@ func TestRequestHandlerFilePlaylist(t *testing.T) {
 	testConn := &testutil.ErrorTestingConnection{}
 	dudeldu.MetaDataInterval = 5
 	playlist.FrameSize = 5
+	defer func() {
+		dudeldu.MetaDataInterval = 65536
+		playlist.FrameSize = dudeldu.FrameSize
+	}()
 
-	drh.ServeRequest(testConn, "/testpath", true, 2, "")
+	drh.ServeRequest(testConn, &dudeldu.RequestInfo{Path: "/testpath", MetaDataSupport: true, Offset: 2, Auth: ""})
 
 	if testConn.Out.String() != ("ICY 200 OK\r\n" +
 		"Content-Type: audio/mpeg\r\n" +
@@ -106,10 +112,10 @@ func TestRequestHandlerFilePlaylist(t *testing.T) {
 		"icy-metadata: 1\r\n" +
 		"icy-metaint: 5\r\n" +
 		"\r\n" +
-		`cdefg` + string(0x02) + `StreamTitle='test2 - artist2';` + string([]byte{0x0, 0x0}) +
-		`h1234` + string(0x02) + `StreamTitle='test3 - artist3';` + string([]byte{0x0, 0x0}) +
-		`5???!` + string(0x02) + `StreamTitle='test3 - artist3';` + string([]byte{0x0, 0x0}) +
-		`!!&&&` + string(0x02) + `StreamTitle='test3 - artist3';` + string([]byte{0x0, 0x0}) +
+		`cdefg` + string(rune(0x02)) + `StreamTitle='test1 - artist1';` + string([]byte{0x0, 0x0}) +
+		`h1234` + string(rune(0x02)) + `StreamTitle='test2 - artist2';` + string([]byte{0x0, 0x0}) +
+		`5???!` + string(rune(0x02)) + `StreamTitle='test3 - artist3';` + string([]byte{0x0, 0x0}) +
+		`!!&&&` + string(rune(0x02)) + `StreamTitle='test3 - artist3';` + string([]byte{0x0, 0x0}) +
 		`$$$`) {
 
 		t.Error("Unexpected response:", testConn.Out.String())
@@ -150,14 +156,24 @@ Usage of dudeldu [options] <playlist>
   -?	Show this help message
   -auth string
     	Authentication as <user>:<pass>
+  -authfile string
+    	File with <user>:<pass> lines (changes are picked up while running)
+  -check
+    	Validate the playlist and exit without serving it
   -debug
     	Enable extra debugging output
   -fqs int
     	Frame queue size (default 10000)
+  -framesize int
+    	Size of the frames which are sent to clients (default 3000)
   -host string
     	Server hostname to listen on (default "127.0.0.1")
+  -logformat string
+    	Format of the debugging output: text or json (default "text")
   -loop
     	Loop playlists
+  -metaint int
+    	Interval in bytes in which meta data is sent (0 disables meta data) (default 65536)
   -port string
     	Server port to listen on (default "9091")
   -pp string
@@ -167,6 +183,7 @@ Usage of dudeldu [options] <playlist>
   -tps int
     	Thread pool size (default 10)
 
+Use - as playlist to read the playlist definition from stdin.
 Authentication can also be defined via the environment variable: DUDELDU_AUTH="<user>:<pass>"
 ` {
 		t.Error("Unexpected output:", "#"+ret+"#", err)
@@ -190,6 +207,8 @@ DudelDu `[1:]+dudeldu.ProductVersion+`
 Serving playlist test.dpl on 127.0.0.1:-1
 Thread pool size: 10
 Frame queue size: 10000
+Meta data interval: 65536
+Frame size: 3000
 Loop playlist: false
 Shuffle playlist: false
 Path prefix: 
@@ -201,6 +220,8 @@ DudelDu `[1:]+dudeldu.ProductVersion+`
 Serving playlist test.dpl on 127.0.0.1:-1
 Thread pool size: 10
 Frame queue size: 10000
+Meta data interval: 65536
+Frame size: 3000
 Loop playlist: false
 Shuffle playlist: false
 Path prefix: 
@@ -211,6 +232,157 @@ Shutting down
 		t.Error("Unexpected output:", ret, err)
 		return
 	}
+
+	// Meta data interval and frame size can be set
+
+	defer func() {
+		dudeldu.MetaDataInterval = 65536
+		dudeldu.FrameSize = 3000
+		playlist.FrameSize = dudeldu.FrameSize
+	}()
+
+	os.Args = []string{"dudeldu", "-metaint", "8192", "-framesize", "1000", "-port", "-1", "test.dpl"}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+
+	if ret, err := execMain(); err != nil || !strings.Contains(ret, `
+Meta data interval: 8192
+Frame size: 1000
+`) {
+		t.Error("Unexpected output:", ret, err)
+		return
+	}
+
+	if dudeldu.MetaDataInterval != 8192 || dudeldu.FrameSize != 1000 || playlist.FrameSize != 1000 {
+		t.Error("Unexpected values:", dudeldu.MetaDataInterval, dudeldu.FrameSize, playlist.FrameSize)
+		return
+	}
+
+	// Playlist frames and frames of the request handler have the new size
+
+	if sizes, err := streamFrameSizes(); err != nil || fmt.Sprint(sizes) != "[1000 1000 500 1000]" {
+		t.Error("Unexpected frame sizes:", sizes, err)
+		return
+	}
+
+	// Invalid options exit with a non-zero code
+
+	exitCode := 0
+	exit = func(code int) {
+		exitCode = code
+	}
+	defer func() {
+		exit = os.Exit
+	}()
+
+	os.Args = []string{"dudeldu", "-metaint", "-1", "test.dpl"}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+
+	if ret, err := execMain(); err != nil || exitCode != 1 || ret != `
+DudelDu `[1:]+dudeldu.ProductVersion+`
+Invalid meta data interval: -1
+` {
+		t.Error("Unexpected output:", ret, exitCode, err)
+		return
+	}
+
+	exitCode = 0
+	os.Args = []string{"dudeldu", "-framesize", "0", "test.dpl"}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+
+	if ret, err := execMain(); err != nil || exitCode != 1 || ret != `
+DudelDu `[1:]+dudeldu.ProductVersion+`
+Invalid frame size: 0
+` {
+		t.Error("Unexpected output:", ret, exitCode, err)
+		return
+	}
+
+	exitCode = 0
+	os.Args = []string{"dudeldu", "-logformat", "xml", "test.dpl"}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+
+	if ret, err := execMain(); err != nil || exitCode != 1 || ret != `
+DudelDu `[1:]+dudeldu.ProductVersion+`
+Unknown log format: xml
+` {
+		t.Error("Unexpected output:", ret, exitCode, err)
+		return
+	}
+
+	// Check a playlist without serving it
+
+	exitCode = 0
+
+	os.Args = []string{"dudeldu", "-check", "test.dpl"}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+
+	if ret, err := execMain(); err != nil || exitCode != 0 || ret != `
+DudelDu `[1:]+dudeldu.ProductVersion+`
+Playlist test.dpl is valid
+` {
+		t.Error("Unexpected output:", ret, exitCode, err)
+		return
+	}
+
+	ioutil.WriteFile("test.dpl", []byte(`{"/foo" : [{"artist" : "a", "title" : "t", "path" : "missing.mp3"}]}`), 0644)
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+
+	if ret, err := execMain(); err != nil || exitCode != 1 || ret != `
+DudelDu `[1:]+dudeldu.ProductVersion+`
+Playlist problems: Item missing.mp3 of /foo cannot be read: open missing.mp3: no such file or directory
+` {
+		t.Error("Unexpected output:", ret, exitCode, err)
+		return
+	}
+}
+
+/*
+streamFrameSizes streams a playlist with a single file of 2500 bytes followed by
+silence and returns the sizes of the first written frames.
+*/
+func streamFrameSizes() ([]int, error) {
+	var sizes []int
+
+	os.Mkdir(pdir, 0770)
+	defer os.RemoveAll(pdir)
+
+	ioutil.WriteFile(pdir+"/framesize.mp3", make([]byte, 2500), 0644)
+	ioutil.WriteFile(pdir+"/framesize.dpl", []byte(`{
+	"/framesize" : [
+		{ "artist" : "artist1", "title" : "test1", "path" : "`+pdir+`/framesize.mp3" }
+	]
+}`), 0644)
+
+	fac, err := playlist.NewFilePlaylistFactory(pdir+"/framesize.dpl", "")
+	if err != nil {
+		return nil, err
+	}
+
+	drh := dudeldu.NewDefaultRequestHandler(fac, false, false, "")
+	drh.PostEndBehavior = dudeldu.PostEndSilence
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	go drh.ServeRequest(c1, &dudeldu.RequestInfo{Path: "/framesize"})
+
+	// Skip the headers - a read on a pipe returns at most a single write
+
+	buf := make([]byte, 10000)
+
+	if _, err := c2.Read(buf); err != nil {
+		return nil, err
+	}
+
+	for len(sizes) < 4 {
+		n, err := c2.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, n)
+	}
+
+	return sizes, nil
 }
 
 /*
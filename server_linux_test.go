@@ -0,0 +1,62 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package dudeldu
+
+import (
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+func TestServerSocketWriteBufferSize(t *testing.T) {
+	sizes := make(chan int, 1)
+
+	dds := NewServer(func(c net.Conn, err net.Error) {
+		defer c.Close()
+
+		size := -1
+
+		if raw, err := c.(*net.TCPConn).SyscallConn(); err == nil {
+			raw.Control(func(fd uintptr) {
+				size, _ = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+			})
+		}
+
+		sizes <- size
+	})
+	dds.SocketWriteBufferSize = 32768
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go dds.Run("localhost:0", &wg)
+
+	wg.Wait()
+
+	conn, err := net.Dial("tcp", dds.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	conn.Close()
+
+	// The OS may adjust the size (e.g. Linux doubles it)
+
+	if size := <-sizes; size < dds.SocketWriteBufferSize {
+		t.Error("Unexpected socket write buffer size:", size)
+		return
+	}
+
+	wg.Add(1)
+
+	dds.ShutdownAndWait()
+}
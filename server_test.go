@@ -12,11 +12,14 @@ package dudeldu
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 var testport = "localhost:9090"
@@ -103,6 +106,442 @@ func TestServer(t *testing.T) {
 	wg.Wait()
 }
 
+func TestServerShutdownAndWait(t *testing.T) {
+
+	dds := NewServer(func(c net.Conn, err net.Error) {
+		c.Close()
+	})
+
+	if err := dds.ShutdownAndWait(); err != nil {
+		t.Error("Shutting down a stopped server should do nothing:", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go dds.Run(testport, &wg)
+
+	wg.Wait()
+
+	if !dds.IsRunning() {
+		t.Error("Server should be running")
+		return
+	}
+
+	// The wait group is notified again on shutdown
+
+	wg.Add(1)
+
+	if err := dds.ShutdownAndWait(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if dds.IsRunning() {
+		t.Error("Server should not be running")
+		return
+	}
+
+	// The listener must be closed
+
+	if _, err := net.Dial("tcp", testport); err == nil {
+		t.Error("Listener should be closed")
+		return
+	}
+}
+
+func TestServerConcurrentShutdown(t *testing.T) {
+
+	dds := NewServer(func(c net.Conn, err net.Error) {
+		c.Close()
+	})
+	dds.PollTimeout = 10 * time.Millisecond
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go dds.Serve(listener, &wg)
+
+	wg.Wait()
+	wg.Add(1)
+
+	// Concurrent callers all return once the server has stopped
+
+	var callers sync.WaitGroup
+
+	for i := 0; i < 5; i++ {
+		callers.Add(2)
+
+		go func() {
+			defer callers.Done()
+			dds.ShutdownAndWait()
+		}()
+
+		go func() {
+			defer callers.Done()
+			dds.Shutdown()
+		}()
+	}
+
+	done := make(chan bool)
+
+	go func() {
+		callers.Wait()
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("Shutdown callers should not block")
+		return
+	}
+
+	if dds.IsRunning() {
+		t.Error("Server should not be running")
+		return
+	}
+
+	if err := dds.ShutdownAndWait(); err != nil {
+		t.Error("Shutting down a stopped server should do nothing:", err)
+		return
+	}
+}
+
+func TestServerPollTimeout(t *testing.T) {
+
+	dds := NewServer(func(c net.Conn, err net.Error) {
+		c.Close()
+	})
+
+	if dds.PollTimeout != time.Second {
+		t.Error("Unexpected default poll timeout:", dds.PollTimeout)
+		return
+	}
+
+	dds.PollTimeout = 10 * time.Millisecond
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go dds.Run(testport, &wg)
+
+	wg.Wait()
+	wg.Add(1)
+
+	start := time.Now()
+
+	dds.ShutdownAndWait()
+
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Error("Shutdown took too long:", d)
+		return
+	}
+}
+
+/*
+testDeadlineListener is a listener which records the deadlines of accept calls
+*/
+type testDeadlineListener struct {
+	*net.TCPListener
+	deadlines chan time.Duration
+}
+
+func (l *testDeadlineListener) SetDeadline(t time.Time) error {
+	select {
+	case l.deadlines <- time.Until(t):
+	default:
+	}
+	return l.TCPListener.SetDeadline(t)
+}
+
+func TestServerZeroPollTimeout(t *testing.T) {
+
+	// A server without a poll timeout waits a second for new connections
+
+	dds := &Server{Handler: func(c net.Conn, err net.Error) {
+		c.Close()
+	}}
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dl := &testDeadlineListener{listener.(*net.TCPListener), make(chan time.Duration, 10)}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go dds.Serve(dl, &wg)
+
+	wg.Wait()
+	wg.Add(1)
+
+	defer dds.ShutdownAndWait()
+
+	if d := <-dl.deadlines; d < 500*time.Millisecond || d > time.Second {
+		t.Error("Unexpected deadline:", d)
+		return
+	}
+}
+
+func TestServerAddr(t *testing.T) {
+
+	dds := NewServer(func(c net.Conn, err net.Error) {
+		c.Write([]byte("Hello"))
+		c.Close()
+	})
+
+	if addr := dds.Addr(); addr != nil {
+		t.Error("Server should have no address before it was started:", addr)
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go dds.Run("localhost:0", &wg)
+
+	wg.Wait()
+
+	addr := dds.Addr()
+
+	if addr == nil || addr.(*net.TCPAddr).Port == 0 {
+		t.Error("Unexpected server address:", addr)
+		return
+	}
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var buf bytes.Buffer
+	io.Copy(&buf, conn)
+	conn.Close()
+
+	if buf.String() != "Hello" {
+		t.Error("Unexpected server response:", buf.String())
+		return
+	}
+
+	wg.Add(1)
+
+	dds.ShutdownAndWait()
+}
+
+/*
+testPlainListener is a listener which does not support accept timeouts
+*/
+type testPlainListener struct {
+	net.Listener
+}
+
+func TestServerServe(t *testing.T) {
+
+	dds := NewServer(func(c net.Conn, err net.Error) {
+		c.Write([]byte("Hello"))
+		c.Close()
+	})
+
+	for _, wrap := range []func(net.Listener) net.Listener{
+		func(l net.Listener) net.Listener { return l },
+		func(l net.Listener) net.Listener { return &testPlainListener{l} },
+	} {
+		listener, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+
+		go dds.Serve(wrap(listener), &wg)
+
+		wg.Wait()
+
+		if addr := dds.Addr(); addr.String() != listener.Addr().String() {
+			t.Error("Unexpected server address:", addr)
+			return
+		}
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		var buf bytes.Buffer
+		io.Copy(&buf, conn)
+		conn.Close()
+
+		if buf.String() != "Hello" {
+			t.Error("Unexpected server response:", buf.String())
+			return
+		}
+
+		wg.Add(1)
+
+		if err := dds.ShutdownAndWait(); err != nil {
+			t.Error(err)
+			return
+		}
+
+		// The listener is closed on shutdown
+
+		if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+			t.Error("Listener should be closed")
+			return
+		}
+	}
+}
+
+/*
+testErrorListener is a listener whose Accept always fails
+*/
+type testErrorListener struct {
+	net.Listener
+	accepts int
+}
+
+func (l *testErrorListener) Accept() (net.Conn, error) {
+	l.accepts++
+	return nil, errors.New("too many open files")
+}
+
+func TestServerAcceptBackoff(t *testing.T) {
+	var sleeps []time.Duration
+	var out bytes.Buffer
+	var outLock sync.Mutex
+
+	// The serve loop and the accept loop log from different goroutines
+
+	dds := NewServer(func(c net.Conn, err net.Error) {
+	})
+	dds.DebugOutput = true
+	dds.LogPrint = func(v ...interface{}) {
+		outLock.Lock()
+		defer outLock.Unlock()
+
+		out.WriteString(fmt.Sprint(v...))
+		out.WriteString("\n")
+	}
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	el := &testErrorListener{Listener: listener}
+
+	dds.sleep = func(d time.Duration) {
+		sleeps = append(sleeps, d)
+
+		if len(sleeps) == 10 {
+			go dds.Shutdown()
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	dds.Serve(el, nil)
+
+	// The wait time doubles with every error up to the maximum
+
+	if len(sleeps) < 10 || sleeps[0] != 5*time.Millisecond || sleeps[1] != 10*time.Millisecond ||
+		sleeps[7] != 640*time.Millisecond || sleeps[8] != MaxAcceptBackoff || sleeps[9] != MaxAcceptBackoff {
+		t.Error("Unexpected backoff:", sleeps)
+		return
+	}
+
+	if el.accepts != len(sleeps) {
+		t.Error("Unexpected number of accepts:", el.accepts, len(sleeps))
+		return
+	}
+
+	outLock.Lock()
+	defer outLock.Unlock()
+
+	if !strings.Contains(out.String(), "Accept error (retrying in 5ms): too many open files") {
+		t.Error("Unexpected output:", out.String())
+		return
+	}
+}
+
+func TestServerOnError(t *testing.T) {
+	errs := make(chan error, 10)
+
+	dds := NewServer(func(c net.Conn, err net.Error) {
+		panic("boom")
+	})
+	dds.OnError = func(err error) {
+		errs <- err
+	}
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var shutdown sync.Once
+
+	dds.sleep = func(d time.Duration) {
+		shutdown.Do(func() { go dds.Shutdown() })
+		time.Sleep(time.Millisecond)
+	}
+
+	dds.Serve(&testErrorListener{Listener: listener}, nil)
+
+	select {
+	case err := <-errs:
+		if err.Error() != "too many open files" {
+			t.Error("Unexpected error:", err)
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("OnError was not called")
+		return
+	}
+
+	// Handler panics are recovered and reported
+
+	c1, c2 := net.Pipe()
+
+	dds.handle(c1, nil)
+
+	select {
+	case err := <-errs:
+		if err.Error() != "Handler panic: boom" {
+			t.Error("Unexpected error:", err)
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("OnError was not called")
+		return
+	}
+
+	// The connection of the panicking handler was closed
+
+	if _, err := c2.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
+
 func readSocket() (string, error) {
 	conn, err := net.Dial("tcp", testport)
 	if err != nil {
@@ -115,3 +554,72 @@ func readSocket() (string, error) {
 
 	return buf.String(), nil
 }
+
+func TestServerCIDRs(t *testing.T) {
+
+	dds := NewServer(func(c net.Conn, err net.Error) {
+		c.Write([]byte("Hello"))
+		c.Close()
+	})
+	dds.PollTimeout = 10 * time.Millisecond
+
+	var wg sync.WaitGroup
+
+	// Invalid networks are reported
+
+	dds.DenyCIDRs = []string{"foo"}
+	wg.Add(1)
+
+	if err := dds.Run(testport, &wg); err == nil || err.Error() != "invalid CIDR address: foo" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	run := func(allow, deny []string) string {
+		dds.AllowCIDRs = allow
+		dds.DenyCIDRs = deny
+
+		wg.Add(1)
+		go dds.Run(testport, &wg)
+		wg.Wait()
+
+		defer func() {
+			wg.Add(1)
+			dds.ShutdownAndWait()
+		}()
+
+		ret, err := readSocket()
+		if err != nil {
+			return err.Error()
+		}
+
+		return ret
+	}
+
+	if ret := run(nil, []string{"127.0.0.0/8", "::1/128"}); ret != "" {
+		t.Error("Connection should be refused:", ret)
+		return
+	}
+
+	// Deny takes precedence
+
+	if ret := run([]string{"127.0.0.0/8", "::1/128"}, []string{"127.0.0.1/32", "::1/128"}); ret != "" {
+		t.Error("Connection should be refused:", ret)
+		return
+	}
+
+	if ret := run([]string{"10.0.0.0/8"}, nil); ret != "" {
+		t.Error("Connection should be refused:", ret)
+		return
+	}
+
+	if ret := run([]string{"127.0.0.0/8", "::1/128"}, []string{"10.0.0.0/8"}); ret != "Hello" {
+		t.Error("Connection should be accepted:", ret)
+		return
+	}
+
+	if ret := run(nil, nil); ret != "Hello" {
+		t.Error("Connection should be accepted:", ret)
+		return
+	}
+}
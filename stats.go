@@ -0,0 +1,43 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package dudeldu
+
+/*
+ConnectionStats contains the number of streaming connections which were closed
+for a particular reason.
+*/
+type ConnectionStats struct {
+	WriteFailures uint64 // Connections closed because the client did not accept data
+	Completed     uint64 // Connections closed by the server (e.g. MaxStreamDuration was reached)
+	PlaylistEnd   uint64 // Connections closed because the playlist ended
+	Disconnected  uint64 // Connections closed by the client (only detected with DetectDisconnect)
+}
+
+/*
+ConnectionStats returns the number of closed streaming connections by reason.
+A high number of write failures points to slow clients or network problems.
+*/
+func (drh *DefaultRequestHandler) ConnectionStats() ConnectionStats {
+	drh.statsLock.RLock()
+	defer drh.statsLock.RUnlock()
+
+	return drh.stats
+}
+
+/*
+countConnection records the reason why a streaming connection was closed.
+*/
+func (drh *DefaultRequestHandler) countConnection(counter *uint64) {
+	drh.statsLock.Lock()
+	defer drh.statsLock.Unlock()
+
+	*counter++
+}
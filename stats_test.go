@@ -0,0 +1,73 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package dudeldu
+
+import (
+	"testing"
+	"time"
+
+	"devt.de/krotik/common/testutil"
+)
+
+func TestConnectionStats(t *testing.T) {
+
+	tpl := &testPlaylist{[][]byte{[]byte("12345"), []byte("67890")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+
+	request := func(testConn *testutil.ErrorTestingConnection) {
+		tpl.fp = 0
+		drh.ServeRequest(testConn, &RequestInfo{Path: "/testpath"})
+	}
+
+	// A client which reads everything
+
+	request(&testutil.ErrorTestingConnection{})
+
+	if stats := drh.ConnectionStats(); stats != (ConnectionStats{0, 0, 1, 0}) {
+		t.Error("Unexpected stats:", stats)
+		return
+	}
+
+	// A client which stops reading
+
+	request(&testutil.ErrorTestingConnection{OutErr: 70})
+
+	if stats := drh.ConnectionStats(); stats != (ConnectionStats{1, 0, 1, 0}) {
+		t.Error("Unexpected stats:", stats)
+		return
+	}
+
+	// A client which goes away
+
+	request(&testutil.ErrorTestingConnection{OutClose: true})
+
+	if stats := drh.ConnectionStats(); stats != (ConnectionStats{2, 0, 1, 0}) {
+		t.Error("Unexpected stats:", stats)
+		return
+	}
+
+	// A client which streams for too long
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	drh.MaxStreamDuration = time.Second
+	drh.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	request(&testutil.ErrorTestingConnection{})
+
+	if stats := drh.ConnectionStats(); stats != (ConnectionStats{2, 1, 1, 0}) {
+		t.Error("Unexpected stats:", stats)
+		return
+	}
+}
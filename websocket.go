@@ -0,0 +1,119 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package dudeldu
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"regexp"
+)
+
+/*
+webSocketGUID is the magic string which is used to calculate the accept key
+of a WebSocket handshake (see RFC 6455).
+*/
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+/*
+WebSocket opcodes which are used by the server.
+*/
+const (
+	webSocketOpText   = 0x1
+	webSocketOpBinary = 0x2
+)
+
+/*
+requestUpgradePattern is the pattern which is used to detect a WebSocket upgrade request
+(i case-insensitive / m multi-line mode: ^ and $ match begin/end line)
+*/
+var requestUpgradePattern = regexp.MustCompile("(?im)^Upgrade:\\s*websocket\\s*$")
+
+/*
+requestWebSocketKeyPattern is the pattern which is used to extract the WebSocket key
+(i case-insensitive / m multi-line mode: ^ and $ match begin/end line)
+*/
+var requestWebSocketKeyPattern = regexp.MustCompile("(?im)^Sec-WebSocket-Key:\\s*(\\S+)\\s*$")
+
+/*
+webSocketConn is a connection which sends all written data as binary WebSocket
+messages. The connection is upgraded once the playlist has been found.
+*/
+type webSocketConn struct {
+	net.Conn        // Underlying client connection
+	key      string // WebSocket key which was send by the client
+}
+
+/*
+handshake writes the WebSocket upgrade response to the client.
+*/
+func (wsc *webSocketConn) handshake() error {
+	h := sha1.New()
+	h.Write([]byte(wsc.key + webSocketGUID))
+
+	_, err := wsc.Conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(h.Sum(nil)) + "\r\n\r\n"))
+
+	return err
+}
+
+/*
+Write writes data as a binary WebSocket message.
+*/
+func (wsc *webSocketConn) Write(b []byte) (int, error) {
+	return wsc.writeMessage(webSocketOpBinary, b)
+}
+
+/*
+WriteMetaData writes meta data information as a text WebSocket message.
+*/
+func (wsc *webSocketConn) WriteMetaData(playlist Playlist) error {
+	data, _ := json.Marshal(map[string]string{
+		"name":   displayName(playlist),
+		"artist": playlist.Artist(),
+		"title":  playlist.Title(),
+	})
+
+	_, err := wsc.writeMessage(webSocketOpText, data)
+
+	return err
+}
+
+/*
+writeMessage writes a single unmasked WebSocket message to the client.
+*/
+func (wsc *webSocketConn) writeMessage(opcode byte, b []byte) (int, error) {
+	var header []byte
+
+	// Set the FIN bit - messages are never fragmented
+
+	header = append(header, 0x80|opcode)
+
+	if l := len(b); l < 126 {
+		header = append(header, byte(l))
+	} else if l <= 0xFFFF {
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(l))
+	} else {
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(l))
+	}
+
+	if _, err := wsc.Conn.Write(append(header, b...)); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
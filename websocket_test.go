@@ -0,0 +1,124 @@
+/*
+ * DudelDu
+ *
+ * Copyright 2016 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package dudeldu
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+const testWebSocketRequest = "GET /testpath HTTP/1.1\r\n" +
+	"Host: localhost:9091\r\n" +
+	"Upgrade: websocket\r\n" +
+	"Connection: Upgrade\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+	"Sec-WebSocket-Version: 13\r\n\r\n"
+
+func TestWebSocketStreaming(t *testing.T) {
+
+	tpl := &testPlaylist{[][]byte{[]byte("123"), []byte("4567")}, nil, 0}
+	drh := NewDefaultRequestHandler(&testPlaylistFactory{tpl}, false, false, "")
+	drh.SetDebugLogger(&TestDebugLogger{false, nil})
+	drh.WebSocket = true
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	go drh.HandleRequest(server, nil)
+
+	client.Write([]byte(testWebSocketRequest))
+
+	r := bufio.NewReader(client)
+
+	// Read the handshake response
+
+	var response string
+	for !strings.HasSuffix(response, "\r\n\r\n") {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		response += line
+	}
+
+	if response != "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n\r\n" {
+		t.Error("Unexpected response:", response)
+		return
+	}
+
+	// Read the messages
+
+	var messages []string
+	for {
+		opcode, data, err := readTestWebSocketMessage(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Error(err)
+			return
+		}
+		messages = append(messages, string(rune('0'+opcode))+":"+data)
+	}
+
+	if strings.Join(messages, "|") != `1:{"artist":"Test Artist","name":"TestPlaylist","title":"Test Title"}|2:123|2:4567` {
+		t.Error("Unexpected messages:", messages)
+		return
+	}
+
+	// Check that a non-existing stream is not upgraded
+
+	server, client = net.Pipe()
+	defer client.Close()
+
+	go drh.HandleRequest(server, nil)
+
+	client.Write([]byte(strings.Replace(testWebSocketRequest, "/testpath", "/foo", 1)))
+
+	if line, _ := bufio.NewReader(client).ReadString('\n'); line != "HTTP/1.1 404 Not found\r\n" {
+		t.Error("Unexpected response:", line)
+		return
+	}
+}
+
+/*
+readTestWebSocketMessage reads a single unmasked WebSocket message.
+*/
+func readTestWebSocketMessage(r *bufio.Reader) (byte, string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, "", err
+	}
+
+	l := uint64(header[1] & 0x7F)
+
+	if l == 126 {
+		ext := make([]byte, 2)
+		io.ReadFull(r, ext)
+		l = uint64(binary.BigEndian.Uint16(ext))
+	} else if l == 127 {
+		ext := make([]byte, 8)
+		io.ReadFull(r, ext)
+		l = binary.BigEndian.Uint64(ext)
+	}
+
+	data := make([]byte, l)
+	_, err := io.ReadFull(r, data)
+
+	return header[0] & 0x0F, string(data), err
+}